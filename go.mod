@@ -1,3 +1,7 @@
 module github.com/anpep/tftp
 
 go 1.18
+
+require golang.org/x/net v0.33.0
+
+require golang.org/x/sys v0.28.0 // indirect
@@ -0,0 +1,62 @@
+package tftp
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// bandwidthLimiter paces the data sent by several sessions so that their aggregate throughput doesn't exceed a rate.
+//
+// It's a token bucket holding up to a second worth of bytes. Sending takes as many tokens as bytes are sent, and the
+// bucket may go into debt: the sender then sleeps until the debt would be paid off. Since tokens are taken while
+// holding the lock but the sleep happens after releasing it, contending sessions never block each other for longer
+// than needed, and those coming later simply wait for the debt left by the earlier ones
+type bandwidthLimiter struct {
+	rate  float64 // Bytes per second
+	burst float64 // Capacity of the bucket
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time // Last time tokens were added to the bucket
+
+	now   func() time.Time
+	sleep func(d time.Duration)
+}
+
+func newBandwidthLimiter(ctx context.Context, bytesPerSecond int64) *bandwidthLimiter {
+	return &bandwidthLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+		now:    time.Now,
+		sleep: func(d time.Duration) {
+			// Do not hold up sessions being aborted because the server is closed
+			t := time.NewTimer(d)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+			}
+		},
+	}
+}
+
+// wait blocks until n more bytes can be sent without exceeding the rate
+func (l *bandwidthLimiter) wait(n int) {
+	l.mu.Lock()
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	debt := -l.tokens
+	l.mu.Unlock()
+
+	if debt > 0 {
+		l.sleep(time.Duration(debt / l.rate * float64(time.Second)))
+	}
+}
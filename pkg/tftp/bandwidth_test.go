@@ -0,0 +1,121 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock which only moves forward when sleeping, recording every sleep
+type fakeClock struct {
+	mu    sync.Mutex
+	t     time.Time
+	slept []time.Duration
+	// Whether sleeping moves the clock forward
+	advance bool
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slept = append(c.slept, d)
+	if c.advance {
+		c.t = c.t.Add(d)
+	}
+}
+
+// newFakeLimiter returns a limiter of bytesPerSecond with a full bucket, driven by clock
+func newFakeLimiter(bytesPerSecond int64, clock *fakeClock) *bandwidthLimiter {
+	l := newBandwidthLimiter(context.Background(), bytesPerSecond)
+	l.last, l.now, l.sleep = clock.now(), clock.now, clock.sleep
+	return l
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	t.Run("Sending within the limit is not delayed", func(t *testing.T) {
+		clock := &fakeClock{t: time.Unix(0, 0), advance: true}
+		l := newFakeLimiter(1000, clock)
+		l.wait(600)
+		l.wait(400)
+		if len(clock.slept) != 0 {
+			t.Fatalf("got sleeps of %v want none", clock.slept)
+		}
+	})
+
+	t.Run("Sending faster than the limit introduces pacing delays", func(t *testing.T) {
+		clock := &fakeClock{t: time.Unix(0, 0), advance: true}
+		l := newFakeLimiter(1000, clock)
+		l.wait(1000)
+		l.wait(500)
+		l.wait(250)
+		if want := []time.Duration{500 * time.Millisecond, 250 * time.Millisecond}; !reflect.DeepEqual(clock.slept, want) {
+			t.Fatalf("got sleeps of %v want %v", clock.slept, want)
+		}
+	})
+
+	t.Run("Idle time refills the bucket up to a second worth of data", func(t *testing.T) {
+		clock := &fakeClock{t: time.Unix(0, 0), advance: true}
+		l := newFakeLimiter(1000, clock)
+		l.wait(1000)
+		clock.t = clock.t.Add(time.Minute)
+		l.wait(1000)
+		l.wait(1)
+		if want := []time.Duration{time.Millisecond}; !reflect.DeepEqual(clock.slept, want) {
+			t.Fatalf("got sleeps of %v want %v", clock.slept, want)
+		}
+	})
+
+	t.Run("Contending senders share the limit", func(t *testing.T) {
+		// The clock stands still, so every sender waits for the debt left by the previous ones
+		clock := &fakeClock{t: time.Unix(0, 0)}
+		l := newFakeLimiter(1000, clock)
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				l.wait(1000)
+			}()
+		}
+		wg.Wait()
+
+		sort.Slice(clock.slept, func(i, j int) bool { return clock.slept[i] < clock.slept[j] })
+		var want []time.Duration
+		for i := 1; i < 10; i++ {
+			want = append(want, time.Duration(i)*time.Second)
+		}
+		if !reflect.DeepEqual(clock.slept, want) {
+			t.Fatalf("got sleeps of %v want %v", clock.slept, want)
+		}
+	})
+}
+
+func TestServerBandwidthLimit(t *testing.T) {
+	t.Run("Transfers exceeding the limit are paced", func(t *testing.T) {
+		// The first 4096 bytes are sent in a burst, and the following 1024 take a quarter of a second
+		want := bytes.Repeat([]byte("B"), 4096+1024)
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": want}), WithBandwidthLimit(4096))
+
+		start := time.Now()
+		got, err := newTestPeer(t, addr).get("file.bin", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Fatalf("got a transfer taking %v want at least %v", elapsed, 200*time.Millisecond)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes want %d", len(got), len(want))
+		}
+	})
+}
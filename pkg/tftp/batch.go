@@ -0,0 +1,11 @@
+package tftp
+
+import "net"
+
+// batchWriter type sends several datagrams to the same address at once, which saves system calls when sending a
+// window of blocks
+type batchWriter interface {
+	// writeBatch sends datagrams to addr in order, returning how many of them were sent. Datagrams which were not sent
+	// are left to be sent one by one
+	writeBatch(datagrams [][]byte, addr net.Addr) (int, error)
+}
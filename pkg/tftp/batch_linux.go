@@ -0,0 +1,51 @@
+package tftp
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// udpBatchWriter sends several datagrams through a UDP socket with a single call to sendmmsg
+type udpBatchWriter struct {
+	write func(msgs []ipv4.Message, flags int) (int, error)
+	msgs  []ipv4.Message // Reused across batches, since a session sends a single window at a time
+}
+
+// newBatchWriter returns a batchWriter sending datagrams through conn, or nil if conn is not a UDP socket
+func newBatchWriter(conn net.PacketConn) batchWriter {
+	uc, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil
+	}
+	ipv4Conn, err := isIPv4Conn(uc)
+	if err != nil {
+		return nil
+	}
+	if ipv4Conn {
+		return &udpBatchWriter{write: ipv4.NewPacketConn(uc).WriteBatch}
+	}
+	// IPv6 sockets may be dual-stack ones, which send to IPv4 addresses as well
+	return &udpBatchWriter{write: ipv6.NewPacketConn(uc).WriteBatch}
+}
+
+func (w *udpBatchWriter) writeBatch(datagrams [][]byte, addr net.Addr) (int, error) {
+	w.msgs = w.msgs[:0]
+	for i := range datagrams {
+		w.msgs = append(w.msgs, ipv4.Message{Buffers: datagrams[i : i+1 : i+1], Addr: addr})
+	}
+
+	sent := 0
+	for sent < len(w.msgs) {
+		n, err := w.write(w.msgs[sent:], 0)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+		if n == 0 {
+			break
+		}
+	}
+	return sent, nil
+}
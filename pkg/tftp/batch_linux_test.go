@@ -0,0 +1,48 @@
+package tftp
+
+import (
+	"net"
+	"testing"
+)
+
+// BenchmarkWindowSend compares sending a window of 16 DATA packets with a single call to sendmmsg with sending them
+// one by one
+func BenchmarkWindowSend(b *testing.B) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	// Datagrams are sent to a socket nobody reads from, and dropped once its buffer is full
+	dst, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer dst.Close()
+
+	window := make([][]byte, 16)
+	for i := range window {
+		window[i] = make([]byte, 4+1428)
+	}
+
+	b.Run("Batched", func(b *testing.B) {
+		w := newBatchWriter(conn)
+		b.SetBytes(int64(len(window) * 1428))
+		for i := 0; i < b.N; i++ {
+			if _, err := w.writeBatch(window, dst.LocalAddr()); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("PerPacket", func(b *testing.B) {
+		b.SetBytes(int64(len(window) * 1428))
+		for i := 0; i < b.N; i++ {
+			for _, datagram := range window {
+				if _, err := conn.WriteTo(datagram, dst.LocalAddr()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package tftp
+
+import "net"
+
+// newBatchWriter returns nil, since datagrams can't be sent in batches on this platform
+func newBatchWriter(net.PacketConn) batchWriter {
+	return nil
+}
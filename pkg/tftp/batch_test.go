@@ -0,0 +1,133 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// receiveDatagrams reads n datagrams from conn
+func receiveDatagrams(t *testing.T, conn net.PacketConn, n int) []string {
+	t.Helper()
+	var got []string
+	buf := make([]byte, maxDatagramSize)
+	for len(got) < n {
+		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		m, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		got = append(got, string(buf[:m]))
+	}
+	return got
+}
+
+func TestBatchWriter(t *testing.T) {
+	want := []string{"first", "second", "third"}
+	datagrams := make([][]byte, len(want))
+	for i, s := range want {
+		datagrams[i] = []byte(s)
+	}
+
+	for _, local := range []string{"127.0.0.1:0", ":0"} {
+		t.Run(fmt.Sprintf("Batches sent from %s arrive in order", local), func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", local)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			w := newBatchWriter(conn)
+			if w == nil {
+				t.Skip("batches can't be sent on this platform")
+			}
+			dst, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer dst.Close()
+
+			n, err := w.writeBatch(datagrams, dst.LocalAddr())
+			if err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			if n != len(datagrams) {
+				t.Fatalf("got %d datagrams sent want %d", n, len(datagrams))
+			}
+			if got := receiveDatagrams(t, dst, len(want)); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v want %v", got, want)
+			}
+		})
+	}
+
+	t.Run("Batches can't be sent through sockets other than UDP ones", func(t *testing.T) {
+		if w := newBatchWriter(newMemNetwork().listen()); w != nil {
+			t.Fatalf("got %T want none", w)
+		}
+	})
+}
+
+func TestWindowedSend(t *testing.T) {
+	want := bytes.Repeat([]byte("0123456789abcdef"), 10*DefaultBlockSize/16+3)
+	for _, batched := range []bool{true, false} {
+		name := "Windows are sent one datagram at a time when batches are not supported"
+		if batched {
+			name = "Windows are sent in batches when supported"
+		}
+		t.Run(name, func(t *testing.T) {
+			senderConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			receiverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer senderConn.Close()
+			defer receiverConn.Close()
+
+			sender := newSession(senderConn, receiverConn.LocalAddr(), defaultTransferConfig())
+			receiver := newSession(receiverConn, senderConn.LocalAddr(), defaultTransferConfig())
+			if batched && sender.batch == nil {
+				t.Skip("batches can't be sent on this platform")
+			}
+			if !batched {
+				sender.batch = nil
+			}
+			sender.windowSize, receiver.windowSize = 4, 4
+			receiver.prepareACK(0)
+
+			done := make(chan error, 1)
+			go func() {
+				done <- sender.sendFile(bytes.NewReader(want))
+			}()
+			got := bytes.Buffer{}
+			if err := receiver.receiveFile(&got, func() error { return nil }); err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			if err := <-done; err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+			}
+		})
+	}
+
+	t.Run("Clients download windows sent in batches", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": want}))
+		got := bytes.Buffer{}
+		c := newTestClient(t, WithWindowSize(8))
+		if err := c.Get(context.Background(), addr.String(), "file.bin", ModeOctet, &got); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+	})
+}
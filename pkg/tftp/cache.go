@@ -0,0 +1,89 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+)
+
+// DefaultMaxCacheEntrySize is the size of the largest file cached by a CachingFileHandler, unless configured otherwise
+const DefaultMaxCacheEntrySize = 1 << 20
+
+// Cache type stores the contents of files served by a CachingFileHandler. Implementations must be safe for concurrent
+// use, and are free to evict entries at any time
+type Cache interface {
+	// Get returns the contents stored for key, if any. The returned slice must not be modified
+	Get(key string) ([]byte, bool)
+	// Set stores the contents of a file for key. data must not be modified afterwards
+	Set(key string, data []byte)
+}
+
+// CachingFileHandler serves files read from another handler through a cache, so that files requested often are not
+// opened again for every request
+type CachingFileHandler struct {
+	// MaxEntrySize is the size of the largest file cached, in bytes. Larger files are always read from the inner
+	// handler
+	MaxEntrySize int64
+
+	inner Handler
+	cache Cache
+}
+
+// CachingHandler returns a Handler serving the files read from inner through cache. Files are cached by filename and
+// transfer mode, and only once they have been read successfully. Write requests are passed on to inner, but cached
+// contents are not invalidated by them
+func CachingHandler(inner Handler, cache Cache) *CachingFileHandler {
+	return &CachingFileHandler{MaxEntrySize: DefaultMaxCacheEntrySize, inner: inner, cache: cache}
+}
+
+// cacheKey returns the key files are cached with
+func cacheKey(req *Request) string {
+	return strings.ToLower(string(req.Mode)) + "\x00" + req.Filename
+}
+
+func (h *CachingFileHandler) ReadFile(ctx context.Context, req *Request) (io.ReadCloser, error) {
+	key := cacheKey(req)
+	if data, ok := h.cache.Get(key); ok {
+		return memFile{bytes.NewReader(data)}, nil
+	}
+
+	rc, err := h.inner.ReadFile(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if size, ok := fileSize(rc); ok && size > h.MaxEntrySize {
+		return rc, nil
+	}
+
+	// Read one byte past the limit to tell files too large to be cached apart without reading them whole
+	data, err := io.ReadAll(io.LimitReader(rc, h.MaxEntrySize+1))
+	if err != nil {
+		_ = rc.Close()
+		return nil, err
+	}
+	if int64(len(data)) > h.MaxEntrySize {
+		// Serve what has been read so far, followed by the rest of the file
+		return struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), rc), rc}, nil
+	}
+	if err := rc.Close(); err != nil {
+		return nil, err
+	}
+
+	h.cache.Set(key, data)
+	return memFile{bytes.NewReader(data)}, nil
+}
+
+func (h *CachingFileHandler) WriteFile(ctx context.Context, req *Request) (io.WriteCloser, error) {
+	return h.inner.WriteFile(ctx, req)
+}
+
+// RawMode reports whether the inner handler converts files into the requested mode by itself, in which case the
+// converted contents are cached
+func (h *CachingFileHandler) RawMode() bool {
+	r, ok := h.inner.(RawModeHandler)
+	return ok && r.RawMode()
+}
@@ -0,0 +1,129 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// mapCache is a Cache which never evicts entries
+type mapCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+func (c *mapCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data, ok := c.entries[key]
+	return data, ok
+}
+
+func (c *mapCache) Set(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[key] = data
+}
+
+// countingHandler counts the files opened through it
+type countingHandler struct {
+	Handler
+	reads int32
+}
+
+func (h *countingHandler) ReadFile(ctx context.Context, req *Request) (io.ReadCloser, error) {
+	atomic.AddInt32(&h.reads, 1)
+	return h.Handler.ReadFile(ctx, req)
+}
+
+func TestCachingHandler(t *testing.T) {
+	files := map[string][]byte{
+		"small.bin": bytes.Repeat([]byte("small"), 200),
+		"large.bin": bytes.Repeat([]byte("large"), 400),
+	}
+
+	t.Run("Files are read from the inner handler once", func(t *testing.T) {
+		inner := &countingHandler{Handler: MapHandler(files)}
+		addr := startTestServer(t, CachingHandler(inner, &mapCache{entries: make(map[string][]byte)}))
+
+		for i := 0; i < 2; i++ {
+			got, err := newTestPeer(t, addr).get("small.bin", ModeOctet)
+			if err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			if !bytes.Equal(got, files["small.bin"]) {
+				t.Fatalf("got %d bytes want %d", len(got), len(files["small.bin"]))
+			}
+		}
+		if reads := atomic.LoadInt32(&inner.reads); reads != 1 {
+			t.Fatalf("got %v reads want %v", reads, 1)
+		}
+	})
+
+	t.Run("Failed reads are not cached", func(t *testing.T) {
+		inner := &countingHandler{Handler: MapHandler(files)}
+		addr := startTestServer(t, CachingHandler(inner, &mapCache{entries: make(map[string][]byte)}))
+
+		for i := 0; i < 2; i++ {
+			if _, err := newTestPeer(t, addr).get("missing.bin", ModeOctet); !errors.Is(err, ErrorCodeFileNotFound) {
+				t.Fatalf("got %v want %v", err, ErrorCodeFileNotFound)
+			}
+		}
+		if reads := atomic.LoadInt32(&inner.reads); reads != 2 {
+			t.Fatalf("got %v reads want %v", reads, 2)
+		}
+	})
+
+	t.Run("Files larger than the maximum entry size are not cached", func(t *testing.T) {
+		cache := &mapCache{entries: make(map[string][]byte)}
+		h := CachingHandler(struct{ Handler }{MapHandler(files)}, cache)
+		h.MaxEntrySize = 1500
+
+		for _, filename := range []string{"small.bin", "large.bin"} {
+			rc, err := h.ReadFile(context.Background(), &Request{Filename: filename, Mode: ModeOctet})
+			if err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			_ = rc.Close()
+			if !bytes.Equal(got, files[filename]) {
+				t.Fatalf("got %d bytes want %d", len(got), len(files[filename]))
+			}
+		}
+		if _, ok := cache.Get(cacheKey(&Request{Filename: "small.bin", Mode: ModeOctet})); !ok {
+			t.Fatal("small.bin was not cached")
+		}
+		if _, ok := cache.Get(cacheKey(&Request{Filename: "large.bin", Mode: ModeOctet})); ok {
+			t.Fatal("large.bin was cached")
+		}
+	})
+	t.Run("Streams larger than the maximum entry size are served whole but not cached", func(t *testing.T) {
+		cache := &mapCache{entries: make(map[string][]byte)}
+		h := CachingHandler(pipeHandler{data: files["large.bin"]}, cache)
+		h.MaxEntrySize = 1500
+
+		req := &Request{Filename: "large.bin", Mode: ModeOctet}
+		rc, err := h.ReadFile(context.Background(), req)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		got, err := io.ReadAll(rc)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		_ = rc.Close()
+		if !bytes.Equal(got, files["large.bin"]) {
+			t.Fatalf("got %d bytes want %d", len(got), len(files["large.bin"]))
+		}
+		if _, ok := cache.Get(cacheKey(req)); ok {
+			t.Fatal("large.bin was cached")
+		}
+	})
+}
@@ -0,0 +1,472 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrSizeUnsupported is returned by Client.Size when the server doesn't report the size of the file
+	ErrSizeUnsupported = errors.New("server doesn't support the transfer size option")
+	// ErrUploadTooLarge is returned when the server refuses an upload because it has no room for it
+	ErrUploadTooLarge = errors.New("server refused the upload because of its size")
+	// ErrResponseTooLarge is returned by Client.GetBytes when the file is larger than the maximum response size
+	ErrResponseTooLarge = errors.New("file exceeds the maximum response size")
+	// ErrNoResponse is returned when the server doesn't reply to a request at all, which usually means that it's down
+	// or unreachable. It wraps ErrTimeout, which on its own means that the transfer stalled once started
+	ErrNoResponse = fmt.Errorf("%w: no response from the server", ErrTimeout)
+)
+
+// DefaultMaxResponseSize is the size of the largest file read by Client.GetBytes, unless configured otherwise
+const DefaultMaxResponseSize = 32 << 20
+
+// ClientOption type configures optional parameters of a Client
+type ClientOption interface {
+	applyClient(c *Client)
+}
+
+type clientOptionFunc func(c *Client)
+
+func (f clientOptionFunc) applyClient(c *Client) {
+	f(c)
+}
+
+// WithLocalAddr makes the client send its requests from the given local UDP address. Since the port requests are
+// sent from is the client's transfer ID, the whole transfer is carried out from this address. Unless its port is 0,
+// only one transfer may be in progress at a time, as every transfer binds the same address
+func WithLocalAddr(addr string) ClientOption {
+	return clientOptionFunc(func(c *Client) {
+		c.localAddr = addr
+	})
+}
+
+// WithBlockSize makes the client request blocks of the given size by means of the blksize option (RFC 2348). The
+// size must be between 8 and 65464 bytes, and the server may choose a smaller one
+func WithBlockSize(size int) ClientOption {
+	return clientOptionFunc(func(c *Client) {
+		c.setOption(OptionBlockSize, strconv.Itoa(size))
+	})
+}
+
+// WithWindowSize makes the client request windows of the given number of blocks by means of the windowsize option
+// (RFC 7440). The size must be between 1 and 32767 blocks, and the server may choose a smaller one
+func WithWindowSize(size int) ClientOption {
+	return clientOptionFunc(func(c *Client) {
+		c.setOption(OptionWindowSize, strconv.Itoa(size))
+	})
+}
+
+// WithRequestedTimeout makes the client request the server to use the given retransmission timeout by means of the
+// timeout option (RFC 2349). The timeout must be a whole number of seconds between 1 and 255. If the server agrees,
+// the client uses the same timeout
+func WithRequestedTimeout(timeout time.Duration) ClientOption {
+	return clientOptionFunc(func(c *Client) {
+		value := timeout.String()
+		if timeout%time.Second == 0 {
+			value = strconv.FormatInt(int64(timeout/time.Second), 10)
+		}
+		c.setOption(OptionTimeout, value)
+	})
+}
+
+// WithHandshakeRetries sets the number of times a request is retransmitted before giving up on the server, which may
+// be slow to answer it. By default, or when set to a negative value, the number of retries configured by WithRetries
+// is used
+func WithHandshakeRetries(retries int) ClientOption {
+	return clientOptionFunc(func(c *Client) {
+		c.handshakeRetries = retries
+	})
+}
+
+// WithDataRetries sets the number of retransmissions attempted once the server has answered the request, before
+// aborting the transfer. By default, or when set to a negative value, the number of retries configured by WithRetries
+// is used
+func WithDataRetries(retries int) ClientOption {
+	return clientOptionFunc(func(c *Client) {
+		c.dataRetries = retries
+	})
+}
+
+// WithMaxResponseSize sets the size of the largest file read by GetBytes, in bytes
+func WithMaxResponseSize(size int64) ClientOption {
+	return clientOptionFunc(func(c *Client) {
+		c.maxResponseSize = size
+	})
+}
+
+// WithStrictTID sets whether packets from the server must come from the exact transfer ID it replied to the request
+// from, which is the default. Some middleboxes rewrite ports, so that packets from the server appear to come from
+// different ones. When strict is false, packets from any port of the server's IP address are accepted, trading the
+// protection against packets injected by other hosts' processes for compatibility. Replies are still sent to the
+// transfer ID the server first replied from
+func WithStrictTID(strict bool) ClientOption {
+	return clientOptionFunc(func(c *Client) {
+		c.looseTID = !strict
+	})
+}
+
+// Client is a TFTP client. A single client may be used to perform several transfers concurrently, except when it sends
+// them from a fixed local port by means of WithLocalAddr
+type Client struct {
+	transferConfig
+	localAddr       string
+	options         []Option // Options requested by the client
+	maxResponseSize int64
+	looseTID        bool // Whether packets from any port of the server are accepted
+
+	// Number of retransmissions before the server answers the request, and afterwards
+	handshakeRetries int
+	dataRetries      int
+}
+
+// NewClient creates a new client
+func NewClient(opts ...ClientOption) (*Client, error) {
+	c := &Client{
+		transferConfig:   defaultTransferConfig(),
+		maxResponseSize:  DefaultMaxResponseSize,
+		handshakeRetries: -1,
+		dataRetries:      -1,
+	}
+	for _, opt := range opts {
+		opt.applyClient(c)
+	}
+
+	if c.timeout <= 0 {
+		return nil, fmt.Errorf("%w: timeout must be positive", ErrInvalidConfig)
+	}
+	if c.retries < 0 {
+		return nil, fmt.Errorf("%w: retries can't be negative", ErrInvalidConfig)
+	}
+	if c.handshakeRetries < 0 {
+		c.handshakeRetries = c.retries
+	}
+	if c.dataRetries < 0 {
+		c.dataRetries = c.retries
+	}
+	if c.maxResponseSize < 0 {
+		return nil, fmt.Errorf("%w: maximum response size can't be negative", ErrInvalidConfig)
+	}
+	for _, option := range c.options {
+		if err := validateOption(option); err != nil {
+			return nil, err
+		}
+	}
+	if c.localAddr != "" {
+		if _, err := net.ResolveUDPAddr("udp", c.localAddr); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// setOption sets the value of an option requested by the client
+func (c *Client) setOption(name, value string) {
+	for i := range c.options {
+		if c.options[i].Name == name {
+			c.options[i].Value = value
+			return
+		}
+	}
+	c.options = append(c.options, Option{Name: name, Value: value})
+}
+
+// requestOptions returns a copy of the options requested by the client, which may be extended for a single request.
+// No options are requested in legacy-only mode
+func (c *Client) requestOptions() []Option {
+	if c.legacyOnly {
+		return nil
+	}
+	return append([]Option(nil), c.options...)
+}
+
+// Get downloads filename from the server at the remote address and writes its contents to w
+func (c *Client) Get(ctx context.Context, remote, filename string, mode Mode, w io.Writer) error {
+	_, err := c.Download(ctx, remote, filename, mode, w)
+	return err
+}
+
+// GetBytes downloads filename from the server at the remote address and returns its contents. Transfers of files
+// larger than the maximum response size are aborted, and ErrResponseTooLarge is returned
+func (c *Client) GetBytes(ctx context.Context, remote, filename string, mode Mode) ([]byte, error) {
+	buf := &limitedBuffer{max: c.maxResponseSize}
+	if err := c.Get(ctx, remote, filename, mode, buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// limitedBuffer is a buffer refusing to grow past a maximum size
+type limitedBuffer struct {
+	bytes.Buffer
+	max int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if int64(b.Len()+len(p)) > b.max {
+		return 0, ErrResponseTooLarge
+	}
+	return b.Buffer.Write(p)
+}
+
+// Download behaves like Get, but describes the completed transfer
+func (c *Client) Download(ctx context.Context, remote, filename string, mode Mode, w io.Writer) (*Transfer, error) {
+	return c.transfer(ctx, remote, func(sess *session) error {
+		options := c.requestOptions()
+		seeker, resumable := w.(io.Seeker)
+		resumable = resumable && c.resumable && !c.legacyOnly
+		if resumable {
+			end, err := seeker.Seek(0, io.SeekEnd)
+			if err != nil {
+				return err
+			}
+			// Resume from the last complete block
+			if offset := end - end%int64(NegotiatedBlockSize(options)); offset > 0 {
+				options = append(options, Option{Name: OptionResumeOffset, Value: strconv.FormatInt(offset, 10)})
+			}
+		}
+		if err := sess.send(c.request(&RRQPacket{Filename: filename, Mode: mode, Options: options})); err != nil {
+			return err
+		}
+		acknowledged, err := sess.awaitOACK(options)
+		if err != nil {
+			return noResponse(err)
+		}
+		if resumable {
+			// Start over unless the server resumes the transfer
+			offset := int64(0)
+			if value, ok := findOption(sess.options, OptionResumeOffset); ok {
+				offset, _ = strconv.ParseInt(value, 10, 64)
+			}
+			if err := rewind(seeker, offset); err != nil {
+				return sess.abort(err)
+			}
+		}
+		sess.retries = c.dataRetries
+		if acknowledged {
+			// Let the server know that the transfer can start
+			if err := sess.sendACK(0); err != nil {
+				return err
+			}
+		}
+		if err := sess.receiveFile(w, func() error {
+			return nil
+		}); err != nil {
+			return err
+		}
+		if c.strictFinalBlock {
+			// Make sure the server doesn't keep sending blocks
+			return sess.dally(sess.timeout)
+		}
+		return nil
+	})
+}
+
+// rewind seeks a resumed download to the offset the transfer starts from, dropping any data past it if possible
+func rewind(seeker io.Seeker, offset int64) error {
+	if t, ok := seeker.(interface{ Truncate(size int64) error }); ok {
+		if err := t.Truncate(offset); err != nil {
+			return err
+		}
+	}
+	_, err := seeker.Seek(offset, io.SeekStart)
+	return err
+}
+
+// Put uploads the contents of r to the server at the remote address as filename. If the size of r can be known in
+// advance, it is declared by means of the tsize option, so that the server may refuse files too large to be stored
+func (c *Client) Put(ctx context.Context, remote, filename string, mode Mode, r io.Reader) error {
+	_, err := c.Upload(ctx, remote, filename, mode, r)
+	return err
+}
+
+// Upload behaves like Put, but describes the completed transfer
+func (c *Client) Upload(ctx context.Context, remote, filename string, mode Mode, r io.Reader) (*Transfer, error) {
+	return c.transfer(ctx, remote, func(sess *session) error {
+		options := c.requestOptions()
+		if size, ok := fileSize(r); ok && !c.legacyOnly {
+			// Let the server refuse files it has no room for before they are sent
+			options = append(options, Option{Name: OptionTransferSize, Value: strconv.FormatInt(size, 10)})
+		}
+		if err := sess.send(c.request(&WRQPacket{Filename: filename, Mode: mode, Options: options})); err != nil {
+			return err
+		}
+
+		acknowledged, err := sess.awaitOACK(options)
+		err = noResponse(err)
+		if err == nil && !acknowledged {
+			err = sess.awaitACK(0)
+		}
+		if errors.Is(err, ErrorCodeDiskFull) {
+			// Keep the server's error around, so that it can still be inspected
+			return joinErrors(ErrUploadTooLarge, err)
+		}
+		if err != nil {
+			return err
+		}
+		sess.retries = c.dataRetries
+		// An OACK takes the place of the ACK for block 0
+		return sess.sendFile(r)
+	})
+}
+
+// Size returns the size of filename on the server at the remote address, without downloading it. The size is
+// requested by means of the tsize option, and the transfer is cancelled as soon as the server reports it. If the server
+// doesn't support the option, or options are disabled by WithLegacyOnly, ErrSizeUnsupported is returned
+func (c *Client) Size(ctx context.Context, remote, filename string, mode Mode) (int64, error) {
+	if c.legacyOnly {
+		return 0, ErrSizeUnsupported
+	}
+	var size int64
+	_, err := c.transfer(ctx, remote, func(sess *session) error {
+		rrq := &RRQPacket{Filename: filename, Mode: mode, Options: []Option{{Name: OptionTransferSize, Value: "0"}}}
+		if err := sess.send(c.request(rrq)); err != nil {
+			return err
+		}
+
+		var oack *OACKPacket
+		err := sess.await(func(p Packet) (bool, error) {
+			switch p := p.(type) {
+			case *OACKPacket:
+				oack = p
+			case *DATAPacket:
+			default:
+				return false, sess.abort(fmt.Errorf("%w: expected OACK", ErrUnexpectedPacket))
+			}
+			return true, nil
+		})
+		if err != nil {
+			return noResponse(err)
+		}
+
+		if oack == nil {
+			// The server ignored the option and started sending the file
+			_ = sess.fail(ErrorCodeNotDefined, "transfer cancelled")
+			return ErrSizeUnsupported
+		}
+
+		// Decline the options, as allowed by RFC 2347, so that the transfer doesn't start
+		_ = sess.fail(ErrorCodeOptionRefused, "transfer cancelled")
+		for _, option := range oack.Options {
+			if option.Name == OptionTransferSize {
+				if size, err = strconv.ParseInt(option.Value, 10, 64); err == nil && size >= 0 {
+					return nil
+				}
+			}
+		}
+		return ErrSizeUnsupported
+	})
+	if err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// Exists reports whether filename exists on the server at the remote address, without downloading it. A read request
+// is sent, and the transfer is cancelled as soon as the server starts it. Files the server reports as not found don't
+// exist. Some servers report missing files as access violations, which can't be told apart from files which exist
+// but can't be read: in that case, as with any other error, false is returned along with the error
+func (c *Client) Exists(ctx context.Context, remote, filename string, mode Mode) (bool, error) {
+	_, err := c.transfer(ctx, remote, func(sess *session) error {
+		if err := sess.send(c.request(&RRQPacket{Filename: filename, Mode: mode})); err != nil {
+			return err
+		}
+		err := sess.await(func(p Packet) (bool, error) {
+			switch p.(type) {
+			case *OACKPacket, *DATAPacket:
+				return true, nil
+			}
+			return false, sess.abort(fmt.Errorf("%w: expected DATA", ErrUnexpectedPacket))
+		})
+		if err != nil {
+			return noResponse(err)
+		}
+		_ = sess.fail(ErrorCodeNotDefined, "transfer cancelled")
+		return nil
+	})
+	if errors.Is(err, ErrorCodeFileNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// noResponse returns the error of a request the server didn't reply to, telling such a timeout apart from those
+// occurring once the transfer has started
+func noResponse(err error) error {
+	if err == ErrTimeout {
+		return ErrNoResponse
+	}
+	return err
+}
+
+// requestPacket type is implemented by RRQ and WRQ packets
+type requestPacket interface {
+	Packet
+	marshal(w io.Writer, allowNonNETASCII bool) error
+}
+
+// nonNETASCIIRequest is a request whose filename need not be NETASCII
+type nonNETASCIIRequest struct {
+	requestPacket
+}
+
+func (p nonNETASCIIRequest) Marshal(w io.Writer) error {
+	return p.marshal(w, true)
+}
+
+// request returns the packet sending p, subject to the restrictions on filenames configured for the client
+func (c *Client) request(p requestPacket) Packet {
+	if c.allowNonNETASCIIFilenames {
+		return nonNETASCIIRequest{p}
+	}
+	return p
+}
+
+// transfer runs a transfer with the server at the remote address from a newly allocated transfer ID, aborting it if
+// ctx is done before it completes
+func (c *Client) transfer(ctx context.Context, remote string, run func(sess *session) error) (*Transfer, error) {
+	addr, err := net.ResolveUDPAddr("udp", remote)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenPacket("udp", c.localAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	applyDSCP(conn, c.transferConfig)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblock the session
+			_ = conn.Close()
+		case <-done:
+		}
+	}()
+
+	start := time.Now()
+	sess := newSession(conn, addr, c.transferConfig)
+	defer func() {
+		_ = sess.close()
+	}()
+	// The server replies from the transfer ID it chooses for the rest of the transfer
+	sess.locked = false
+	sess.looseTID = c.looseTID
+	sess.retries = c.handshakeRetries
+	if err := run(sess); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return newTransfer(sess, time.Since(start)), nil
+}
@@ -0,0 +1,1087 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestClient creates a client, failing the test on error
+func newTestClient(t *testing.T, opts ...ClientOption) *Client {
+	t.Helper()
+	c, err := NewClient(opts...)
+	if err != nil {
+		t.Fatalf("got an error but didn't want one: %v", err)
+	}
+	return c
+}
+
+func TestClientGet(t *testing.T) {
+	t.Run("Get downloads files", func(t *testing.T) {
+		want := bytes.Repeat([]byte("download"), 300)
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": want}))
+
+		got := bytes.Buffer{}
+		if err := newTestClient(t).Get(context.Background(), addr.String(), "file.bin", ModeOctet, &got); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+	})
+
+	t.Run("Get reports errors sent by the server", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(nil))
+
+		err := newTestClient(t).Get(context.Background(), addr.String(), "missing.bin", ModeOctet, &bytes.Buffer{})
+		var protoErr ProtocolError
+		if !errors.As(err, &protoErr) {
+			t.Fatalf("got %v want a ProtocolError", err)
+		}
+		if protoErr.Code != ErrorCodeFileNotFound {
+			t.Fatalf("got error code %v want %v", protoErr.Code, ErrorCodeFileNotFound)
+		}
+	})
+
+	t.Run("Get is aborted when the context is done", func(t *testing.T) {
+		// A peer which never answers
+		p := newTestPeer(t, nil)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err := newTestClient(t).Get(ctx, p.conn.LocalAddr().String(), "file.bin", ModeOctet, &bytes.Buffer{})
+		if err != context.DeadlineExceeded {
+			t.Fatalf("got %v want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestClientGetBytes(t *testing.T) {
+	want := bytes.Repeat([]byte("bytes"), 300)
+	files := map[string][]byte{"file.bin": want}
+
+	t.Run("GetBytes returns the contents of files", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(files))
+		got, err := newTestClient(t).GetBytes(context.Background(), addr.String(), "file.bin", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes want %d", len(got), len(want))
+		}
+	})
+
+	t.Run("Files larger than the maximum response size are refused", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(files))
+		c := newTestClient(t, WithMaxResponseSize(int64(len(want)-1)))
+		if _, err := c.GetBytes(context.Background(), addr.String(), "file.bin", ModeOctet); err != ErrResponseTooLarge {
+			t.Fatalf("got %v want %v", err, ErrResponseTooLarge)
+		}
+	})
+}
+
+func TestClientPut(t *testing.T) {
+	t.Run("Put uploads files", func(t *testing.T) {
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		addr := startTestServer(t, h)
+
+		want := bytes.Repeat([]byte("upload"), 300)
+		err := newTestClient(t).Put(context.Background(), addr.String(), "file.bin", ModeOctet, bytes.NewReader(want))
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if got := readMapFile(t, h, "file.bin"); !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes want %d", len(got), len(want))
+		}
+	})
+
+	t.Run("Uploads refused because of their declared size are reported", func(t *testing.T) {
+		// A fake server with no room for large files
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			wrq, ok := p.receive().(*WRQPacket)
+			if !ok {
+				t.Errorf("got %#v want a WRQ", wrq)
+				return
+			}
+			if size, _ := findOption(wrq.Options, "tsize"); size != "100000" {
+				t.Errorf("got tsize %q want %q", size, "100000")
+			}
+			p.send(&ERRORPacket{ErrorCode: ErrorCodeDiskFull, ErrorMsg: "file too large"})
+		}()
+
+		data := bytes.NewReader(make([]byte, 100000))
+		err := newTestClient(t).Put(context.Background(), p.conn.LocalAddr().String(), "big.bin", ModeOctet, data)
+		<-done
+		if !errors.Is(err, ErrUploadTooLarge) {
+			t.Fatalf("got %v want %v", err, ErrUploadTooLarge)
+		}
+		if !errors.Is(err, ErrorCodeDiskFull) {
+			t.Fatalf("got %v want %v", err, ErrorCodeDiskFull)
+		}
+		var protoErr ProtocolError
+		if !errors.As(err, &protoErr) || protoErr.Msg != "file too large" {
+			t.Fatalf("got %v want the server's ProtocolError", err)
+		}
+	})
+
+	t.Run("The size of streams of unknown length is not declared", func(t *testing.T) {
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			wrq, ok := p.receive().(*WRQPacket)
+			if !ok || len(wrq.Options) != 0 {
+				t.Errorf("got %#v want a WRQ without options", wrq)
+				return
+			}
+			p.send(&ACKPacket{BlockNumber: 0})
+			if dp, ok := p.receive().(*DATAPacket); !ok || string(dp.Data) != "stream" {
+				t.Errorf("got %#v want DATA block 1", dp)
+			}
+			p.send(&ACKPacket{BlockNumber: 1})
+		}()
+
+		r := io.MultiReader(strings.NewReader("stream"))
+		if err := newTestClient(t).Put(context.Background(), p.conn.LocalAddr().String(), "stream", ModeOctet, r); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		<-done
+	})
+
+	t.Run("Uploads complete only once the final block is acknowledged", func(t *testing.T) {
+		// A fake server which loses the final block, and acknowledges its retransmission late
+		p := newTestPeer(t, nil)
+		acked := make(chan struct{})
+		go func() {
+			if _, ok := p.receive().(*WRQPacket); !ok {
+				t.Error("got an unexpected packet want a WRQ")
+				return
+			}
+			p.send(&ACKPacket{BlockNumber: 0})
+			for i := 0; i < 2; i++ {
+				if dp, ok := p.receive().(*DATAPacket); !ok || dp.BlockNumber != 1 {
+					t.Errorf("got %#v want DATA block 1", dp)
+					return
+				}
+			}
+			// A duplicate acknowledgement of the WRQ doesn't end the upload either
+			p.send(&ACKPacket{BlockNumber: 0})
+			time.Sleep(20 * time.Millisecond)
+			close(acked)
+			p.send(&ACKPacket{BlockNumber: 1})
+		}()
+
+		c := newTestClient(t, WithTimeout(100*time.Millisecond))
+		r := io.MultiReader(strings.NewReader("final"))
+		if err := c.Put(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet, r); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		select {
+		case <-acked:
+		default:
+			t.Fatal("the upload completed before the final block was acknowledged")
+		}
+	})
+}
+
+func TestClientLocalAddr(t *testing.T) {
+	t.Run("Requests are sent from the configured local address", func(t *testing.T) {
+		// Find a free port to bind the client to
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		local := conn.LocalAddr().String()
+		_ = conn.Close()
+
+		// A fake server checking where the request comes from and serving a single block
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if rrq, ok := p.receive().(*RRQPacket); !ok || rrq.Filename != "file.txt" {
+				t.Errorf("got %#v want a RRQ for file.txt", rrq)
+				return
+			}
+			if p.remote.String() != local {
+				t.Errorf("got request from %v want %v", p.remote, local)
+			}
+			p.send(&DATAPacket{BlockNumber: 1, Data: []byte("hello")})
+			if ack, ok := p.receive().(*ACKPacket); !ok || ack.BlockNumber != 1 {
+				t.Errorf("got %#v want ACK block 1", ack)
+			}
+		}()
+
+		got := bytes.Buffer{}
+		c := newTestClient(t, WithLocalAddr(local))
+		if err := c.Get(context.Background(), p.conn.LocalAddr().String(), "file.txt", ModeOctet, &got); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if got.String() != "hello" {
+			t.Fatalf("got %q want %q", got.String(), "hello")
+		}
+		<-done
+	})
+
+	t.Run("Invalid local addresses are rejected", func(t *testing.T) {
+		if _, err := NewClient(WithLocalAddr("not an address")); err == nil {
+			t.Fatal("wanted an error but didn't get one")
+		}
+	})
+}
+
+func TestClientIPv6(t *testing.T) {
+	t.Run("Transfers complete over IPv6 loopback", func(t *testing.T) {
+		handler := MapHandler(nil)
+		handler.AllowWrites = true
+		addr := startTestServerOn(t, "[::1]:0", handler)
+		want := bytes.Repeat([]byte("ipv6"), 300)
+
+		c := newTestClient(t)
+		if err := c.Put(context.Background(), addr.String(), "file.bin", ModeOctet, bytes.NewReader(want)); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		got := bytes.Buffer{}
+		if err := c.Get(context.Background(), addr.String(), "file.bin", ModeOctet, &got); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+	})
+
+	t.Run("Transfer IDs on different zones are told apart", func(t *testing.T) {
+		addr, err := net.ResolveUDPAddr("udp", "[fe80::1%eth0]:69")
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if addr.Zone != "eth0" {
+			t.Fatalf("got zone %q want %q", addr.Zone, "eth0")
+		}
+		if sameAddr(addr, &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: "eth1"}) {
+			t.Fatal("addresses with different zones are considered the same")
+		}
+		if !sameAddr(addr, &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: "eth0"}) {
+			t.Fatal("addresses with the same zone are considered different")
+		}
+	})
+}
+
+func TestClientTransferID(t *testing.T) {
+	t.Run("Packets from other transfer IDs are rejected without disturbing the transfer", func(t *testing.T) {
+		first := bytes.Repeat([]byte{0xAB}, DefaultBlockSize)
+		last := []byte("last block")
+
+		// A fake server whose transfer is interfered with by a stranger once the client has locked onto it
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if _, ok := p.receive().(*RRQPacket); !ok {
+				t.Error("got an unexpected packet want a RRQ")
+				return
+			}
+			p.send(&DATAPacket{BlockNumber: 1, Data: first})
+			if ack, ok := p.receive().(*ACKPacket); !ok || ack.BlockNumber != 1 {
+				t.Errorf("got %#v want ACK 1", ack)
+				return
+			}
+
+			stranger := newTestPeer(t, p.remote)
+			stranger.send(&DATAPacket{BlockNumber: 2, Data: []byte("forged")})
+			if pkt, ok := stranger.receive().(*ERRORPacket); !ok || pkt.ErrorCode != ErrorCodeUnknownTransferID {
+				t.Errorf("got %#v want ERROR %v", pkt, ErrorCodeUnknownTransferID)
+				return
+			}
+
+			p.send(&DATAPacket{BlockNumber: 2, Data: last})
+			if ack, ok := p.receive().(*ACKPacket); !ok || ack.BlockNumber != 2 {
+				t.Errorf("got %#v want ACK 2", ack)
+			}
+		}()
+
+		got := bytes.Buffer{}
+		if err := newTestClient(t).Get(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet, &got); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if want := append(first, last...); !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+		<-done
+	})
+
+	// A fake server whose second block comes from another port of the same host, as if rewritten by a middlebox.
+	// Unless the client accepts it, the block is sent again from the original port
+	serveFromOtherPort := func(t *testing.T, accepted bool) (*testPeer, <-chan struct{}) {
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if _, ok := p.receive().(*RRQPacket); !ok {
+				t.Error("got an unexpected packet want a RRQ")
+				return
+			}
+			p.send(&DATAPacket{BlockNumber: 1, Data: bytes.Repeat([]byte{0xAB}, DefaultBlockSize)})
+			if ack, ok := p.receive().(*ACKPacket); !ok || ack.BlockNumber != 1 {
+				t.Errorf("got %#v want ACK 1", ack)
+				return
+			}
+
+			other := newTestPeer(t, p.remote)
+			other.send(&DATAPacket{BlockNumber: 2, Data: []byte("last")})
+			if !accepted {
+				if pkt, ok := other.receive().(*ERRORPacket); !ok || pkt.ErrorCode != ErrorCodeUnknownTransferID {
+					t.Errorf("got %#v want ERROR %v", pkt, ErrorCodeUnknownTransferID)
+					return
+				}
+				p.send(&DATAPacket{BlockNumber: 2, Data: []byte("last")})
+			}
+			// Acknowledgements are sent to the transfer ID the server first replied from
+			if ack, ok := p.receive().(*ACKPacket); !ok || ack.BlockNumber != 2 {
+				t.Errorf("got %#v want ACK 2", ack)
+			}
+		}()
+		return p, done
+	}
+
+	for _, strict := range []bool{true, false} {
+		name := "Packets from other ports of the server are accepted with loose transfer IDs"
+		if strict {
+			name = "Packets from other ports of the server are rejected with strict transfer IDs"
+		}
+		t.Run(name, func(t *testing.T) {
+			p, done := serveFromOtherPort(t, !strict)
+			got := bytes.Buffer{}
+			c := newTestClient(t, WithStrictTID(strict))
+			if err := c.Get(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet, &got); err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			<-done
+			if want := DefaultBlockSize + len("last"); got.Len() != want {
+				t.Fatalf("got %d bytes want %d", got.Len(), want)
+			}
+		})
+	}
+}
+
+func TestClientNonNETASCIIFilenames(t *testing.T) {
+	t.Run("UTF-8 filenames are transferred when allowed on both ends", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"imágenes/arranque.bin": []byte("boot")}),
+			AllowNonNETASCIIFilenames())
+
+		got := bytes.Buffer{}
+		c := newTestClient(t, AllowNonNETASCIIFilenames())
+		if err := c.Get(context.Background(), addr.String(), "imágenes/arranque.bin", ModeOctet, &got); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if got.String() != "boot" {
+			t.Fatalf("got %q want %q", got.String(), "boot")
+		}
+	})
+}
+
+func TestClientRetries(t *testing.T) {
+	// drain returns the number of packets with the given opcode received by conn until it goes quiet
+	drain := func(t *testing.T, conn net.PacketConn, op Opcode) int {
+		t.Helper()
+		buf := make([]byte, maxDatagramSize)
+		for n := 0; ; {
+			if err := conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+			k, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return n
+			}
+			if k >= 2 && Opcode(binary.BigEndian.Uint16(buf)) == op {
+				n++
+			}
+		}
+	}
+
+	t.Run("Requests are retransmitted as many times as handshake retries", func(t *testing.T) {
+		// A fake server which never answers
+		p := newTestPeer(t, nil)
+		c := newTestClient(t, WithTimeout(20*time.Millisecond), WithHandshakeRetries(3), WithDataRetries(0))
+		err := c.Get(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet, &bytes.Buffer{})
+		if !errors.Is(err, ErrTimeout) {
+			t.Fatalf("got %v want %v", err, ErrTimeout)
+		}
+		if n := drain(t, p.conn, RRQ); n != 4 {
+			t.Fatalf("got %v requests want %v", n, 4)
+		}
+	})
+
+	t.Run("Blocks are retransmitted as many times as data retries", func(t *testing.T) {
+		// A fake server which stops answering after the first block
+		p := newTestPeer(t, nil)
+		go func() {
+			p.receive()
+			p.send(&DATAPacket{BlockNumber: 1, Data: make([]byte, DefaultBlockSize)})
+		}()
+
+		c := newTestClient(t, WithTimeout(20*time.Millisecond), WithHandshakeRetries(5), WithDataRetries(1))
+		err := c.Get(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet, &bytes.Buffer{})
+		if err != ErrTimeout {
+			t.Fatalf("got %v want %v", err, ErrTimeout)
+		}
+		if errors.Is(err, ErrNoResponse) {
+			t.Fatal("stalled transfers are reported as servers not responding")
+		}
+		if n := drain(t, p.conn, ACK); n != 2 {
+			t.Fatalf("got %v acknowledgements want %v", n, 2)
+		}
+	})
+}
+
+func TestClientNoResponse(t *testing.T) {
+	// A fake server which never answers
+	p := newTestPeer(t, nil)
+	remote := p.conn.LocalAddr().String()
+	c := newTestClient(t, WithTimeout(10*time.Millisecond), WithRetries(1))
+
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"Downloads", func() error {
+			return c.Get(context.Background(), remote, "file.bin", ModeOctet, &bytes.Buffer{})
+		}},
+		{"Uploads", func() error {
+			return c.Put(context.Background(), remote, "file.bin", ModeOctet, bytes.NewReader([]byte("data")))
+		}},
+		{"Size queries", func() error {
+			_, err := c.Size(context.Background(), remote, "file.bin", ModeOctet)
+			return err
+		}},
+		{"Existence checks", func() error {
+			_, err := c.Exists(context.Background(), remote, "file.bin", ModeOctet)
+			return err
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name+" to servers which never reply fail with ErrNoResponse", func(t *testing.T) {
+			if err := test.run(); !errors.Is(err, ErrNoResponse) {
+				t.Fatalf("got %v want %v", err, ErrNoResponse)
+			}
+		})
+	}
+}
+
+func TestClientSize(t *testing.T) {
+	t.Run("Size is read from the OACK and the transfer is declined", func(t *testing.T) {
+		// A fake server reporting the size of any file
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			rrq, ok := p.receive().(*RRQPacket)
+			if !ok || !reflect.DeepEqual(rrq.Options, []Option{{Name: "tsize", Value: "0"}}) {
+				t.Errorf("got %#v want a RRQ with tsize 0", rrq)
+				return
+			}
+			p.send(&OACKPacket{Options: []Option{{Name: "tsize", Value: "1234"}}})
+			if pkt, ok := p.receive().(*ERRORPacket); !ok || pkt.ErrorCode != ErrorCodeOptionRefused {
+				t.Errorf("got %#v want ERROR %v", pkt, ErrorCodeOptionRefused)
+			}
+		}()
+
+		size, err := newTestClient(t).Size(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if size != 1234 {
+			t.Fatalf("got %v want %v", size, 1234)
+		}
+		<-done
+	})
+
+	t.Run("Size of files served by the server is reported", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": make([]byte, 1000)}))
+
+		size, err := newTestClient(t).Size(context.Background(), addr.String(), "file.bin", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if size != 1000 {
+			t.Fatalf("got %v want %v", size, 1000)
+		}
+	})
+
+	t.Run("Servers not reporting the size are detected", func(t *testing.T) {
+		addr := startTestServer(t, pipeHandler{data: []byte("streamed")})
+
+		_, err := newTestClient(t).Size(context.Background(), addr.String(), "stream", ModeOctet)
+		if err != ErrSizeUnsupported {
+			t.Fatalf("got %v want %v", err, ErrSizeUnsupported)
+		}
+	})
+}
+
+func TestClientExists(t *testing.T) {
+	// existsServer starts a fake server answering a single RRQ with reply, and expects the transfer to be cancelled
+	// when the reply starts it
+	existsServer := func(t *testing.T, reply Packet) *testPeer {
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		t.Cleanup(func() { <-done })
+		go func() {
+			defer close(done)
+			if rrq, ok := p.receive().(*RRQPacket); !ok || len(rrq.Options) != 0 {
+				t.Errorf("got %#v want a RRQ without options", rrq)
+				return
+			}
+			p.send(reply)
+			if _, ok := reply.(*ERRORPacket); ok {
+				return
+			}
+			if pkt, ok := p.receive().(*ERRORPacket); !ok || pkt.ErrorCode != ErrorCodeNotDefined {
+				t.Errorf("got %#v want ERROR %v", pkt, ErrorCodeNotDefined)
+			}
+		}()
+		return p
+	}
+
+	t.Run("Files the server starts sending exist", func(t *testing.T) {
+		p := existsServer(t, &DATAPacket{BlockNumber: 1, Data: []byte("present")})
+		exists, err := newTestClient(t).Exists(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !exists {
+			t.Fatal("got false want true")
+		}
+	})
+
+	t.Run("Files the server reports as not found don't exist", func(t *testing.T) {
+		p := existsServer(t, &ERRORPacket{ErrorCode: ErrorCodeFileNotFound, ErrorMsg: "no such file"})
+		exists, err := newTestClient(t).Exists(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if exists {
+			t.Fatal("got true want false")
+		}
+	})
+
+	t.Run("Access violations are reported as errors", func(t *testing.T) {
+		p := existsServer(t, &ERRORPacket{ErrorCode: ErrorCodeAccessViolation, ErrorMsg: "denied"})
+		exists, err := newTestClient(t).Exists(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet)
+		if !errors.Is(err, ErrAccessViolation) {
+			t.Fatalf("got %v want %v", err, ErrAccessViolation)
+		}
+		if exists {
+			t.Fatal("got true want false")
+		}
+	})
+
+	t.Run("Files served by the server exist", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": []byte("present")}))
+		c := newTestClient(t)
+		for filename, want := range map[string]bool{"file.bin": true, "missing.bin": false} {
+			exists, err := c.Exists(context.Background(), addr.String(), filename, ModeOctet)
+			if err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			if exists != want {
+				t.Fatalf("got %v want %v for %s", exists, want, filename)
+			}
+		}
+	})
+}
+
+func TestClientConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		opt  ClientOption
+	}{
+		{"Block sizes above 65464 are rejected", WithBlockSize(70000)},
+		{"Block sizes below 8 are rejected", WithBlockSize(4)},
+		{"Zero timeouts are rejected", WithTimeout(0)},
+		{"Negative retries are rejected", WithRetries(-1)},
+		{"Requested timeouts above 255 seconds are rejected", WithRequestedTimeout(300 * time.Second)},
+		{"Requested timeouts below 1 second are rejected", WithRequestedTimeout(0)},
+		{"Requested timeouts with fractional seconds are rejected", WithRequestedTimeout(1500 * time.Millisecond)},
+		{"Window sizes of 0 are rejected", WithWindowSize(0)},
+		{"Window sizes above 32767 are rejected", WithWindowSize(32768)},
+		{"Negative maximum response sizes are rejected", WithMaxResponseSize(-1)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewClient(test.opt); !errors.Is(err, ErrInvalidConfig) {
+				t.Fatalf("got %v want %v", err, ErrInvalidConfig)
+			}
+		})
+	}
+
+	t.Run("Values within range are accepted", func(t *testing.T) {
+		newTestClient(t, WithBlockSize(65464), WithBlockSize(8), WithWindowSize(32767),
+			WithRequestedTimeout(255*time.Second))
+	})
+
+	t.Run("Options ignored by the server fall back to the default values", func(t *testing.T) {
+		want := bytes.Repeat([]byte("defaults"), 300)
+		h := MapHandler(map[string][]byte{"file.bin": want})
+		h.AllowWrites = true
+		addr := startTestServer(t, h)
+		c := newTestClient(t, WithBlockSize(1024), WithRequestedTimeout(2*time.Second))
+
+		got := bytes.Buffer{}
+		if err := c.Get(context.Background(), addr.String(), "file.bin", ModeOctet, &got); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+		if err := c.Put(context.Background(), addr.String(), "upload.bin", ModeOctet, bytes.NewReader(want)); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+	})
+}
+
+func TestClientTransfer(t *testing.T) {
+	t.Run("Block sizes downgraded by the server are reported", func(t *testing.T) {
+		want := bytes.Repeat([]byte("Z"), 610)
+
+		// A fake server choosing a smaller block size than requested
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if rrq, ok := p.receive().(*RRQPacket); !ok || !reflect.DeepEqual(rrq.Options, []Option{{Name: "blksize", Value: "1024"}}) {
+				t.Errorf("got %#v want a RRQ with blksize 1024", rrq)
+				return
+			}
+			p.send(&OACKPacket{Options: []Option{{Name: "blksize", Value: "600"}}})
+			expectACK(t, p, 0)
+			p.send(sessionDATA{&DATAPacket{BlockNumber: 1, Data: want[:600]}, 600})
+			expectACK(t, p, 1)
+			p.send(&DATAPacket{BlockNumber: 2, Data: want[600:]})
+			expectACK(t, p, 2)
+		}()
+
+		got := bytes.Buffer{}
+		c := newTestClient(t, WithBlockSize(1024))
+		tr, err := c.Download(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet, &got)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		<-done
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+		if tr.BlockSize() != 600 {
+			t.Fatalf("got block size %v want %v", tr.BlockSize(), 600)
+		}
+		if want := map[string]string{"blksize": "600"}; !reflect.DeepEqual(tr.Options(), want) {
+			t.Fatalf("got %v want %v", tr.Options(), want)
+		}
+	})
+
+	t.Run("Defaults are reported when no options are acknowledged", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.txt": []byte("hello")}))
+
+		tr, err := newTestClient(t).Download(context.Background(), addr.String(), "file.txt", ModeOctet, &bytes.Buffer{})
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if tr.BlockSize() != DefaultBlockSize || tr.WindowSize() != 1 || tr.Timeout() != DefaultTimeout {
+			t.Fatalf("got block size %v, window size %v and timeout %v want %v, %v and %v",
+				tr.BlockSize(), tr.WindowSize(), tr.Timeout(), DefaultBlockSize, 1, DefaultTimeout)
+		}
+		if len(tr.Options()) != 0 {
+			t.Fatalf("got %v want no options", tr.Options())
+		}
+	})
+
+	t.Run("Results describe the completed transfer", func(t *testing.T) {
+		want := bytes.Repeat([]byte("R"), 2*DefaultBlockSize+100)
+		const timeout = 50 * time.Millisecond
+
+		// A fake server letting the client retransmit its acknowledgement of the second block once
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if _, ok := p.receive().(*RRQPacket); !ok {
+				t.Error("got an unexpected packet want a RRQ")
+				return
+			}
+			p.send(&DATAPacket{BlockNumber: 1, Data: want[:DefaultBlockSize]})
+			expectACK(t, p, 1)
+			p.send(&DATAPacket{BlockNumber: 2, Data: want[DefaultBlockSize : 2*DefaultBlockSize]})
+			expectACK(t, p, 2)
+			expectACK(t, p, 2)
+			p.send(&DATAPacket{BlockNumber: 3, Data: want[2*DefaultBlockSize:]})
+			expectACK(t, p, 3)
+		}()
+
+		c := newTestClient(t, WithTimeout(timeout))
+		tr, err := c.Download(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet, &bytes.Buffer{})
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		<-done
+
+		res := tr.Result()
+		if res.Bytes != int64(len(want)) || res.Blocks != 3 || res.Retransmits != 1 {
+			t.Fatalf("got %v bytes, %v blocks and %v retransmits want %v, %v and %v",
+				res.Bytes, res.Blocks, res.Retransmits, len(want), 3, 1)
+		}
+		if res.Duration < timeout {
+			t.Fatalf("got duration %v want at least %v", res.Duration, timeout)
+		}
+		if len(res.Options) != 0 {
+			t.Fatalf("got %v want no options", res.Options)
+		}
+	})
+}
+
+func TestClientDuplicateOACK(t *testing.T) {
+	t.Run("OACKs retransmitted during a download are acknowledged again without disturbing it", func(t *testing.T) {
+		want := bytes.Repeat([]byte("O"), 700)
+
+		// A fake server whose OACK is duplicated by the network once the transfer has started
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if _, ok := p.receive().(*RRQPacket); !ok {
+				t.Error("got an unexpected packet want a RRQ")
+				return
+			}
+			oack := &OACKPacket{Options: []Option{{Name: "blksize", Value: "600"}}}
+			p.send(oack)
+			expectACK(t, p, 0)
+			p.send(sessionDATA{&DATAPacket{BlockNumber: 1, Data: want[:600]}, 600})
+			expectACK(t, p, 1)
+			p.send(oack)
+			expectACK(t, p, 0)
+			p.send(&DATAPacket{BlockNumber: 2, Data: want[600:]})
+			expectACK(t, p, 2)
+		}()
+
+		got := bytes.Buffer{}
+		c := newTestClient(t, WithBlockSize(1024))
+		if err := c.Get(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet, &got); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		<-done
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+	})
+}
+
+func TestClientSkippedOACK(t *testing.T) {
+	t.Run("Servers answering with DATA instead of an OACK are acknowledged from block 1", func(t *testing.T) {
+		// A fake server ignoring the requested options
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if rrq, ok := p.receive().(*RRQPacket); !ok || len(rrq.Options) == 0 {
+				t.Errorf("got %#v want a RRQ with options", rrq)
+				return
+			}
+			p.send(&DATAPacket{BlockNumber: 1, Data: []byte("plain")})
+			if ack, ok := p.receive().(*ACKPacket); !ok || ack.BlockNumber != 1 {
+				t.Errorf("got %#v want ACK 1", ack)
+			}
+		}()
+
+		got := bytes.Buffer{}
+		c := newTestClient(t, WithBlockSize(1024))
+		tr, err := c.Download(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet, &got)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		<-done
+		if got.String() != "plain" {
+			t.Fatalf("got %q want %q", got.String(), "plain")
+		}
+		if tr.BlockSize() != DefaultBlockSize {
+			t.Fatalf("got block size %v want %v", tr.BlockSize(), DefaultBlockSize)
+		}
+	})
+}
+
+func TestClientPartialOACK(t *testing.T) {
+	t.Run("Options left out of the OACK keep their default values", func(t *testing.T) {
+		want := bytes.Repeat([]byte("P"), 1000)
+
+		// A fake server acknowledging the block size but not the timeout
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			rrq, ok := p.receive().(*RRQPacket)
+			if !ok {
+				t.Errorf("got %#v want a RRQ", rrq)
+				return
+			}
+			if _, ok := findOption(rrq.Options, "timeout"); !ok {
+				t.Errorf("got %v want a timeout option", rrq.Options)
+			}
+			p.send(&OACKPacket{Options: []Option{{Name: "blksize", Value: "1024"}}})
+			expectACK(t, p, 0)
+			p.send(sessionDATA{&DATAPacket{BlockNumber: 1, Data: want}, 1024})
+			expectACK(t, p, 1)
+		}()
+
+		got := bytes.Buffer{}
+		c := newTestClient(t, WithBlockSize(1024), WithRequestedTimeout(10*time.Second))
+		tr, err := c.Download(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet, &got)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		<-done
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+		if tr.BlockSize() != 1024 {
+			t.Fatalf("got block size %v want %v", tr.BlockSize(), 1024)
+		}
+		if tr.Timeout() != DefaultTimeout {
+			t.Fatalf("got timeout %v want %v", tr.Timeout(), DefaultTimeout)
+		}
+	})
+}
+
+func TestClientUnsolicitedOACK(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(c *Client, remote string) error
+	}{
+		{"downloads", func(c *Client, remote string) error {
+			return c.Get(context.Background(), remote, "file.bin", ModeOctet, &bytes.Buffer{})
+		}},
+		{"uploads", func(c *Client, remote string) error {
+			return c.Put(context.Background(), remote, "file.bin", ModeOctet, io.MultiReader(strings.NewReader("data")))
+		}},
+	}
+	for _, test := range tests {
+		t.Run("OACKs are refused for "+test.name+" requested without options", func(t *testing.T) {
+			// A fake server acknowledging options nobody asked for
+			p := newTestPeer(t, nil)
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				p.receive()
+				p.send(&OACKPacket{Options: []Option{{Name: "blksize", Value: "1024"}}})
+				if pkt, ok := p.receive().(*ERRORPacket); !ok || pkt.ErrorCode != ErrorCodeOptionRefused {
+					t.Errorf("got %#v want ERROR %v", pkt, ErrorCodeOptionRefused)
+				}
+			}()
+
+			err := test.run(newTestClient(t), p.conn.LocalAddr().String())
+			<-done
+			if !errors.Is(err, ErrInvalidOACK) {
+				t.Fatalf("got %v want %v", err, ErrInvalidOACK)
+			}
+		})
+	}
+}
+
+func TestClientLegacyOnly(t *testing.T) {
+	t.Run("Legacy-only clients send plain requests and use 512-byte blocks", func(t *testing.T) {
+		want := bytes.Repeat([]byte("L"), DefaultBlockSize+100)
+
+		// A fake server which would acknowledge any option requested
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if rrq, ok := p.receive().(*RRQPacket); !ok || len(rrq.Options) != 0 {
+				t.Errorf("got %#v want a RRQ without options", rrq)
+				return
+			}
+			p.send(&DATAPacket{BlockNumber: 1, Data: want[:DefaultBlockSize]})
+			expectACK(t, p, 1)
+			p.send(&DATAPacket{BlockNumber: 2, Data: want[DefaultBlockSize:]})
+			expectACK(t, p, 2)
+		}()
+
+		got := bytes.Buffer{}
+		c := newTestClient(t, WithLegacyOnly(), WithBlockSize(1024), WithWindowSize(4))
+		tr, err := c.Download(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet, &got)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		<-done
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+		if tr.BlockSize() != DefaultBlockSize {
+			t.Fatalf("got block size %v want %v", tr.BlockSize(), DefaultBlockSize)
+		}
+	})
+
+	t.Run("Legacy-only clients don't declare the size of uploads", func(t *testing.T) {
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if wrq, ok := p.receive().(*WRQPacket); !ok || len(wrq.Options) != 0 {
+				t.Errorf("got %#v want a WRQ without options", wrq)
+				return
+			}
+			p.send(&ACKPacket{BlockNumber: 0})
+			if data, ok := p.receive().(*DATAPacket); !ok || data.BlockNumber != 1 {
+				t.Errorf("got %#v want DATA 1", data)
+				return
+			}
+			p.send(&ACKPacket{BlockNumber: 1})
+		}()
+
+		c := newTestClient(t, WithLegacyOnly())
+		if err := c.Put(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet,
+			strings.NewReader("data")); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		<-done
+	})
+
+	t.Run("Sizes can't be requested by legacy-only clients", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": []byte("data")}))
+		c := newTestClient(t, WithLegacyOnly())
+		if _, err := c.Size(context.Background(), addr.String(), "file.bin", ModeOctet); err != ErrSizeUnsupported {
+			t.Fatalf("got %v want %v", err, ErrSizeUnsupported)
+		}
+	})
+}
+
+func TestClientStrictFinalBlock(t *testing.T) {
+	// A fake server which sends a short block before the end of the file
+	serve := func(p *testPeer, strict bool) <-chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if _, ok := p.receive().(*RRQPacket); !ok {
+				t.Error("wanted a RRQ but didn't get one")
+				return
+			}
+			p.send(&DATAPacket{BlockNumber: 1, Data: []byte("short")})
+			expectACK(t, p, 1)
+			p.send(&DATAPacket{BlockNumber: 2, Data: []byte("more")})
+			if !strict {
+				return
+			}
+			if e, ok := p.receive().(*ERRORPacket); !ok || e.ErrorCode != ErrorCodeNotDefined {
+				t.Errorf("got %#v want an ERROR with code %v", e, ErrorCodeNotDefined)
+			}
+		}()
+		return done
+	}
+
+	t.Run("The first short block is final", func(t *testing.T) {
+		p := newTestPeer(t, nil)
+		done := serve(p, false)
+		got := bytes.Buffer{}
+		c := newTestClient(t)
+		if _, err := c.Download(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet,
+			&got); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		<-done
+		if got.String() != "short" {
+			t.Fatalf("got %q want %q", got.String(), "short")
+		}
+	})
+
+	t.Run("Blocks after the final one are errors when checked strictly", func(t *testing.T) {
+		p := newTestPeer(t, nil)
+		done := serve(p, true)
+		c := newTestClient(t, StrictFinalBlock())
+		_, err := c.Download(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet,
+			io.Discard)
+		<-done
+		if !errors.Is(err, ErrDataAfterFinalBlock) {
+			t.Fatalf("got %v want %v", err, ErrDataAfterFinalBlock)
+		}
+	})
+
+	t.Run("Errors received while lingering are reported", func(t *testing.T) {
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if _, ok := p.receive().(*RRQPacket); !ok {
+				t.Error("wanted a RRQ but didn't get one")
+				return
+			}
+			p.send(&DATAPacket{BlockNumber: 1, Data: []byte("short")})
+			expectACK(t, p, 1)
+			p.send(&ERRORPacket{ErrorCode: ErrorCodeDiskFull, ErrorMsg: "gone"})
+		}()
+		c := newTestClient(t, StrictFinalBlock())
+		_, err := c.Download(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet,
+			io.Discard)
+		<-done
+		if !errors.Is(err, ErrorCodeDiskFull) {
+			t.Fatalf("got %v want %v", err, ErrorCodeDiskFull)
+		}
+	})
+}
+
+func TestClientResume(t *testing.T) {
+	file := make([]byte, 2000)
+	for i := range file {
+		file[i] = byte(i)
+	}
+	// A partial download, whose last block is incomplete and corrupt
+	partial := append(append([]byte(nil), file[:1024]...), bytes.Repeat([]byte{0xff}, 100)...)
+
+	// Resumes the partial download, returning the number of bytes transferred
+	download := func(t *testing.T, addr net.Addr) int64 {
+		t.Helper()
+		f, err := os.Create(filepath.Join(t.TempDir(), "file.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.Write(partial); err != nil {
+			t.Fatal(err)
+		}
+		c := newTestClient(t, WithResume())
+		tr, err := c.Download(context.Background(), addr.String(), "file.bin", ModeOctet, f)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		got, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, file) {
+			t.Fatalf("got %d bytes want %d", len(got), len(file))
+		}
+		return tr.Result().Bytes
+	}
+
+	t.Run("Downloads resume from the last complete block", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": file}), WithResume())
+		if got := download(t, addr); got != int64(len(file)-1024) {
+			t.Fatalf("got %d bytes transferred want %d", got, len(file)-1024)
+		}
+	})
+
+	t.Run("Downloads start over when the server can't resume them", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": file}))
+		if got := download(t, addr); got != int64(len(file)) {
+			t.Fatalf("got %d bytes transferred want %d", got, len(file))
+		}
+	})
+}
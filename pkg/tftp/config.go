@@ -0,0 +1,262 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// ErrInvalidConfig is returned when creating a client or server with invalid parameters
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// TransferOption type configures parameters shared by clients and servers
+type TransferOption interface {
+	ClientOption
+	ServerOption
+}
+
+// BlockRollover type determines the block number following 65535 on transfers larger than 65535 blocks
+type BlockRollover int
+
+const (
+	// RolloverToZero makes block numbers wrap around to 0, which is what most implementations do
+	RolloverToZero BlockRollover = 0
+	// RolloverToOne makes block numbers wrap around to 1
+	RolloverToOne BlockRollover = 1
+)
+
+// transferConfig holds the parameters shared by clients and servers
+type transferConfig struct {
+	timeout  time.Duration
+	retries  int
+	rollover BlockRollover
+	dscp     int // 0 leaves the traffic class of the transfer sockets untouched
+	// Time after which transfers are aborted regardless of their progress, or 0 for no limit
+	maxDuration time.Duration
+	// Whether options are neither requested nor acknowledged, as per RFC 1350
+	legacyOnly bool
+	// Whether blocks received after the final one are reported as errors
+	strictFinalBlock bool
+	// Number of blocks received from far behind the current one tolerated before aborting a transfer
+	maxBlockAnomalies int
+	// Whether downloads may be resumed with the resumeoffset option
+	resumable bool
+	// Function called whenever a transfer enters a new state
+	stateHook func(peer net.Addr, state State)
+
+	allowNonNETASCIIFilenames bool
+}
+
+func defaultTransferConfig() transferConfig {
+	return transferConfig{
+		timeout:           DefaultTimeout,
+		retries:           DefaultRetries,
+		rollover:          RolloverToZero,
+		maxBlockAnomalies: DefaultMaxBlockAnomalies,
+	}
+}
+
+type transferOptionFunc func(c *transferConfig)
+
+func (f transferOptionFunc) applyClient(c *Client) {
+	f(&c.transferConfig)
+}
+
+func (f transferOptionFunc) applyServer(s *Server) {
+	f(&s.transferConfig)
+}
+
+// WithTimeout sets the time to wait for a packet before retransmitting
+func WithTimeout(timeout time.Duration) TransferOption {
+	return transferOptionFunc(func(c *transferConfig) {
+		c.timeout = timeout
+	})
+}
+
+// WithRetries sets the number of retransmissions attempted before aborting a transfer
+func WithRetries(retries int) TransferOption {
+	return transferOptionFunc(func(c *transferConfig) {
+		c.retries = retries
+	})
+}
+
+// WithBlockRollover sets the block number following 65535 when the peer doesn't negotiate it with the rollover option
+func WithBlockRollover(rollover BlockRollover) TransferOption {
+	return transferOptionFunc(func(c *transferConfig) {
+		c.rollover = rollover
+	})
+}
+
+// MaxTransferDuration sets the time after which transfers are aborted with ErrTransferTooLong, even if they are still
+// making progress. This bounds the time a peer trickling data slowly enough not to time out can hold a transfer up.
+// Durations which are not positive lift the limit, which is the default
+func MaxTransferDuration(d time.Duration) TransferOption {
+	return transferOptionFunc(func(c *transferConfig) {
+		c.maxDuration = d
+	})
+}
+
+// WithLegacyOnly disables option negotiation altogether, so that transfers behave as per RFC 1350 with 512-byte
+// blocks. Clients request no options, and servers ignore those requested. This helps reproducing interoperability
+// issues with legacy devices
+func WithLegacyOnly() TransferOption {
+	return transferOptionFunc(func(c *transferConfig) {
+		c.legacyOnly = true
+	})
+}
+
+// StrictFinalBlock makes receivers check that no block follows the final one, which is the first block shorter than
+// the block size. Such a block is taken as final regardless, as per RFC 1350, so a sender mistakenly sending short
+// blocks before the end of the file makes the transfer end prematurely. With this option, blocks received after the
+// final one abort the transfer with ErrDataAfterFinalBlock, reported to the peer as ERROR code 0. Only files received
+// are checked, that is, uploads to servers and downloads by clients. Since such blocks can only be noticed by
+// lingering once the final block is acknowledged, every transfer checked lasts one dally period longer: the dally
+// timeout for servers, or their timeout if dallying is disabled, and the timeout for clients
+func StrictFinalBlock() TransferOption {
+	return transferOptionFunc(func(c *transferConfig) {
+		c.strictFinalBlock = true
+	})
+}
+
+// WithMaxBlockAnomalies sets the number of blocks jumping backward tolerated by receivers before aborting a transfer.
+// Blocks far behind the last window, rather than retransmissions of it, hint at a confused peer or at an attack. The
+// peer is told which block was the last one received in order, and the transfer is aborted with ErrUnexpectedBlock,
+// reported to the peer as ERROR code 0, once more than n such blocks have been received. If n is not positive, the
+// transfer is aborted as soon as the first one is received
+func WithMaxBlockAnomalies(n int) TransferOption {
+	return transferOptionFunc(func(c *transferConfig) {
+		c.maxBlockAnomalies = n
+	})
+}
+
+// WithResume enables the non-standard resumeoffset option, which resumes interrupted downloads. Clients downloading
+// into a writer which can seek request the transfer to start at the end of the data written so far, rounded down to a
+// multiple of the block size, and truncate any data past that point if the writer allows it. Should the server not
+// support the option, the download starts over from the beginning. Servers honor the option for files read from
+// seekable readers, which excludes files translated into NETASCII
+func WithResume() TransferOption {
+	return transferOptionFunc(func(c *transferConfig) {
+		c.resumable = true
+	})
+}
+
+// AllowNonNETASCIIFilenames lifts the requirement for filenames to be NETASCII, so that UTF-8 filenames used on
+// controlled networks may be sent and received. Filenames can never contain NUL bytes, which terminate them
+func AllowNonNETASCIIFilenames() TransferOption {
+	return transferOptionFunc(func(c *transferConfig) {
+		c.allowNonNETASCIIFilenames = true
+	})
+}
+
+// ServerConfig holds the settings of a server in a single place, so that they can be loaded from a configuration file
+// and validated as a whole. Settings without a field of their own can still be set by layering options on top of it
+type ServerConfig struct {
+	// Time to wait for a packet before retransmitting
+	Timeout time.Duration `json:"timeout"`
+	// Number of retransmissions attempted before aborting a transfer
+	Retries int `json:"retries"`
+	// Time the handler is given to open or create a file, or 0 for no limit
+	HandlerTimeout time.Duration `json:"handlerTimeout"`
+	// Time a transfer lingers once an upload is complete, or 0 not to linger
+	DallyTimeout time.Duration `json:"dallyTimeout"`
+	// Largest block size agreed to
+	MaxBlockSize int `json:"maxBlockSize"`
+	// Largest window agreed to
+	MaxWindowSize int `json:"maxWindowSize"`
+	// Size of the largest file which may be uploaded, or 0 for no limit
+	MaxFileSize int64 `json:"maxFileSize"`
+	// Number of transfers carried out at once, or 0 for no limit
+	MaxSessions int `json:"maxSessions"`
+	// Number of transfers carried out at once with clients sharing an IP address, or 0 for no limit
+	MaxSessionsPerClient int `json:"maxSessionsPerClient"`
+	// Aggregate throughput of the data sent, in bytes per second, or 0 for no limit
+	BandwidthLimit int64 `json:"bandwidthLimit"`
+	// Whether write requests are refused
+	ReadOnly bool `json:"readOnly"`
+	// IP addresses or CIDR prefixes of the clients served, or none to serve every client
+	Allowlist []string `json:"allowlist"`
+}
+
+// DefaultServerConfig returns the configuration servers have unless configured otherwise
+func DefaultServerConfig() ServerConfig {
+	return ServerConfig{
+		Timeout:       DefaultTimeout,
+		Retries:       DefaultRetries,
+		DallyTimeout:  DefaultDallyTimeout,
+		MaxBlockSize:  DefaultMaxServerBlockSize,
+		MaxWindowSize: DefaultMaxServerWindowSize,
+	}
+}
+
+// Validate checks that every setting is within its allowed range, returning an error wrapping ErrInvalidConfig
+// otherwise
+func (c ServerConfig) Validate() error {
+	_, err := c.allowlist()
+	switch {
+	case c.Timeout <= 0:
+		return fmt.Errorf("%w: timeout must be positive", ErrInvalidConfig)
+	case c.Retries < 0:
+		return fmt.Errorf("%w: retries can't be negative", ErrInvalidConfig)
+	case c.HandlerTimeout < 0:
+		return fmt.Errorf("%w: handler timeout can't be negative", ErrInvalidConfig)
+	case c.DallyTimeout < 0:
+		return fmt.Errorf("%w: dally timeout can't be negative", ErrInvalidConfig)
+	case c.MaxBlockSize < minBlockSize || c.MaxBlockSize > maxBlockSize:
+		return fmt.Errorf("%w: maximum block size must be between %d and %d", ErrInvalidConfig, minBlockSize,
+			maxBlockSize)
+	case c.MaxWindowSize < 1 || c.MaxWindowSize > maxWindowSize:
+		return fmt.Errorf("%w: maximum window size must be between 1 and %d", ErrInvalidConfig, maxWindowSize)
+	case c.MaxFileSize < 0:
+		return fmt.Errorf("%w: maximum file size can't be negative", ErrInvalidConfig)
+	case c.MaxSessions < 0:
+		return fmt.Errorf("%w: maximum number of sessions can't be negative", ErrInvalidConfig)
+	case c.MaxSessionsPerClient < 0:
+		return fmt.Errorf("%w: maximum number of sessions per client can't be negative", ErrInvalidConfig)
+	case c.BandwidthLimit < 0:
+		return fmt.Errorf("%w: bandwidth limit can't be negative", ErrInvalidConfig)
+	case err != nil:
+		return err
+	}
+	return nil
+}
+
+// allowlist parses the allowlist, in which IP addresses stand for prefixes containing only themselves
+func (c ServerConfig) allowlist() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range c.Allowlist {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(s)
+			if addrErr != nil {
+				return nil, fmt.Errorf("%w: invalid allowlist entry %q", ErrInvalidConfig, s)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// options returns the server options applying the configuration
+func (c ServerConfig) options() []ServerOption {
+	allowlist, _ := c.allowlist()
+	opts := []ServerOption{
+		WithTimeout(c.Timeout),
+		WithRetries(c.Retries),
+		WithHandlerTimeout(c.HandlerTimeout),
+		WithDallyTimeout(c.DallyTimeout),
+		WithMaxServerBlockSize(c.MaxBlockSize),
+		WithMaxServerWindowSize(c.MaxWindowSize),
+		WithMaxFileSize(c.MaxFileSize),
+		WithMaxSessions(c.MaxSessions),
+		WithMaxSessionsPerClient(c.MaxSessionsPerClient),
+		WithBandwidthLimit(c.BandwidthLimit),
+		WithAllowlist(allowlist...),
+	}
+	if c.ReadOnly {
+		opts = append(opts, ReadOnly())
+	}
+	return opts
+}
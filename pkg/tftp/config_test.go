@@ -0,0 +1,178 @@
+package tftp
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServerConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(c *ServerConfig)
+	}{
+		{"Negative timeouts are rejected", func(c *ServerConfig) { c.Timeout = -time.Second }},
+		{"Zero timeouts are rejected", func(c *ServerConfig) { c.Timeout = 0 }},
+		{"Negative retries are rejected", func(c *ServerConfig) { c.Retries = -1 }},
+		{"Negative handler timeouts are rejected", func(c *ServerConfig) { c.HandlerTimeout = -time.Second }},
+		{"Negative dally timeouts are rejected", func(c *ServerConfig) { c.DallyTimeout = -time.Second }},
+		{"Block sizes below 8 are rejected", func(c *ServerConfig) { c.MaxBlockSize = 7 }},
+		{"Block sizes above 65464 are rejected", func(c *ServerConfig) { c.MaxBlockSize = 65465 }},
+		{"Window sizes of 0 are rejected", func(c *ServerConfig) { c.MaxWindowSize = 0 }},
+		{"Window sizes above 32767 are rejected", func(c *ServerConfig) { c.MaxWindowSize = 32768 }},
+		{"Negative file sizes are rejected", func(c *ServerConfig) { c.MaxFileSize = -1 }},
+		{"Negative numbers of sessions are rejected", func(c *ServerConfig) { c.MaxSessions = -1 }},
+		{"Negative numbers of sessions per client are rejected", func(c *ServerConfig) { c.MaxSessionsPerClient = -1 }},
+		{"Negative bandwidth limits are rejected", func(c *ServerConfig) { c.BandwidthLimit = -1 }},
+		{"Invalid allowlist entries are rejected", func(c *ServerConfig) { c.Allowlist = []string{"10.0.0.0/33"} }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := DefaultServerConfig()
+			test.modify(&cfg)
+			if err := cfg.Validate(); !errors.Is(err, ErrInvalidConfig) {
+				t.Fatalf("got %v want %v", err, ErrInvalidConfig)
+			}
+			if _, err := NewServerWithConfig(nil, MapHandler(nil), cfg); !errors.Is(err, ErrInvalidConfig) {
+				t.Fatalf("got %v want %v", err, ErrInvalidConfig)
+			}
+		})
+	}
+
+	t.Run("The default configuration is valid", func(t *testing.T) {
+		if err := DefaultServerConfig().Validate(); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+	})
+
+	t.Run("Configurations can be serialized", func(t *testing.T) {
+		want := DefaultServerConfig()
+		want.ReadOnly = true
+		want.Allowlist = []string{"192.0.2.0/24", "2001:db8::1"}
+		b, err := json.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got ServerConfig
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %+v want %+v", got, want)
+		}
+	})
+
+	t.Run("Allowlist entries may be addresses or prefixes", func(t *testing.T) {
+		cfg := ServerConfig{Allowlist: []string{"192.0.2.1", "198.51.100.7/24", "2001:db8::/32"}}
+		got, err := cfg.allowlist()
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		want := []netip.Prefix{
+			netip.MustParsePrefix("192.0.2.1/32"),
+			netip.MustParsePrefix("198.51.100.0/24"),
+			netip.MustParsePrefix("2001:db8::/32"),
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v want %v", got, want)
+		}
+	})
+}
+
+func TestServerConfigSettings(t *testing.T) {
+	files := map[string][]byte{"file.bin": []byte("data")}
+	// start starts a server configured by cfg
+	start := func(t *testing.T, cfg ServerConfig) net.Addr {
+		t.Helper()
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewServerWithConfig(conn, MapHandler(files), cfg)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		go func() {
+			_ = s.Run()
+		}()
+		t.Cleanup(func() {
+			_ = s.Close()
+		})
+		return conn.LocalAddr()
+	}
+
+	t.Run("Read-only servers refuse write requests", func(t *testing.T) {
+		cfg := DefaultServerConfig()
+		cfg.ReadOnly = true
+		err := newTestPeer(t, start(t, cfg)).put("file.bin", ModeOctet, []byte("new"))
+		if !errors.Is(err, ErrorCodeAccessViolation) {
+			t.Fatalf("got %v want %v", err, ErrorCodeAccessViolation)
+		}
+	})
+
+	t.Run("Clients in the allowlist are served", func(t *testing.T) {
+		cfg := DefaultServerConfig()
+		cfg.Allowlist = []string{"10.0.0.0/8", "127.0.0.1"}
+		got, err := newTestPeer(t, start(t, cfg)).get("file.bin", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if string(got) != "data" {
+			t.Fatalf("got %q want %q", got, "data")
+		}
+	})
+
+	t.Run("Clients out of the allowlist are refused", func(t *testing.T) {
+		cfg := DefaultServerConfig()
+		cfg.Allowlist = []string{"10.0.0.0/8"}
+		if _, err := newTestPeer(t, start(t, cfg)).get("file.bin", ModeOctet); !errors.Is(err, ErrorCodeAccessViolation) {
+			t.Fatalf("got %v want %v", err, ErrorCodeAccessViolation)
+		}
+	})
+
+	t.Run("Requests exceeding the maximum number of sessions are refused", func(t *testing.T) {
+		cfg := DefaultServerConfig()
+		cfg.MaxSessions = 1
+		addr := start(t, cfg)
+
+		// Leave the first transfer waiting for an acknowledgement
+		first := newTestPeer(t, addr)
+		first.send(&RRQPacket{Filename: "file.bin", Mode: ModeOctet})
+		if pkt, ok := first.receive().(*DATAPacket); !ok || pkt.BlockNumber != 1 {
+			t.Fatalf("got %#v want DATA 1", pkt)
+		}
+
+		_, err := newTestPeer(t, addr).get("file.bin", ModeOctet)
+		var protocolErr ProtocolError
+		if !errors.As(err, &protocolErr) || protocolErr.Msg != DefaultBusyMessage {
+			t.Fatalf("got %v want %q", err, DefaultBusyMessage)
+		}
+		first.send(&ACKPacket{BlockNumber: 1})
+	})
+
+	t.Run("Options are applied on top of the configuration", func(t *testing.T) {
+		cfg := DefaultServerConfig()
+		cfg.MaxBlockSize = 1024
+		s, err := NewServerWithConfig(nil, MapHandler(files), cfg, WithMaxServerBlockSize(512))
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if s.maxBlockSize != 512 {
+			t.Fatalf("got maximum block size %v want %v", s.maxBlockSize, 512)
+		}
+	})
+
+	t.Run("Servers created without a connection can't be run", func(t *testing.T) {
+		s, err := NewServerWithConfig(nil, MapHandler(files), DefaultServerConfig())
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if err := s.Run(); !errors.Is(err, ErrNoConn) {
+			t.Fatalf("got %v want %v", err, ErrNoConn)
+		}
+	})
+}
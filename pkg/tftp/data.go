@@ -0,0 +1,189 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// dataWriter fragments a stream into DATA packets as it's written
+type dataWriter struct {
+	w         io.Writer
+	blockSize int
+	block     uint16 // Number of the block being filled
+	data      []byte // Data of the block being filled
+	buf       bytes.Buffer
+	err       error
+}
+
+// NewDATAWriter returns a writer which splits the data written to it into blocks of blockSize bytes, writing each one
+// of them to w as a DATA packet. Blocks are numbered from startBlock onwards, and block 65535 is followed by block 0.
+// Every packet is written with a single call to w.Write, so that w may be a datagram socket.
+//
+// Close writes the final block, which is shorter than blockSize so that the end of the stream can be told apart. If
+// the length of the stream is a multiple of blockSize, the final block is empty. It panics if blockSize is not
+// positive
+func NewDATAWriter(w io.Writer, blockSize int, startBlock uint16) io.WriteCloser {
+	if blockSize <= 0 {
+		panic("tftp: block size must be positive")
+	}
+	return &dataWriter{w: w, blockSize: blockSize, block: startBlock, data: make([]byte, 0, blockSize)}
+}
+
+func (d *dataWriter) Write(p []byte) (int, error) {
+	written := 0
+	for d.err == nil && len(p) > 0 {
+		n := copy(d.data[len(d.data):d.blockSize], p)
+		d.data = d.data[:len(d.data)+n]
+		p = p[n:]
+		written += n
+		if len(d.data) == d.blockSize {
+			d.flush()
+		}
+	}
+	return written, d.err
+}
+
+// Close writes the final block. Further writes fail with fs.ErrClosed
+func (d *dataWriter) Close() error {
+	if d.err != nil {
+		return d.err
+	}
+	d.flush()
+	if d.err == nil {
+		d.err = fs.ErrClosed
+		return nil
+	}
+	return d.err
+}
+
+// flush writes the block being filled as a DATA packet and starts the next one
+func (d *dataWriter) flush() {
+	d.buf.Reset()
+	p := DATAPacket{BlockNumber: d.block, Data: d.data}
+	if d.err = p.marshal(&d.buf, true, d.blockSize); d.err != nil {
+		return
+	}
+	if _, err := d.w.Write(d.buf.Bytes()); err != nil {
+		d.err = NewIOError("can't write DATA packet", err)
+		return
+	}
+	d.block++
+	d.data = d.data[:0]
+}
+
+// NewDATABlock returns the DATA packet carrying the given block of a file held in data, split into blocks of blockSize
+// bytes and numbered from 1, and reports whether it is the final block. The final block is shorter than blockSize, and
+// is empty if the length of data is a multiple of blockSize. The packet shares its data with the buffer.
+//
+// Block 0 and blocks past the final one don't exist, and nil is returned for them. Since block numbers don't roll over,
+// only files up to 65535 blocks long can be sent. It panics if blockSize is not positive
+func NewDATABlock(data []byte, blockSize int, block uint16) (*DATAPacket, bool) {
+	if blockSize <= 0 {
+		panic("tftp: block size must be positive")
+	}
+	final := len(data)/blockSize + 1
+	if block == 0 || int(block) > final {
+		return nil, false
+	}
+	start := (int(block) - 1) * blockSize
+	end := start + blockSize
+	if end > len(data) {
+		end = len(data)
+	}
+	return &DATAPacket{BlockNumber: block, Data: data[start:end:end]}, int(block) == final
+}
+
+// dataReader reassembles a stream from DATA packets as it's read
+type dataReader struct {
+	r         io.Reader
+	buf       []byte
+	data      []byte // Data of the last block received, not read yet
+	blockSize int
+	block     uint16 // Number of the last block received
+	started   bool   // Whether the first block has been received
+	done      bool   // Whether the final block has been received
+	err       error
+}
+
+// NewDATAReader returns a reader which presents the data carried by the DATA packets read from r as a plain stream,
+// up to the first block shorter than the block size. Every call to r.Read must return a whole packet, as is the case
+// for datagram sockets and for the writers returned by NewDATAWriter.
+//
+// The block size is assumed to be DefaultBlockSize, unless the first block is larger. Blocks must follow each other in
+// sequence, although repeated blocks are skipped. ERROR packets are reported as a ProtocolError, and streams ending
+// before the final block as io.ErrUnexpectedEOF
+func NewDATAReader(r io.Reader) io.Reader {
+	return &dataReader{r: r, buf: make([]byte, maxDatagramSize), blockSize: DefaultBlockSize}
+}
+
+func (d *dataReader) Read(p []byte) (int, error) {
+	for len(d.data) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if d.err != nil {
+			return 0, d.err
+		}
+		d.err = d.next()
+	}
+
+	n := copy(p, d.data)
+	d.data = d.data[n:]
+	return n, nil
+}
+
+// next reads the following packet
+func (d *dataReader) next() error {
+	n, err := d.r.Read(d.buf)
+	if n == 0 {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if err == io.EOF {
+		// Reported again by the next call, unless this is the final block
+		err = nil
+	}
+
+	b := d.buf[:n]
+	if len(b) < 2 {
+		return ErrTruncatedPacket
+	}
+	p := DATAPacket{}
+	switch Opcode(binary.BigEndian.Uint16(b)) {
+	case DATA:
+		if err := p.unmarshalBytes(b, true, maxBlockSize); err != nil {
+			return err
+		}
+	case ERROR:
+		e := ERRORPacket{}
+		if err := e.UnmarshalBytes(b); err != nil {
+			return err
+		}
+		return e.AsError()
+	default:
+		return fmt.Errorf("%w: expected DATA", ErrUnexpectedPacket)
+	}
+
+	if d.started {
+		if p.BlockNumber == d.block {
+			// Retransmissions are skipped
+			return err
+		}
+		if p.BlockNumber != d.block+1 {
+			return ErrUnexpectedBlock
+		}
+	} else if len(p.Data) > d.blockSize {
+		d.blockSize = len(p.Data)
+	}
+
+	d.started = true
+	d.block = p.BlockNumber
+	d.data = p.Data
+	d.done = len(p.Data) < d.blockSize
+	return err
+}
@@ -0,0 +1,228 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"reflect"
+	"testing"
+)
+
+// datagramRecorder keeps every write as a separate datagram
+type datagramRecorder struct {
+	datagrams [][]byte
+}
+
+func (r *datagramRecorder) Write(p []byte) (int, error) {
+	r.datagrams = append(r.datagrams, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// marshalDATA returns the DATA datagram for the given block
+func marshalDATA(t *testing.T, block uint16, data []byte) []byte {
+	t.Helper()
+	buf := bytes.Buffer{}
+	if err := (sessionDATA{&DATAPacket{BlockNumber: block, Data: data}, len(data)}).Marshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDATAWriter(t *testing.T) {
+	input := []byte("0123456789")
+	tests := []struct {
+		length int
+		want   [][]byte
+	}{
+		{0, [][]byte{marshalDATA(t, 1, nil)}},
+		{3, [][]byte{marshalDATA(t, 1, input[:3])}},
+		{4, [][]byte{marshalDATA(t, 1, input[:4]), marshalDATA(t, 2, nil)}},
+		{10, [][]byte{marshalDATA(t, 1, input[:4]), marshalDATA(t, 2, input[4:8]), marshalDATA(t, 3, input[8:])}},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("Streams of %d bytes are fragmented into blocks", test.length), func(t *testing.T) {
+			rec := &datagramRecorder{}
+			w := NewDATAWriter(rec, 4, 1)
+			// Write a byte at a time, so that blocks are filled across writes
+			for _, b := range input[:test.length] {
+				if _, err := w.Write([]byte{b}); err != nil {
+					t.Fatalf("got an error but didn't want one: %v", err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			if !reflect.DeepEqual(rec.datagrams, test.want) {
+				t.Fatalf("got %q want %q", rec.datagrams, test.want)
+			}
+		})
+	}
+
+	t.Run("Block numbers roll over to 0", func(t *testing.T) {
+		rec := &datagramRecorder{}
+		w := NewDATAWriter(rec, 1, 65535)
+		if _, err := w.Write([]byte("ab")); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		want := [][]byte{marshalDATA(t, 65535, []byte("a")), marshalDATA(t, 0, []byte("b"))}
+		if !reflect.DeepEqual(rec.datagrams, want) {
+			t.Fatalf("got %q want %q", rec.datagrams, want)
+		}
+	})
+
+	t.Run("Writing after closing fails", func(t *testing.T) {
+		w := NewDATAWriter(&datagramRecorder{}, 4, 1)
+		if err := w.Close(); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if _, err := w.Write([]byte("late")); !errors.Is(err, fs.ErrClosed) {
+			t.Fatalf("got %v want %v", err, fs.ErrClosed)
+		}
+	})
+}
+
+// datagramReader returns a datagram on every read
+type datagramReader struct {
+	datagrams [][]byte
+}
+
+func (r *datagramReader) Read(p []byte) (int, error) {
+	if len(r.datagrams) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.datagrams[0])
+	r.datagrams = r.datagrams[1:]
+	return n, nil
+}
+
+func TestDATAReader(t *testing.T) {
+	for _, size := range []int{0, 100, 512, 1000, 2048} {
+		t.Run(fmt.Sprintf("Files of %d bytes are reassembled", size), func(t *testing.T) {
+			want := bytes.Repeat([]byte{0x42}, size)
+			rec := &datagramRecorder{}
+			w := NewDATAWriter(rec, DefaultBlockSize, 1)
+			if _, err := w.Write(want); err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+
+			got, err := io.ReadAll(NewDATAReader(&datagramReader{rec.datagrams}))
+			if err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("got %d bytes want %d", len(got), len(want))
+			}
+		})
+	}
+
+	full := bytes.Repeat([]byte{0x42}, DefaultBlockSize)
+	tests := []struct {
+		name      string
+		datagrams [][]byte
+		want      string
+		err       error
+	}{
+		{
+			"Repeated blocks are skipped",
+			[][]byte{marshalDATA(t, 1, full), marshalDATA(t, 1, full), marshalDATA(t, 2, []byte("end"))},
+			string(full) + "end",
+			nil,
+		},
+		{
+			"Larger first blocks set the block size",
+			[][]byte{marshalDATA(t, 1, make([]byte, 1024)), marshalDATA(t, 2, full), marshalDATA(t, 3, nil)},
+			string(make([]byte, 1024)) + string(full),
+			nil,
+		},
+		{
+			"Blocks out of sequence are reported",
+			[][]byte{marshalDATA(t, 1, full), marshalDATA(t, 3, []byte("end"))},
+			string(full),
+			ErrUnexpectedBlock,
+		},
+		{
+			"Streams ending before the final block are reported",
+			[][]byte{marshalDATA(t, 1, full)},
+			string(full),
+			io.ErrUnexpectedEOF,
+		},
+		{
+			"Packets other than DATA are reported",
+			[][]byte{[]byte("\x00\x04\x00\x01")},
+			"",
+			ErrUnexpectedPacket,
+		},
+		{
+			"ERROR packets are reported",
+			[][]byte{marshalDATA(t, 1, full), []byte("\x00\x05\x00\x03disk full\x00")},
+			string(full),
+			ErrorCodeDiskFull,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := io.ReadAll(NewDATAReader(&datagramReader{test.datagrams}))
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got %v want %v", err, test.err)
+			}
+			if string(got) != test.want {
+				t.Fatalf("got %d bytes want %d", len(got), len(test.want))
+			}
+		})
+	}
+}
+
+func TestNewDATABlock(t *testing.T) {
+	data := []byte("0123456789")
+	tests := []struct {
+		name   string
+		data   []byte
+		block  uint16
+		want   string
+		final  bool
+		exists bool
+	}{
+		{"The first block starts the buffer", data, 1, "0123", false, true},
+		{"Middle blocks are full", data, 2, "4567", false, true},
+		{"The final block is short", data, 3, "89", true, true},
+		{"The final block of buffers of a multiple of the block size is empty", data[:8], 3, "", true, true},
+		{"Full blocks of buffers of a multiple of the block size are not final", data[:8], 2, "4567", false, true},
+		{"The only block of empty buffers is empty", nil, 1, "", true, true},
+		{"Block 0 doesn't exist", data, 0, "", false, false},
+		{"Blocks past the final one don't exist", data, 4, "", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, final := NewDATABlock(test.data, 4, test.block)
+			if !test.exists {
+				if p != nil || final {
+					t.Fatalf("got %#v, %v want no block", p, final)
+				}
+				return
+			}
+			if p == nil {
+				t.Fatalf("got no block want block %d", test.block)
+			}
+			if p.BlockNumber != test.block || string(p.Data) != test.want {
+				t.Fatalf("got block %d %q want block %d %q", p.BlockNumber, p.Data, test.block, test.want)
+			}
+			if final != test.final {
+				t.Fatalf("got final %v want %v", final, test.final)
+			}
+		})
+	}
+
+	t.Run("Appending to blocks leaves the buffer untouched", func(t *testing.T) {
+		buf := append([]byte(nil), data...)
+		p, _ := NewDATABlock(buf, 4, 1)
+		_ = append(p.Data, 'x')
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("got %q want %q", buf, data)
+		}
+	})
+}
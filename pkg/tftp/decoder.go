@@ -0,0 +1,141 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+var (
+	ErrFilenameTooLong = errors.New("filename is longer than allowed")
+	ErrTooManyOptions  = errors.New("packet carries more options than allowed")
+)
+
+// DecoderOption type configures optional parameters of a Decoder
+type DecoderOption interface {
+	applyDecoder(d *Decoder)
+}
+
+type decoderOptionFunc func(d *Decoder)
+
+func (f decoderOptionFunc) applyDecoder(d *Decoder) {
+	f(d)
+}
+
+// WithMaxFilenameLength limits the length in bytes of the filenames of RRQ and WRQ packets. Longer filenames are
+// rejected with ErrFilenameTooLong. By default, or if n is not positive, there is no limit
+func WithMaxFilenameLength(n int) DecoderOption {
+	return decoderOptionFunc(func(d *Decoder) {
+		d.maxFilenameLength = n
+	})
+}
+
+// WithMaxOptions limits the number of options carried by RRQ, WRQ and OACK packets. Packets carrying more options are
+// rejected with ErrTooManyOptions. By default, or if n is not positive, there is no limit
+func WithMaxOptions(n int) DecoderOption {
+	return decoderOptionFunc(func(d *Decoder) {
+		d.maxOptions = n
+	})
+}
+
+// LenientDecoding makes the decoder tolerate deviations from the standard found in the wild, namely filenames which
+// are not NETASCII, trailing bytes after ACK packets and ERROR messages lacking the terminating NUL byte. By default,
+// such packets are rejected
+func LenientDecoding() DecoderOption {
+	return decoderOptionFunc(func(d *Decoder) {
+		d.lenient = true
+	})
+}
+
+// Decoder reads packets from a stream of datagrams, subject to configurable limits
+type Decoder struct {
+	r                 io.Reader
+	buf               []byte
+	maxFilenameLength int
+	maxOptions        int
+	lenient           bool
+}
+
+// NewDecoder returns a decoder reading packets from r. Every call to r.Read must return a whole datagram, as is the
+// case for datagram sockets
+func NewDecoder(r io.Reader, opts ...DecoderOption) *Decoder {
+	d := &Decoder{r: r, buf: make([]byte, maxDatagramSize)}
+	for _, opt := range opts {
+		opt.applyDecoder(d)
+	}
+	return d
+}
+
+// Decode reads the next datagram and parses it like ParsePacket does, enforcing the limits configured for the decoder.
+// io.EOF is returned once r is exhausted
+func (d *Decoder) Decode() (Packet, error) {
+	n, err := d.r.Read(d.buf)
+	if n == 0 && err != nil {
+		return nil, err
+	}
+	// Errors returned along with a datagram are reported again by the next read
+
+	p, err := d.parse(d.buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	if err := d.check(p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parse unmarshals a datagram, tolerating deviations from the standard if the decoder is lenient
+func (d *Decoder) parse(b []byte) (Packet, error) {
+	if !d.lenient || len(b) < 2 {
+		return ParsePacket(b)
+	}
+
+	switch op := Opcode(binary.BigEndian.Uint16(b)); op {
+	case RRQ, WRQ:
+		if len(b) < MinSize(op) {
+			return nil, ErrTruncatedPacket
+		}
+		filename, mode, options, err := unmarshalRequestBytes(b[2:], true)
+		if err != nil {
+			return nil, err
+		}
+		if op == RRQ {
+			return &RRQPacket{Filename: filename, Mode: mode, Options: options}, nil
+		}
+		return &WRQPacket{Filename: filename, Mode: mode, Options: options}, nil
+	case ACK:
+		if len(b) > MinSize(ACK) {
+			b = b[:MinSize(ACK)]
+		}
+	case ERROR:
+		p := &ERRORPacket{}
+		if err := p.unmarshalBytes(b, true); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	return ParsePacket(b)
+}
+
+// check enforces the limits configured for the decoder on p
+func (d *Decoder) check(p Packet) error {
+	var filename string
+	var options []Option
+	switch p := p.(type) {
+	case *RRQPacket:
+		filename, options = p.Filename, p.Options
+	case *WRQPacket:
+		filename, options = p.Filename, p.Options
+	case *OACKPacket:
+		options = p.Options
+	}
+
+	if d.maxFilenameLength > 0 && len(filename) > d.maxFilenameLength {
+		return ErrFilenameTooLong
+	}
+	if d.maxOptions > 0 && len(options) > d.maxOptions {
+		return ErrTooManyOptions
+	}
+	return nil
+}
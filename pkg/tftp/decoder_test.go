@@ -0,0 +1,72 @@
+package tftp
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecoder(t *testing.T) {
+	longName := "\x00\x01" + strings.Repeat("a", 20) + "\x00octet\x00"
+	options := "\x00\x01file\x00octet\x00blksize\x001024\x00tsize\x000\x00"
+
+	tests := []struct {
+		name     string
+		datagram string
+		opts     []DecoderOption
+		want     Packet
+		err      error
+	}{
+		{"Packets are decoded", "\x00\x04\x00\x2A", nil, &ACKPacket{BlockNumber: 42}, nil},
+		{"Filenames within the limit are accepted", longName, []DecoderOption{WithMaxFilenameLength(20)},
+			&RRQPacket{Filename: strings.Repeat("a", 20), Mode: ModeOctet}, nil},
+		{"Filenames over the limit are rejected", longName, []DecoderOption{WithMaxFilenameLength(19)}, nil,
+			ErrFilenameTooLong},
+		{"Options within the limit are accepted", options, []DecoderOption{WithMaxOptions(2)},
+			&RRQPacket{Filename: "file", Mode: ModeOctet, Options: []Option{{"blksize", "1024"}, {"tsize", "0"}}}, nil},
+		{"Options over the limit are rejected", options, []DecoderOption{WithMaxOptions(1)}, nil, ErrTooManyOptions},
+		{"OACK options over the limit are rejected", "\x00\x06tsize\x000\x00blksize\x00512\x00",
+			[]DecoderOption{WithMaxOptions(1)}, nil, ErrTooManyOptions},
+		{"Trailing bytes after ACK packets are rejected", "\x00\x04\x00\x2A\x00", nil, nil, ErrTrailingBytes},
+		{"Lenient decoders ignore trailing bytes after ACK packets", "\x00\x04\x00\x2A\x00",
+			[]DecoderOption{LenientDecoding()}, &ACKPacket{BlockNumber: 42}, nil},
+		{"Filenames which are not NETASCII are rejected", "\x00\x02fich\xe9\x00octet\x00", nil, nil,
+			ErrInputNotNETASCII},
+		{"Lenient decoders accept filenames which are not NETASCII", "\x00\x02fich\xe9\x00octet\x00",
+			[]DecoderOption{LenientDecoding()}, &WRQPacket{Filename: "fich\xe9", Mode: ModeOctet}, nil},
+		{"Lenient decoders still enforce limits", "\x00\x02fich\xe9\x00octet\x00",
+			[]DecoderOption{LenientDecoding(), WithMaxFilenameLength(4)}, nil, ErrFilenameTooLong},
+		{"ERROR messages lacking the terminating NUL byte are rejected", "\x00\x05\x00\x01oops", nil, nil,
+			ErrTruncatedPacket},
+		{"Lenient decoders accept ERROR messages lacking the terminating NUL byte", "\x00\x05\x00\x01oops",
+			[]DecoderOption{LenientDecoding()}, &ERRORPacket{ErrorCode: ErrorCodeFileNotFound, ErrorMsg: "oops"}, nil},
+		{"Lenient decoders reject ERROR packets without a message", "\x00\x05\x00\x01",
+			[]DecoderOption{LenientDecoding()}, nil, ErrTruncatedPacket},
+		{"Lenient decoders accept complete ERROR packets", "\x00\x05\x00\x01oops\x00",
+			[]DecoderOption{LenientDecoding()}, &ERRORPacket{ErrorCode: ErrorCodeFileNotFound, ErrorMsg: "oops"}, nil},
+		{"Truncated packets are rejected", "\x00\x01", []DecoderOption{LenientDecoding()}, nil, ErrTruncatedPacket},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := NewDecoder(&datagramReader{datagrams: [][]byte{[]byte(test.datagram)}}, test.opts...)
+			got, err := d.Decode()
+			if err != test.err {
+				t.Fatalf("got error %v want %v", err, test.err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %#v want %#v", got, test.want)
+			}
+		})
+	}
+
+	t.Run("Exhausted readers are reported", func(t *testing.T) {
+		d := NewDecoder(&datagramReader{datagrams: [][]byte{[]byte("\x00\x04\x00\x01")}})
+		if _, err := d.Decode(); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if _, err := d.Decode(); err != io.EOF {
+			t.Fatalf("got %v want %v", err, io.EOF)
+		}
+	})
+}
@@ -0,0 +1,28 @@
+package tftp
+
+import (
+	"log"
+	"net"
+)
+
+// WithDSCP sets the Differentiated Services Code Point (0-63) of the datagrams sent during transfers, so that networks
+// can prioritize TFTP traffic. Where the setting can't be applied, a warning is logged and transfers proceed normally
+func WithDSCP(dscp int) TransferOption {
+	return transferOptionFunc(func(c *transferConfig) {
+		c.dscp = dscp
+	})
+}
+
+// applyDSCP sets the DSCP configured in cfg on conn, if any. Failures are not fatal
+func applyDSCP(conn net.PacketConn, cfg transferConfig) {
+	if cfg.dscp == 0 {
+		return
+	}
+	if cfg.dscp < 0 || cfg.dscp > 63 {
+		log.Printf("tftp: can't set DSCP: value %d out of range", cfg.dscp)
+		return
+	}
+	if err := setDSCP(conn, cfg.dscp); err != nil {
+		log.Printf("tftp: can't set DSCP: %v", err)
+	}
+}
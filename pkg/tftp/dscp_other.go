@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+
+package tftp
+
+import (
+	"errors"
+	"net"
+)
+
+// errDSCPUnsupported is returned by setDSCP on platforms where the traffic class of a socket can't be set
+var errDSCPUnsupported = errors.New("setting DSCP is not supported on this platform")
+
+// setDSCP sets the traffic class of the datagrams sent through conn
+func setDSCP(net.PacketConn, int) error {
+	return errDSCPUnsupported
+}
@@ -0,0 +1,33 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestDSCP(t *testing.T) {
+	tests := []struct {
+		name string
+		dscp int
+	}{
+		{"Transfers complete with DSCP set", 46},
+		{"Transfers complete when the DSCP value can't be applied", 64},
+	}
+	for _, test := range tests {
+		dscp := test.dscp
+		t.Run(test.name, func(t *testing.T) {
+			want := bytes.Repeat([]byte("expedited"), 100)
+			addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": want}), WithDSCP(dscp))
+
+			got := bytes.Buffer{}
+			err := newTestClient(t, WithDSCP(dscp)).Get(context.Background(), addr.String(), "file.bin", ModeOctet, &got)
+			if err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+			}
+		})
+	}
+}
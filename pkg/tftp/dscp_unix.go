@@ -0,0 +1,46 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package tftp
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// setDSCP sets the traffic class of the datagrams sent through conn
+func setDSCP(conn net.PacketConn, dscp int) error {
+	c, ok := conn.(net.Conn)
+	if !ok {
+		return fmt.Errorf("%T doesn't expose its socket", conn)
+	}
+	ipv4Conn, err := isIPv4Conn(conn)
+	if err != nil {
+		return err
+	}
+
+	tos := dscp << 2 // The two least significant bits are used for ECN
+	if ipv4Conn {
+		return ipv4.NewConn(c).SetTOS(tos)
+	}
+	if err := ipv6.NewConn(c).SetTrafficClass(tos); err != nil {
+		return err
+	}
+	if conn.LocalAddr().(*net.UDPAddr).IP.IsUnspecified() {
+		// Sockets bound to the unspecified address may be dual-stack ones, which send IPv4 datagrams too. This fails on
+		// IPv6-only sockets, which is fine
+		_ = ipv4.NewConn(c).SetTOS(tos)
+	}
+	return nil
+}
+
+// isIPv4Conn reports whether conn is bound to an IPv4 address
+func isIPv4Conn(conn net.PacketConn) (bool, error) {
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return false, fmt.Errorf("unsupported address type %T", conn.LocalAddr())
+	}
+	return addr.IP.To4() != nil, nil
+}
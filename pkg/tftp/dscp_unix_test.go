@@ -0,0 +1,51 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+
+package tftp
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+func TestSetDSCP(t *testing.T) {
+	t.Run("DSCP is applied to IPv4 sockets", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if err := setDSCP(conn, 46); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		tos, err := ipv4.NewConn(conn.(net.Conn)).TOS()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tos != 46<<2 {
+			t.Fatalf("got TOS %#x want %#x", tos, 46<<2)
+		}
+	})
+
+	t.Run("DSCP is applied to IPv6 sockets", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp6", "[::1]:0")
+		if err != nil {
+			t.Skipf("IPv6 is not available: %v", err)
+		}
+		defer conn.Close()
+
+		if err := setDSCP(conn, 46); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		class, err := ipv6.NewConn(conn.(net.Conn)).TrafficClass()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if class != 46<<2 {
+			t.Fatalf("got traffic class %#x want %#x", class, 46<<2)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package tftp
+
+import (
+	"bytes"
+	"io"
+)
+
+// EncoderOption type configures optional parameters of an Encoder
+type EncoderOption interface {
+	applyEncoder(e *Encoder)
+}
+
+type encoderOptionFunc func(e *Encoder)
+
+func (f encoderOptionFunc) applyEncoder(e *Encoder) {
+	f(e)
+}
+
+// SkipNETASCIICheck makes the encoder accept RRQ and WRQ packets whose filenames are not NETASCII, for the sake of
+// peers expecting UTF-8 filenames. By default, such packets are rejected with ErrInputNotNETASCII
+func SkipNETASCIICheck() EncoderOption {
+	return encoderOptionFunc(func(e *Encoder) {
+		e.allowNonNETASCII = true
+	})
+}
+
+// WithTargetBlockSize sets the block size DATA packets are validated against, so that packets as large as a block
+// size negotiated by means of the blksize option can be encoded. Sizes which are not positive are ignored, and
+// DefaultBlockSize is used instead
+func WithTargetBlockSize(size int) EncoderOption {
+	return encoderOptionFunc(func(e *Encoder) {
+		if size > 0 {
+			e.blockSize = size
+		}
+	})
+}
+
+// Encoder writes packets to a stream of datagrams
+type Encoder struct {
+	w                io.Writer
+	buf              bytes.Buffer
+	allowNonNETASCII bool
+	blockSize        int
+}
+
+// NewEncoder returns an encoder writing packets to w
+func NewEncoder(w io.Writer, opts ...EncoderOption) *Encoder {
+	e := &Encoder{w: w, blockSize: DefaultBlockSize}
+	for _, opt := range opts {
+		opt.applyEncoder(e)
+	}
+	return e
+}
+
+// Encode marshals p and writes it to w with a single call to w.Write, so that it's sent as a single datagram. Nothing
+// is written if p can't be marshalled
+func (e *Encoder) Encode(p Packet) error {
+	if e.w == nil {
+		return ErrNilWriter
+	}
+
+	e.buf.Reset()
+	var err error
+	switch p := p.(type) {
+	case *RRQPacket:
+		err = p.marshal(&e.buf, e.allowNonNETASCII)
+	case *WRQPacket:
+		err = p.marshal(&e.buf, e.allowNonNETASCII)
+	case *DATAPacket:
+		err = p.marshal(&e.buf, false, e.blockSize)
+	default:
+		err = p.Marshal(&e.buf)
+	}
+	if err != nil {
+		return err
+	}
+
+	n, err := e.w.Write(e.buf.Bytes())
+	if err != nil {
+		return NewIOError("can't write packet", err)
+	}
+	if n < e.buf.Len() {
+		return NewIOError("can't write packet", io.ErrShortWrite)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestEncoder(t *testing.T) {
+	t.Run("Packets are written in a single call", func(t *testing.T) {
+		packets := []Packet{
+			&RRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{Name: "blksize", Value: "1024"}}},
+			&DATAPacket{BlockNumber: 1, Data: []byte("hello")},
+			&ACKPacket{BlockNumber: 1},
+			&ERRORPacket{ErrorCode: ErrorCodeFileNotFound, ErrorMsg: "not found"},
+			&OACKPacket{Options: []Option{{Name: "tsize", Value: "42"}}},
+		}
+		rec := &datagramRecorder{}
+		e := NewEncoder(rec)
+		var want [][]byte
+		for _, p := range packets {
+			if err := e.Encode(p); err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			buf := bytes.Buffer{}
+			if err := p.Marshal(&buf); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, buf.Bytes())
+		}
+		if !reflect.DeepEqual(rec.datagrams, want) {
+			t.Fatalf("got %q want %q", rec.datagrams, want)
+		}
+	})
+
+	t.Run("Nothing is written for packets which can't be marshalled", func(t *testing.T) {
+		rec := &datagramRecorder{}
+		if err := NewEncoder(rec).Encode(&DATAPacket{BlockNumber: 0}); err != ErrInvalidBlockNumber {
+			t.Fatalf("got %v want %v", err, ErrInvalidBlockNumber)
+		}
+		if len(rec.datagrams) != 0 {
+			t.Fatalf("got %q want no datagrams", rec.datagrams)
+		}
+	})
+
+	t.Run("Filenames which are not NETASCII are only accepted if the check is skipped", func(t *testing.T) {
+		p := &WRQPacket{Filename: "fichero\xe9", Mode: ModeOctet}
+		if err := NewEncoder(&datagramRecorder{}).Encode(p); err != ErrInputNotNETASCII {
+			t.Fatalf("got %v want %v", err, ErrInputNotNETASCII)
+		}
+		rec := &datagramRecorder{}
+		if err := NewEncoder(rec, SkipNETASCIICheck()).Encode(p); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if want := [][]byte{[]byte("\x00\x02fichero\xe9\x00octet\x00")}; !reflect.DeepEqual(rec.datagrams, want) {
+			t.Fatalf("got %q want %q", rec.datagrams, want)
+		}
+	})
+
+	t.Run("DATA packets are validated against the target block size", func(t *testing.T) {
+		p := &DATAPacket{BlockNumber: 1, Data: make([]byte, 1024)}
+		if err := NewEncoder(&datagramRecorder{}).Encode(p); err != ErrTooMuchData {
+			t.Fatalf("got %v want %v", err, ErrTooMuchData)
+		}
+		if err := NewEncoder(&datagramRecorder{}, WithTargetBlockSize(1024)).Encode(p); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if err := NewEncoder(&datagramRecorder{}, WithTargetBlockSize(1023)).Encode(p); err != ErrTooMuchData {
+			t.Fatalf("got %v want %v", err, ErrTooMuchData)
+		}
+	})
+
+	t.Run("Write errors are reported", func(t *testing.T) {
+		r, w := io.Pipe()
+		_ = r.Close()
+		err := NewEncoder(w).Encode(&ACKPacket{BlockNumber: 1})
+		if !errors.Is(err, io.ErrClosedPipe) {
+			t.Fatalf("got %v want %v", err, io.ErrClosedPipe)
+		}
+	})
+}
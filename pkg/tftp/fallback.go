@@ -0,0 +1,38 @@
+package tftp
+
+import (
+	"context"
+	"io"
+)
+
+// fallbackHandler serves files missing from a handler from another one
+type fallbackHandler struct {
+	primary  Handler
+	fallback Handler
+}
+
+// WithFallback returns a Handler serving files from primary, and from fallback when primary reports them as not found,
+// such as a default configuration served to PXE clients whose specific file is missing. Other errors, such as access
+// violations, are reported as is. Write requests are only passed on to primary
+func WithFallback(primary, fallback Handler) Handler {
+	return &fallbackHandler{primary: primary, fallback: fallback}
+}
+
+func (h *fallbackHandler) ReadFile(ctx context.Context, req *Request) (io.ReadCloser, error) {
+	rc, err := h.primary.ReadFile(ctx, req)
+	if err != nil && ErrorCodeForError(err) == ErrorCodeFileNotFound {
+		return h.fallback.ReadFile(ctx, req)
+	}
+	return rc, err
+}
+
+func (h *fallbackHandler) WriteFile(ctx context.Context, req *Request) (io.WriteCloser, error) {
+	return h.primary.WriteFile(ctx, req)
+}
+
+// RawMode reports whether both handlers convert files into the requested mode by themselves
+func (h *fallbackHandler) RawMode() bool {
+	p, ok := h.primary.(RawModeHandler)
+	f, okFallback := h.fallback.(RawModeHandler)
+	return ok && okFallback && p.RawMode() && f.RawMode()
+}
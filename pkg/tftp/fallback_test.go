@@ -0,0 +1,71 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+)
+
+// deniedHandler refuses every request
+type deniedHandler struct{}
+
+func (deniedHandler) ReadFile(context.Context, *Request) (io.ReadCloser, error) {
+	return nil, ErrorCodeAccessViolation
+}
+
+func (deniedHandler) WriteFile(context.Context, *Request) (io.WriteCloser, error) {
+	return nil, ErrorCodeAccessViolation
+}
+
+func TestFallbackHandler(t *testing.T) {
+	primary := MapHandler(map[string][]byte{"pxe-aa.cfg": []byte("specific")})
+	fallback := MapHandler(map[string][]byte{"pxe-aa.cfg": []byte("default"), "pxe-bb.cfg": []byte("default")})
+
+	tests := []struct {
+		name     string
+		filename string
+		want     string
+	}{
+		{"Files found by the primary handler are served from it", "pxe-aa.cfg", "specific"},
+		{"Files missing from the primary handler are served from the fallback", "pxe-bb.cfg", "default"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := startTestServer(t, WithFallback(primary, fallback))
+			got, err := newTestPeer(t, addr).get(test.filename, ModeOctet)
+			if err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			if !bytes.Equal(got, []byte(test.want)) {
+				t.Fatalf("got %q want %q", got, test.want)
+			}
+		})
+	}
+
+	t.Run("Files missing from both handlers are not found", func(t *testing.T) {
+		addr := startTestServer(t, WithFallback(primary, fallback))
+		if _, err := newTestPeer(t, addr).get("pxe-cc.cfg", ModeOctet); ErrorCodeForError(err) != ErrorCodeFileNotFound {
+			t.Fatalf("got %v want %v", err, ErrorCodeFileNotFound)
+		}
+	})
+
+	t.Run("Access violations are not served from the fallback", func(t *testing.T) {
+		addr := startTestServer(t, WithFallback(deniedHandler{}, fallback))
+		if _, err := newTestPeer(t, addr).get("pxe-bb.cfg", ModeOctet); ErrorCodeForError(err) != ErrorCodeAccessViolation {
+			t.Fatalf("got %v want %v", err, ErrorCodeAccessViolation)
+		}
+	})
+
+	t.Run("Write requests are passed on to the primary handler", func(t *testing.T) {
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		addr := startTestServer(t, WithFallback(h, deniedHandler{}))
+		if err := newTestPeer(t, addr).put("upload.bin", ModeOctet, []byte("uploaded")); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if got := readMapFile(t, h, "upload.bin"); string(got) != "uploaded" {
+			t.Fatalf("got %q want %q", got, "uploaded")
+		}
+	})
+}
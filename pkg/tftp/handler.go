@@ -0,0 +1,142 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net"
+	"sync"
+)
+
+// Request describes a read or write request received by the server
+type Request struct {
+	// Requested filename, exactly as sent by the client unless the server normalizes filenames
+	Filename string
+	// Transfer mode
+	Mode Mode
+	// Address of the client, which allows handlers to tailor their responses to it
+	RemoteAddr net.Addr
+}
+
+// Handler type provides the contents served and accepted by a Server.
+//
+// Errors returned by the handler are sent to the client in an ERROR packet. The error code is derived from the
+// returned error by ErrorCodeForError, so handlers may return an ErrorCode directly.
+type Handler interface {
+	// ReadFile opens the file requested by a RRQ. The returned reader is closed when the transfer ends
+	ReadFile(ctx context.Context, req *Request) (io.ReadCloser, error)
+	// WriteFile creates the file requested by a WRQ. The returned writer is closed when the transfer ends. If the
+	// writer implements CloseWithError(error) error, that method is called instead of Close when the transfer fails
+	WriteFile(ctx context.Context, req *Request) (io.WriteCloser, error)
+}
+
+// RawModeHandler type is implemented by handlers which take care of the conversions required by the transfer mode by
+// themselves. Files served by other handlers in netascii mode are translated into NETASCII by the server
+type RawModeHandler interface {
+	Handler
+	// RawMode reports whether the handler converts files into the requested mode by itself
+	RawMode() bool
+}
+
+// ErrorCodeForError returns the TFTP error code that best describes err
+func ErrorCodeForError(err error) ErrorCode {
+	var code ErrorCode
+	switch {
+	case errors.As(err, &code):
+		return code
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrorCodeFileNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return ErrorCodeAccessViolation
+	case errors.Is(err, fs.ErrExist):
+		return ErrorCodeFileAlreadyExists
+	case errors.Is(err, ErrUnexpectedPacket):
+		return ErrorCodeIllegalOp
+	case errors.Is(err, ErrInvalidOACK):
+		return ErrorCodeOptionRefused
+	}
+	return ErrorCodeNotDefined
+}
+
+// ErrorPacketFromError builds the ERROR packet reporting err to the peer. The error message is that of err, or the
+// description of the error code if it can't be represented in NETASCII
+func ErrorPacketFromError(err error) *ERRORPacket {
+	p := &ERRORPacket{ErrorCode: ErrorCodeForError(err), ErrorMsg: err.Error()}
+
+	var protoErr ProtocolError
+	if errors.As(err, &protoErr) {
+		// Do not repeat the description of the error code
+		p.ErrorMsg = protoErr.Msg
+	}
+	if !isNETASCII(p.ErrorMsg) {
+		p.ErrorMsg = p.ErrorCode.Error()
+	}
+	return p
+}
+
+// MapFileHandler serves files from an in-memory map
+type MapFileHandler struct {
+	// AllowWrites makes WRQ uploads be stored back into the map. When false, write requests are refused
+	AllowWrites bool
+
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+// MapHandler returns a Handler serving the contents of files, keyed by filename.
+// The map must not be modified by the caller while the handler is in use.
+func MapHandler(files map[string][]byte) *MapFileHandler {
+	if files == nil {
+		files = make(map[string][]byte)
+	}
+	return &MapFileHandler{files: files}
+}
+
+// memFile is the reader returned by MapFileHandler. The embedded bytes.Reader exposes the file size
+type memFile struct {
+	*bytes.Reader
+}
+
+func (f memFile) Close() error {
+	return nil
+}
+
+func (h *MapFileHandler) ReadFile(_ context.Context, req *Request) (io.ReadCloser, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	data, ok := h.files[req.Filename]
+	if !ok {
+		return nil, ErrorCodeFileNotFound
+	}
+	return memFile{bytes.NewReader(data)}, nil
+}
+
+// memUpload is the writer returned by MapFileHandler. Uploaded data is only stored once the transfer succeeds
+type memUpload struct {
+	bytes.Buffer
+	handler  *MapFileHandler
+	filename string
+}
+
+func (u *memUpload) Close() error {
+	u.handler.mu.Lock()
+	defer u.handler.mu.Unlock()
+
+	u.handler.files[u.filename] = u.Bytes()
+	return nil
+}
+
+func (u *memUpload) CloseWithError(error) error {
+	// Discard partial uploads
+	return nil
+}
+
+func (h *MapFileHandler) WriteFile(_ context.Context, req *Request) (io.WriteCloser, error) {
+	if !h.AllowWrites {
+		return nil, ErrorCodeAccessViolation
+	}
+	return &memUpload{handler: h, filename: req.Filename}, nil
+}
@@ -0,0 +1,321 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestErrorCodeForError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want ErrorCode
+	}{
+		{ErrorCodeDiskFull, ErrorCodeDiskFull},
+		{ProtocolError{Code: ErrorCodeNoSuchUser}, ErrorCodeNoSuchUser},
+		{fs.ErrNotExist, ErrorCodeFileNotFound},
+		{fs.ErrPermission, ErrorCodeAccessViolation},
+		{fs.ErrExist, ErrorCodeFileAlreadyExists},
+		{ErrUnexpectedPacket, ErrorCodeIllegalOp},
+		{errors.New("bogus"), ErrorCodeNotDefined},
+	}
+	for _, test := range tests {
+		if got := ErrorCodeForError(test.err); got != test.want {
+			t.Errorf("got %v want %v for %v", got, test.want, test.err)
+		}
+	}
+}
+
+// readMapFile returns the contents of a file stored in a MapFileHandler
+func readMapFile(t *testing.T, h *MapFileHandler, filename string) []byte {
+	t.Helper()
+	r, err := h.ReadFile(context.Background(), &Request{Filename: filename})
+	if err != nil {
+		t.Fatalf("got an error but didn't want one: %v", err)
+	}
+	defer r.Close()
+
+	buf := bytes.Buffer{}
+	if _, err := buf.ReadFrom(r); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestMapHandler(t *testing.T) {
+	files := map[string][]byte{
+		"boot.bin":   bytes.Repeat([]byte{0xCA, 0xFE}, 600),
+		"config.txt": []byte("hostname=device\n"),
+	}
+
+	t.Run("Files in the map are served", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(files))
+		for filename, want := range files {
+			got, err := newTestPeer(t, addr).get(filename, ModeOctet)
+			if err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("got %d bytes want %d for %s", len(got), len(want), filename)
+			}
+		}
+	})
+
+	t.Run("Missing files are reported as not found", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(files))
+		_, err := newTestPeer(t, addr).get("missing.bin", ModeOctet)
+		var protoErr ProtocolError
+		if !errors.As(err, &protoErr) {
+			t.Fatalf("got %v want a ProtocolError", err)
+		}
+		if protoErr.Code != ErrorCodeFileNotFound {
+			t.Fatalf("got error code %v want %v", protoErr.Code, ErrorCodeFileNotFound)
+		}
+	})
+
+	t.Run("Uploads are refused by default", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{}))
+		err := newTestPeer(t, addr).put("upload.bin", ModeOctet, []byte("data"))
+		if !errors.Is(err, ErrorCodeAccessViolation) {
+			t.Fatalf("got %v want %v", err, ErrorCodeAccessViolation)
+		}
+	})
+
+	t.Run("Uploads are captured into the map when allowed", func(t *testing.T) {
+		h := MapHandler(map[string][]byte{})
+		h.AllowWrites = true
+		addr := startTestServer(t, h)
+
+		want := bytes.Repeat([]byte("upload"), 200)
+		if err := newTestPeer(t, addr).put("upload.bin", ModeOctet, want); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+
+		// The upload is stored once the final ACK has been sent, so read it back through the server
+		got, err := newTestPeer(t, addr).get("upload.bin", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes want %d", len(got), len(want))
+		}
+	})
+}
+
+func TestErrorPacketConversion(t *testing.T) {
+	t.Run("Protocol errors round-trip through ERROR packets", func(t *testing.T) {
+		want := ProtocolError{Code: ErrorCodeDiskFull, Msg: "no space left"}
+		p := ErrorPacketFromError(want)
+		if p.ErrorCode != want.Code || p.ErrorMsg != want.Msg {
+			t.Fatalf("got %v %q want %v %q", p.ErrorCode, p.ErrorMsg, want.Code, want.Msg)
+		}
+
+		buf := bytes.Buffer{}
+		if err := p.Marshal(&buf); err != nil {
+			t.Fatal("got an error but didn't want one")
+		}
+		got := ERRORPacket{}
+		if err := got.Unmarshal(&buf); err != nil {
+			t.Fatal("got an error but didn't want one")
+		}
+		if err := got.AsError(); err != want {
+			t.Fatalf("got %v want %v", err, want)
+		}
+	})
+
+	t.Run("Arbitrary errors are mapped to their error code", func(t *testing.T) {
+		p := ErrorPacketFromError(fmt.Errorf("opening file: %w", fs.ErrNotExist))
+		if p.ErrorCode != ErrorCodeFileNotFound {
+			t.Fatalf("got error code %v want %v", p.ErrorCode, ErrorCodeFileNotFound)
+		}
+		if p.ErrorMsg != "opening file: file does not exist" {
+			t.Fatalf("got error message %q want %q", p.ErrorMsg, "opening file: file does not exist")
+		}
+	})
+
+	t.Run("Messages which are not NETASCII are replaced", func(t *testing.T) {
+		p := ErrorPacketFromError(errors.New("ñot ñetascii"))
+		if p.ErrorMsg != ErrorCodeNotDefined.Error() {
+			t.Fatalf("got error message %q want %q", p.ErrorMsg, ErrorCodeNotDefined.Error())
+		}
+	})
+
+	t.Run("ERROR packets are converted into errors matching their code", func(t *testing.T) {
+		p := ERRORPacket{ErrorCode: ErrorCodeAccessViolation, ErrorMsg: "denied"}
+		err := p.AsError()
+		if !errors.Is(err, ErrorCodeAccessViolation) {
+			t.Fatalf("got %v want %v", err, ErrorCodeAccessViolation)
+		}
+		if err.Error() != "access violation: denied" {
+			t.Fatalf("got %q want %q", err.Error(), "access violation: denied")
+		}
+	})
+}
+
+// pxeHandler generates a configuration file for each client requesting pxe-{mac}.cfg
+type pxeHandler struct{}
+
+func (pxeHandler) ReadFile(_ context.Context, req *Request) (io.ReadCloser, error) {
+	if !strings.HasPrefix(req.Filename, "pxe-") || !strings.HasSuffix(req.Filename, ".cfg") {
+		return nil, ErrorCodeFileNotFound
+	}
+	mac, err := net.ParseMAC(strings.TrimSuffix(strings.TrimPrefix(req.Filename, "pxe-"), ".cfg"))
+	if err != nil {
+		return nil, ErrorCodeFileNotFound
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(strings.NewReader(fmt.Sprintf("mac=%s\naddr=%s\n", mac, host))), nil
+}
+
+func (pxeHandler) WriteFile(context.Context, *Request) (io.WriteCloser, error) {
+	return nil, ErrorCodeAccessViolation
+}
+
+func TestHandlerRequest(t *testing.T) {
+	t.Run("Handlers can derive content from the filename and the client address", func(t *testing.T) {
+		addr := startTestServer(t, pxeHandler{})
+
+		got, err := newTestPeer(t, addr).get("pxe-00:11:22:33:44:55.cfg", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		want := "mac=00:11:22:33:44:55\naddr=127.0.0.1\n"
+		if string(got) != want {
+			t.Fatalf("got %q want %q", got, want)
+		}
+
+		if _, err := newTestPeer(t, addr).get("other.cfg", ModeOctet); !errors.Is(err, ErrorCodeFileNotFound) {
+			t.Fatalf("got %v want %v", err, ErrorCodeFileNotFound)
+		}
+	})
+}
+
+func TestNormalizeFilenames(t *testing.T) {
+	files := map[string][]byte{"boot/pxe.0": []byte("pxe")}
+
+	t.Run("DOS-style filenames are normalized when enabled", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(files), NormalizeFilenames())
+		got, err := newTestPeer(t, addr).get("BOOT\\PXE.0", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if string(got) != "pxe" {
+			t.Fatalf("got %q want %q", got, "pxe")
+		}
+	})
+
+	t.Run("Filenames are passed on as requested by default", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(files))
+		if _, err := newTestPeer(t, addr).get("BOOT\\PXE.0", ModeOctet); !errors.Is(err, ErrorCodeFileNotFound) {
+			t.Fatalf("got %v want %v", err, ErrorCodeFileNotFound)
+		}
+	})
+}
+
+func TestFilenameRewriter(t *testing.T) {
+	files := map[string][]byte{"firmware-v2.bin": []byte("v2")}
+	rewrite := func(remote net.Addr, filename string) (string, error) {
+		switch filename {
+		case "latest.bin":
+			return "firmware-v2.bin", nil
+		case "secret.bin":
+			return "", ErrorCodeAccessViolation
+		}
+		return filename, nil
+	}
+
+	t.Run("Rewritten filenames are passed to the handler", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(files), WithFilenameRewriter(rewrite))
+		got, err := newTestPeer(t, addr).get("latest.bin", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if string(got) != "v2" {
+			t.Fatalf("got %q want %q", got, "v2")
+		}
+	})
+
+	t.Run("Errors returned by the rewriter refuse the request", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(files), WithFilenameRewriter(rewrite))
+		if _, err := newTestPeer(t, addr).get("secret.bin", ModeOctet); !errors.Is(err, ErrorCodeAccessViolation) {
+			t.Fatalf("got %v want %v", err, ErrorCodeAccessViolation)
+		}
+	})
+
+	t.Run("Normalized filenames are rewritten", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(files), NormalizeFilenames(), WithFilenameRewriter(rewrite))
+		got, err := newTestPeer(t, addr).get("LATEST.BIN", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if string(got) != "v2" {
+			t.Fatalf("got %q want %q", got, "v2")
+		}
+	})
+
+	t.Run("Uploads are stored under the rewritten filename", func(t *testing.T) {
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		addr := startTestServer(t, h, WithFilenameRewriter(rewrite))
+		if err := newTestPeer(t, addr).put("latest.bin", ModeOctet, []byte("v3")); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if got := readMapFile(t, h, "firmware-v2.bin"); string(got) != "v3" {
+			t.Fatalf("got %q want %q", got, "v3")
+		}
+	})
+
+	t.Run("Checksums are reported under the rewritten filename", func(t *testing.T) {
+		reported := make(chan string, 1)
+		addr := startTestServer(t, MapHandler(files), WithFilenameRewriter(rewrite),
+			WithChecksum(sha256.New, func(filename string, sum []byte) {
+				want := sha256.Sum256(files["firmware-v2.bin"])
+				if !bytes.Equal(sum, want[:]) {
+					t.Errorf("got checksum %x want %x", sum, want)
+				}
+				reported <- filename
+			}))
+		if _, err := newTestPeer(t, addr).get("latest.bin", ModeOctet); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		select {
+		case got := <-reported:
+			if got != "firmware-v2.bin" {
+				t.Fatalf("got %q want %q", got, "firmware-v2.bin")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no checksum was reported")
+		}
+	})
+
+	t.Run("Slow rewriters don't hold up other clients", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+		slow := func(_ net.Addr, filename string) (string, error) {
+			if filename == "slow.bin" {
+				<-release
+			}
+			return filename, nil
+		}
+		addr := startTestServer(t, MapHandler(files), WithFilenameRewriter(slow))
+		newTestPeer(t, addr).send(&RRQPacket{Filename: "slow.bin", Mode: ModeOctet})
+		got, err := newTestPeer(t, addr).get("firmware-v2.bin", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if string(got) != "v2" {
+			t.Fatalf("got %q want %q", got, "v2")
+		}
+	})
+}
@@ -0,0 +1,378 @@
+package tftp
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memAddr is the address of a memConn
+type memAddr string
+
+func (a memAddr) Network() string {
+	return "mem"
+}
+
+func (a memAddr) String() string {
+	return string(a)
+}
+
+// memNetwork connects memConns with each other, delivering datagrams in memory
+type memNetwork struct {
+	mu    sync.Mutex
+	conns map[memAddr]*memConn
+	next  int
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{conns: make(map[memAddr]*memConn)}
+}
+
+// listen returns a new connection bound to a newly allocated address
+func (n *memNetwork) listen() *memConn {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.next++
+	c := &memConn{
+		network: n,
+		addr:    memAddr("mem:" + strconv.Itoa(n.next)),
+		in:      make(chan memDatagram, 64),
+		closed:  make(chan struct{}),
+	}
+	n.conns[c.addr] = c
+	return c
+}
+
+// ListenFunc allocates transfer IDs on the network
+func (n *memNetwork) ListenFunc(net.Addr) (net.PacketConn, error) {
+	return n.listen(), nil
+}
+
+// send delivers d to the connection bound to the given address, if any
+func (n *memNetwork) send(d memDatagram, to memAddr) {
+	n.mu.Lock()
+	dst, ok := n.conns[to]
+	n.mu.Unlock()
+	if ok {
+		dst.deliver(d)
+	}
+}
+
+type memDatagram struct {
+	b    []byte
+	from net.Addr
+}
+
+// memFault type is a fault scripted to happen to a datagram sent by a memConn
+type memFault int
+
+const (
+	// memDrop loses the datagram
+	memDrop memFault = iota + 1
+	// memDuplicate delivers the datagram twice
+	memDuplicate
+	// memDelay holds the datagram back until the following one has been delivered, so that they arrive swapped
+	memDelay
+)
+
+// memConn is an in-memory implementation of net.PacketConn. Like with UDP, datagrams sent to unknown addresses or to
+// connections which can't keep up are lost. Faults may be scripted to happen to the datagrams it sends, so that
+// retransmissions and windowing can be tested deterministically
+type memConn struct {
+	network *memNetwork
+	addr    memAddr
+	in      chan memDatagram
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	mu       sync.Mutex
+	deadline time.Time
+	sent     int              // Datagrams sent so far
+	faults   map[int]memFault // Faults keyed by the number of the datagram they happen to, starting at 1
+	held     *memDatagram     // Datagram held back by memDelay
+	heldTo   memAddr
+}
+
+// script makes the given fault happen to the nth datagram sent from now on, starting at 1
+func (c *memConn) script(n int, fault memFault) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.faults == nil {
+		c.faults = make(map[int]memFault)
+	}
+	c.faults[c.sent+n] = fault
+}
+
+// inject delivers b to c as if it had been sent from the given address, which need not belong to the network
+func (c *memConn) inject(b []byte, from net.Addr) {
+	c.deliver(memDatagram{b: append([]byte(nil), b...), from: from})
+}
+
+// deliver queues d to be read, dropping it if c can't keep up
+func (c *memConn) deliver(d memDatagram) {
+	select {
+	case c.in <- d:
+	default:
+	}
+}
+
+func (c *memConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case d := <-c.in:
+		return copy(b, d.b), d.from, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, &net.OpError{Op: "read", Net: "mem", Addr: c.addr, Err: os.ErrDeadlineExceeded}
+	}
+}
+
+func (c *memConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent++
+	d := memDatagram{b: append([]byte(nil), b...), from: c.addr}
+	switch c.faults[c.sent] {
+	case memDrop:
+	case memDuplicate:
+		c.network.send(d, memAddr(addr.String()))
+		c.network.send(d, memAddr(addr.String()))
+	case memDelay:
+		c.held, c.heldTo = &d, memAddr(addr.String())
+		return len(b), nil
+	default:
+		c.network.send(d, memAddr(addr.String()))
+	}
+	if c.held != nil {
+		c.network.send(*c.held, c.heldTo)
+		c.held = nil
+	}
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		err = nil
+		close(c.closed)
+		c.network.mu.Lock()
+		delete(c.network.conns, c.addr)
+		c.network.mu.Unlock()
+	})
+	return err
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+var _ net.PacketConn = (*memConn)(nil)
+
+func TestMemConn(t *testing.T) {
+	// exchange sends every datagram from a new connection to another one, returning the datagrams received
+	exchange := func(t *testing.T, script func(c *memConn), datagrams ...string) []string {
+		t.Helper()
+		network := newMemNetwork()
+		src, dst := network.listen(), network.listen()
+		script(src)
+		for _, d := range datagrams {
+			if _, err := src.WriteTo([]byte(d), dst.LocalAddr()); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var got []string
+		buf := make([]byte, maxDatagramSize)
+		for {
+			if err := dst.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+				t.Fatal(err)
+			}
+			n, addr, err := dst.ReadFrom(buf)
+			if err != nil {
+				return got
+			}
+			if addr != src.LocalAddr() {
+				t.Fatalf("got a datagram from %v want %v", addr, src.LocalAddr())
+			}
+			got = append(got, string(buf[:n]))
+		}
+	}
+
+	tests := []struct {
+		name   string
+		script func(c *memConn)
+		want   []string
+	}{
+		{"Datagrams are delivered in order", func(c *memConn) {}, []string{"1", "2", "3"}},
+		{"Scripted drops lose the datagram", func(c *memConn) { c.script(2, memDrop) }, []string{"1", "3"}},
+		{"Scripted duplicates are delivered twice", func(c *memConn) { c.script(2, memDuplicate) },
+			[]string{"1", "2", "2", "3"}},
+		{"Scripted delays swap the datagram with the following one", func(c *memConn) { c.script(1, memDelay) },
+			[]string{"2", "1", "3"}},
+		{"Faults are scripted from the datagrams sent next", func(c *memConn) {
+			_, _ = c.WriteTo([]byte("0"), memAddr("mem:unknown"))
+			c.script(1, memDrop)
+		}, []string{"2", "3"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := exchange(t, test.script, "1", "2", "3"); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v want %v", got, test.want)
+			}
+		})
+	}
+
+	t.Run("Injected datagrams come from spoofed addresses", func(t *testing.T) {
+		c := newMemNetwork().listen()
+		c.inject([]byte("spoofed"), memAddr("mem:spoofed"))
+		buf := make([]byte, maxDatagramSize)
+		n, addr, err := c.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if string(buf[:n]) != "spoofed" || addr != memAddr("mem:spoofed") {
+			t.Fatalf("got %q from %v want %q from %v", buf[:n], addr, "spoofed", "mem:spoofed")
+		}
+	})
+
+	t.Run("Reads time out once the deadline expires", func(t *testing.T) {
+		c := newMemNetwork().listen()
+		if err := c.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		var netErr net.Error
+		if _, _, err := c.ReadFrom(make([]byte, 1)); !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatalf("got %v want a timeout", err)
+		}
+	})
+
+	t.Run("Closed connections can't be used", func(t *testing.T) {
+		c := newMemNetwork().listen()
+		if err := c.Close(); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if _, _, err := c.ReadFrom(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("got %v want %v", err, net.ErrClosed)
+		}
+		if _, err := c.WriteTo([]byte("x"), c.LocalAddr()); !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("got %v want %v", err, net.ErrClosed)
+		}
+	})
+}
+
+func TestMemConnTransfer(t *testing.T) {
+	t.Run("Windowed transfers recover from lost, duplicated and reordered datagrams", func(t *testing.T) {
+		want := bytes.Repeat([]byte("0123456789abcdef"), 20*DefaultBlockSize/16+5)
+		network := newMemNetwork()
+		senderConn, receiverConn := network.listen(), network.listen()
+		defer senderConn.Close()
+		defer receiverConn.Close()
+
+		cfg := defaultTransferConfig()
+		cfg.timeout = 20 * time.Millisecond
+		sender := newSession(senderConn, receiverConn.LocalAddr(), cfg)
+		receiver := newSession(receiverConn, senderConn.LocalAddr(), cfg)
+		sender.windowSize, receiver.windowSize = 4, 4
+		receiver.prepareACK(0)
+
+		senderConn.script(3, memDrop)
+		senderConn.script(6, memDelay)
+		senderConn.script(9, memDuplicate)
+		receiverConn.script(2, memDrop)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- sender.sendFile(bytes.NewReader(want))
+		}()
+		got := bytes.Buffer{}
+		if err := receiver.receiveFile(&got, func() error { return nil }); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+	})
+
+	t.Run("Windows whose first block is lost are sent again without waiting for a timeout", func(t *testing.T) {
+		want := bytes.Repeat([]byte("w"), 10*DefaultBlockSize+5)
+		network := newMemNetwork()
+		senderConn, receiverConn := network.listen(), network.listen()
+		defer senderConn.Close()
+		defer receiverConn.Close()
+
+		cfg := defaultTransferConfig()
+		cfg.timeout = 2 * time.Second
+		sender := newSession(senderConn, receiverConn.LocalAddr(), cfg)
+		receiver := newSession(receiverConn, senderConn.LocalAddr(), cfg)
+		sender.windowSize, receiver.windowSize = 4, 4
+		receiver.prepareACK(0)
+
+		// Lose block 5, the first one of the second window
+		senderConn.script(5, memDrop)
+
+		start := time.Now()
+		done := make(chan error, 1)
+		go func() {
+			done <- sender.sendFile(bytes.NewReader(want))
+		}()
+		got := bytes.Buffer{}
+		if err := receiver.receiveFile(&got, func() error { return nil }); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+		if elapsed := time.Since(start); elapsed >= cfg.timeout/2 {
+			t.Fatalf("got the transfer stalled for %v want no timeout", elapsed)
+		}
+		if sender.retransmits != 0 {
+			t.Fatalf("got %d retransmissions triggered by timeouts want none", sender.retransmits)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package tftp
+
+import "io"
+
+// netasciiReader translates text into NETASCII as it's read
+type netasciiReader struct {
+	r   io.Reader
+	err error
+	in  [DefaultBlockSize]byte
+	out []byte // Translated data not read yet
+	buf []byte // Backing storage for out
+}
+
+// NewNETASCIIReader returns a reader which translates the text read from r into NETASCII, as defined in RFC 764.
+// Line feeds are translated into CR LF sequences, and carriage returns into CR NUL sequences
+func NewNETASCIIReader(r io.Reader) io.Reader {
+	return &netasciiReader{r: r, buf: make([]byte, 0, 2*DefaultBlockSize)}
+}
+
+// size returns the length of the text still to be read once translated into NETASCII, which is larger than the
+// length of the source text since line feeds and carriage returns are expanded. The source is scanned to find out,
+// so this is only possible if it can be rewound afterwards
+func (n *netasciiReader) size() (int64, bool) {
+	size := int64(len(n.out))
+	if n.err != nil {
+		return size, n.err == io.EOF
+	}
+	rs, ok := n.r.(io.ReadSeeker)
+	if !ok {
+		return 0, false
+	}
+	start, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false
+	}
+
+	for {
+		k, err := rs.Read(n.in[:])
+		size += int64(k)
+		for _, b := range n.in[:k] {
+			if b == '\n' || b == '\r' {
+				size++
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_, _ = rs.Seek(start, io.SeekStart)
+			return 0, false
+		}
+	}
+
+	if _, err := rs.Seek(start, io.SeekStart); err != nil {
+		return 0, false
+	}
+	return size, true
+}
+
+func (n *netasciiReader) Read(p []byte) (int, error) {
+	for len(n.out) == 0 {
+		if n.err != nil {
+			return 0, n.err
+		}
+
+		var k int
+		k, n.err = n.r.Read(n.in[:])
+		n.out = n.buf[:0]
+		for _, b := range n.in[:k] {
+			switch b {
+			case '\n':
+				n.out = append(n.out, '\r', '\n')
+			case '\r':
+				n.out = append(n.out, '\r', 0)
+			default:
+				n.out = append(n.out, b)
+			}
+		}
+	}
+
+	k := copy(p, n.out)
+	n.out = n.out[k:]
+	return k, nil
+}
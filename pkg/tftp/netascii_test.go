@@ -0,0 +1,97 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestNETASCIIReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"Empty input is left empty", "", ""},
+		{"Line feeds are translated into CR LF", "one\ntwo\n", "one\r\ntwo\r\n"},
+		{"Carriage returns are translated into CR NUL", "one\rtwo", "one\r\x00two"},
+		{"Input larger than a block is translated", strings.Repeat("\n", 1000), strings.Repeat("\r\n", 1000)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := io.ReadAll(NewNETASCIIReader(strings.NewReader(test.input)))
+			if err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			if string(got) != test.want {
+				t.Fatalf("got %q want %q", got, test.want)
+			}
+		})
+	}
+
+	t.Run("Small reads are supported", func(t *testing.T) {
+		got, err := io.ReadAll(iotest.OneByteReader(NewNETASCIIReader(strings.NewReader("a\nb"))))
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if string(got) != "a\r\nb" {
+			t.Fatalf("got %q want %q", got, "a\r\nb")
+		}
+	})
+
+	t.Run("Errors are propagated", func(t *testing.T) {
+		_, err := io.ReadAll(NewNETASCIIReader(iotest.ErrReader(io.ErrClosedPipe)))
+		if err != io.ErrClosedPipe {
+			t.Fatalf("got %v want %v", err, io.ErrClosedPipe)
+		}
+	})
+}
+
+// rawModeHandler serves files as they are regardless of the transfer mode
+type rawModeHandler struct {
+	*MapFileHandler
+}
+
+func (h rawModeHandler) RawMode() bool {
+	return true
+}
+
+func TestServerNETASCII(t *testing.T) {
+	text := []byte("first line\nsecond line\n")
+
+	t.Run("Files are served as they are in octet mode", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.txt": text}))
+		got := bytes.Buffer{}
+		if err := newTestClient(t).Get(context.Background(), addr.String(), "file.txt", ModeOctet, &got); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), text) {
+			t.Fatalf("got %q want %q", got.Bytes(), text)
+		}
+	})
+
+	t.Run("Files are translated in netascii mode", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.txt": text}))
+		got := bytes.Buffer{}
+		if err := newTestClient(t).Get(context.Background(), addr.String(), "file.txt", "NETASCII", &got); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if want := "first line\r\nsecond line\r\n"; got.String() != want {
+			t.Fatalf("got %q want %q", got.String(), want)
+		}
+	})
+
+	t.Run("Raw mode handlers translate files themselves", func(t *testing.T) {
+		addr := startTestServer(t, rawModeHandler{MapHandler(map[string][]byte{"file.txt": text})})
+		got := bytes.Buffer{}
+		if err := newTestClient(t).Get(context.Background(), addr.String(), "file.txt", ModeNETASCII, &got); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), text) {
+			t.Fatalf("got %q want %q", got.Bytes(), text)
+		}
+	})
+}
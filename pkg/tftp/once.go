@@ -0,0 +1,98 @@
+package tftp
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ServeFileOnce listens on the UDP address addr and serves the file at diskPath to a single client, returning once it
+// has been downloaded successfully. The file is served to read requests for its base name, and other requests are
+// refused. So are those received while the file is being served, although the file can be requested again should the
+// transfer fail. This is handy for scripts handing a firmware image to a device, which don't need a server to be left
+// running afterwards
+func ServeFileOnce(addr, diskPath string, opts ...ServerOption) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return serveFileOnce(conn, diskPath, opts...)
+}
+
+// serveFileOnce behaves like ServeFileOnce, receiving requests from conn
+func serveFileOnce(conn net.PacketConn, diskPath string, opts ...ServerOption) error {
+	h := &onceHandler{name: filepath.Base(diskPath), path: diskPath, done: make(chan struct{})}
+	s := NewServer(h, append(opts, serverOptionFunc(func(s *Server) {
+		s.onServed = h.served
+	}))...)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- s.Serve(conn)
+	}()
+	select {
+	case <-h.done:
+		return s.Close()
+	case err := <-errs:
+		return err
+	}
+}
+
+// onceHandler serves a file from disk to a single client at a time, until it has been served successfully
+type onceHandler struct {
+	name string // Filename served
+	path string // Path of the file on disk
+	done chan struct{}
+
+	mu      sync.Mutex
+	serving bool // Whether the file is being served
+	isDone  bool // Whether the file has been served successfully
+}
+
+func (h *onceHandler) ReadFile(_ context.Context, req *Request) (io.ReadCloser, error) {
+	if req.Filename != h.name {
+		return nil, ErrorCodeFileNotFound
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.serving || h.isDone {
+		return nil, ProtocolError{Code: ErrorCodeAccessViolation, Msg: "file already being served"}
+	}
+	f, err := os.Open(h.path)
+	if err != nil {
+		return nil, err
+	}
+	h.serving = true
+	return &onceFile{File: f, h: h}, nil
+}
+
+func (h *onceHandler) WriteFile(context.Context, *Request) (io.WriteCloser, error) {
+	return nil, ErrorCodeAccessViolation
+}
+
+// served is called once the file has been served successfully
+func (h *onceHandler) served(*Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.isDone {
+		h.isDone = true
+		close(h.done)
+	}
+}
+
+// onceFile is a file served by a onceHandler, which lets other clients request it once closed
+type onceFile struct {
+	*os.File
+	h *onceHandler
+}
+
+func (f *onceFile) Close() error {
+	f.h.mu.Lock()
+	f.h.serving = false
+	f.h.mu.Unlock()
+	return f.File.Close()
+}
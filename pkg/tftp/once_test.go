@@ -0,0 +1,101 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeFileOnce(t *testing.T) {
+	want := bytes.Repeat([]byte("firmware"), 200)
+	path := filepath.Join(t.TempDir(), "image.bin")
+	if err := os.WriteFile(path, want, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// serve serves the file once in the background, returning the address of the server and the result of serving
+	serve := func(t *testing.T) (net.Addr, <-chan error) {
+		t.Helper()
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+		done := make(chan error, 1)
+		go func() {
+			done <- serveFileOnce(conn, path, WithDallyTimeout(0))
+		}()
+		return conn.LocalAddr(), done
+	}
+
+	t.Run("The server stops once the file has been served", func(t *testing.T) {
+		addr, done := serve(t)
+		got, err := newTestPeer(t, addr).get("image.bin", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes want %d", len(got), len(want))
+		}
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the server is still running")
+		}
+
+		c := newTestClient(t, WithTimeout(100*time.Millisecond), WithRetries(0))
+		if err := c.Get(context.Background(), addr.String(), "image.bin", ModeOctet, &bytes.Buffer{}); err == nil {
+			t.Fatal("wanted an error but didn't get one")
+		}
+	})
+
+	t.Run("Requests received while the file is being served are refused", func(t *testing.T) {
+		addr, done := serve(t)
+		first := newTestPeer(t, addr)
+		first.send(&RRQPacket{Filename: "image.bin", Mode: ModeOctet})
+		if pkt, ok := first.receive().(*DATAPacket); !ok || pkt.BlockNumber != 1 {
+			t.Fatalf("got %#v want DATA 1", pkt)
+		}
+
+		if _, err := newTestPeer(t, addr).get("image.bin", ModeOctet); !errors.Is(err, ErrorCodeAccessViolation) {
+			t.Fatalf("got %v want %v", err, ErrorCodeAccessViolation)
+		}
+
+		// Abandon the first transfer, after which the file can be requested again
+		first.send(&ERRORPacket{ErrorCode: ErrorCodeNotDefined, ErrorMsg: "cancelled"})
+		var got []byte
+		var err error
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			if got, err = newTestPeer(t, addr).get("image.bin", ModeOctet); !errors.Is(err, ErrorCodeAccessViolation) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes want %d", len(got), len(want))
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+	})
+
+	t.Run("Other files are not served", func(t *testing.T) {
+		addr, _ := serve(t)
+		if _, err := newTestPeer(t, addr).get("other.bin", ModeOctet); !errors.Is(err, ErrorCodeFileNotFound) {
+			t.Fatalf("got %v want %v", err, ErrorCodeFileNotFound)
+		}
+	})
+}
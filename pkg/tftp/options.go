@@ -0,0 +1,363 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// OptionBlockSize is the name of the block size option, as defined in RFC 2348
+	OptionBlockSize = "blksize"
+	// OptionTimeout is the name of the timeout interval option, as defined in RFC 2349
+	OptionTimeout = "timeout"
+	// OptionTransferSize is the name of the transfer size option, as defined in RFC 2349
+	OptionTransferSize = "tsize"
+	// OptionWindowSize is the name of the window size option, as defined in RFC 7440
+	OptionWindowSize = "windowsize"
+	// OptionRollover is the name of the non-standard block number rollover option, whose value is the block number
+	// following 65535
+	OptionRollover = "rollover"
+	// OptionResumeOffset is the name of the non-standard option resuming a download, whose value is the offset the
+	// file is read from. The offset must be a multiple of the block size, and blocks are numbered as if the file had
+	// been read from the beginning
+	OptionResumeOffset = "resumeoffset"
+)
+
+// supportedOptions lists the options implemented by the package, in the order they were standardized
+var supportedOptions = []string{OptionBlockSize, OptionTimeout, OptionTransferSize, OptionWindowSize, OptionRollover,
+	OptionResumeOffset}
+
+// SupportedOptions returns the names of the options implemented by the package. Any other option requested by a
+// client is left out of the OACK
+func SupportedOptions() []string {
+	return append([]string(nil), supportedOptions...)
+}
+
+// standardOptions lists the options standardized by RFC 2348, RFC 2349 and RFC 7440, in the order CanonicalizeOptions
+// puts them in
+var standardOptions = []string{OptionBlockSize, OptionTimeout, OptionTransferSize, OptionWindowSize}
+
+// CanonicalizeOptions returns the options in m in a stable order, so that requests built from maps are reproducible:
+// blksize, timeout, tsize and windowsize come first, followed by any other options sorted by name. Option names are
+// compared case-insensitively. Options whose name is empty, or whose name or value is not NETASCII, can't be sent and
+// are left out
+func CanonicalizeOptions(m map[string]string) []Option {
+	rank := func(name string) int {
+		for i, standard := range standardOptions {
+			if strings.EqualFold(name, standard) {
+				return i
+			}
+		}
+		return len(standardOptions)
+	}
+
+	options := make([]Option, 0, len(m))
+	for name, value := range m {
+		if name != "" && isNETASCII(name) && isNETASCII(value) {
+			options = append(options, Option{Name: name, Value: value})
+		}
+	}
+	sort.Slice(options, func(i, j int) bool {
+		a, b := options[i].Name, options[j].Name
+		if ra, rb := rank(a), rank(b); ra != rb {
+			return ra < rb
+		}
+		if la, lb := strings.ToLower(a), strings.ToLower(b); la != lb {
+			return la < lb
+		}
+		return a < b
+	})
+	return options
+}
+
+// Range of block sizes allowed by RFC 2348. Larger block sizes are never requested, and are clamped when requested by
+// clients
+const (
+	minBlockSize = 8
+	maxBlockSize = 65464
+)
+
+// maxWindowSize is the largest window ever requested or agreed to. Block numbers wrap around after 65535, so blocks
+// ahead of the one expected can only be told apart from retransmissions of earlier blocks within half that range
+const maxWindowSize = 32767
+
+// maxUDPPayloadSize is the largest payload of a UDP datagram sent over IPv4, which is 65535 bytes minus the 20 bytes of
+// the IPv4 header and the 8 bytes of the UDP header
+const maxUDPPayloadSize = 65507
+
+// DATA datagrams carrying blocks of the largest size, 65468 bytes long, must fit in a UDP datagram. This fails to
+// compile otherwise
+var _ [maxUDPPayloadSize - (4 + maxBlockSize)]struct{}
+
+// ErrInvalidOACK is returned when the server acknowledges options which were not requested, or with values which are
+// not acceptable responses to the requested ones
+var ErrInvalidOACK = errors.New("server acknowledged unacceptable options")
+
+// fileSize returns the size of the file read from r, if it can be known before reading it. Only the data left to be
+// read counts, so that readers partially read or seeked past their beginning report what will actually be sent. The
+// size of files translated into NETASCII is that of the translated text, which is only known if the file can be
+// scanned beforehand
+func fileSize(r io.Reader) (int64, bool) {
+	var size int64
+	switch r := r.(type) {
+	case *netasciiReader:
+		return r.size()
+	case interface{ Len() int }:
+		return int64(r.Len()), true
+	case interface{ Size() int64 }:
+		size = r.Size()
+	case interface{ Stat() (fs.FileInfo, error) }:
+		info, err := r.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return 0, false
+		}
+		size = info.Size()
+	default:
+		return 0, false
+	}
+
+	// Sizes of whole files only hold from their beginning
+	if seeker, ok := r.(io.Seeker); ok {
+		offset, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		size -= offset
+		if size < 0 {
+			size = 0
+		}
+	}
+	return size, true
+}
+
+// negotiate returns the subset of the requested options accepted for this session. For read requests, r is the
+// reader the file is served from; for write requests it is nil. Unknown or unacceptable options are left out, and so
+// are all options in legacy-only mode. Accepting the resumeoffset option seeks r to the requested offset
+func (s *session) negotiate(requested []Option, r io.Reader) []Option {
+	if s.legacyOnly {
+		return nil
+	}
+	var accepted []Option
+	var resume Option
+	for _, option := range requested {
+		switch option.Name {
+		case OptionResumeOffset:
+			// Handled once the block size is known
+			resume = option
+		case OptionTransferSize:
+			if r == nil {
+				// Acknowledge the size of the file about to be written
+				if _, err := strconv.ParseInt(option.Value, 10, 64); err == nil {
+					accepted = append(accepted, option)
+				}
+			} else if size, ok := fileSize(r); ok {
+				// Report the size of the file about to be read. Streams whose size is unknown can't honor the option
+				accepted = append(accepted, Option{Name: OptionTransferSize, Value: strconv.FormatInt(size, 10)})
+			}
+		case OptionBlockSize:
+			if n, err := strconv.Atoi(option.Value); err == nil && n >= minBlockSize {
+				// Offer a smaller block size than requested if needed, which the client must honor
+				if n > s.maxBlockSize {
+					n = s.maxBlockSize
+				}
+				s.blockSize = n
+				accepted = append(accepted, Option{Name: OptionBlockSize, Value: strconv.Itoa(n)})
+			}
+		case OptionTimeout:
+			// The client uses the same timeout once acknowledged
+			if n, err := strconv.Atoi(option.Value); err == nil && n >= 1 && n <= 255 {
+				s.timeout = time.Duration(n) * time.Second
+				accepted = append(accepted, Option{Name: OptionTimeout, Value: strconv.Itoa(n)})
+			}
+		case OptionWindowSize:
+			if n, err := strconv.ParseUint(option.Value, 10, 16); err == nil && n >= 1 {
+				// Offer a smaller window than requested if needed, which the client must honor
+				if n > uint64(s.maxWindowSize) {
+					n = uint64(s.maxWindowSize)
+				}
+				s.windowSize = int(n)
+				accepted = append(accepted, Option{Name: OptionWindowSize, Value: strconv.FormatUint(n, 10)})
+			}
+		case OptionRollover:
+			// Unsupported values are left out
+			if rollover, ok := parseRollover(option.Value); ok {
+				s.rollover = rollover
+				accepted = append(accepted, option)
+			}
+		}
+	}
+	if resume.Name != "" && s.resume(resume, r) {
+		accepted = append(accepted, resume)
+	}
+	s.options = accepted
+	return accepted
+}
+
+// resume seeks r to the offset requested by the resumeoffset option, and makes the transfer start from the block found
+// at that offset. Offsets which are not a multiple of the block size are refused, and so are the option on write
+// requests, on readers which can't seek, and unless resuming is enabled
+func (s *session) resume(option Option, r io.Reader) bool {
+	seeker, ok := r.(io.Seeker)
+	if !s.resumable || !ok {
+		return false
+	}
+	offset, err := strconv.ParseInt(option.Value, 10, 64)
+	if err != nil || offset < 0 || offset%int64(s.blockSize) != 0 {
+		return false
+	}
+	if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+		return false
+	}
+	s.firstBlock = s.blockAfter(offset / int64(s.blockSize))
+	return true
+}
+
+// NegotiatedBlockSize returns the block size in effect once the given options have been acknowledged: the value of
+// the blksize option if present and valid, or DefaultBlockSize otherwise
+func NegotiatedBlockSize(options []Option) int {
+	value, ok := findOption(options, OptionBlockSize)
+	if !ok {
+		return DefaultBlockSize
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < minBlockSize || n > maxBlockSize {
+		return DefaultBlockSize
+	}
+	return n
+}
+
+// parseRollover parses the value of the rollover option
+func parseRollover(value string) (BlockRollover, bool) {
+	switch value {
+	case "0":
+		return RolloverToZero, true
+	case "1":
+		return RolloverToOne, true
+	}
+	return 0, false
+}
+
+// optionRange returns the range of values allowed for the given option, if known
+func optionRange(name string) (min, max int64, ok bool) {
+	switch name {
+	case OptionBlockSize:
+		return minBlockSize, maxBlockSize, true
+	case OptionTimeout:
+		return 1, 255, true
+	case OptionTransferSize:
+		return 0, math.MaxInt64, true
+	case OptionWindowSize:
+		return 1, maxWindowSize, true
+	case OptionRollover:
+		return 0, 1, true
+	case OptionResumeOffset:
+		return 0, math.MaxInt64, true
+	}
+	return 0, 0, false
+}
+
+// validateOption checks that the value of an option about to be requested is within the range allowed for it
+func validateOption(option Option) error {
+	min, max, ok := optionRange(option.Name)
+	if !ok {
+		return nil
+	}
+	if n, err := strconv.ParseInt(option.Value, 10, 64); err != nil || n < min || n > max {
+		return fmt.Errorf("%w: %s option must be an integer between %d and %d", ErrInvalidConfig, option.Name, min, max)
+	}
+	return nil
+}
+
+// findOption returns the value of the named option
+func findOption(options []Option, name string) (string, bool) {
+	for _, option := range options {
+		if option.Name == name {
+			return option.Value, true
+		}
+	}
+	return "", false
+}
+
+// accept applies the options acknowledged by the server to the session. Every acknowledged option must have been
+// requested, and its value must be an acceptable response to the requested one. As per RFC 2347, the server may leave
+// out requested options it doesn't support, in which case their default values remain in effect
+func (s *session) accept(requested, acknowledged []Option) error {
+	resume := int64(0)
+	for _, option := range acknowledged {
+		value, ok := findOption(requested, option.Name)
+		if !ok {
+			return fmt.Errorf("%w: %s was not requested", ErrInvalidOACK, option.Name)
+		}
+		want, _ := strconv.ParseInt(value, 10, 64)
+		got, err := strconv.ParseInt(option.Value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid %s %q", ErrInvalidOACK, option.Name, option.Value)
+		}
+
+		valid := true
+		switch option.Name {
+		case OptionBlockSize:
+			// The server may choose a smaller block size than requested
+			valid = got >= minBlockSize && got <= want
+			s.blockSize = int(got)
+		case OptionWindowSize:
+			// The server may choose a smaller window than requested
+			valid = got >= 1 && got <= want
+			s.windowSize = int(got)
+		case OptionTimeout:
+			valid = got == want
+			s.timeout = time.Duration(got) * time.Second
+		case OptionTransferSize:
+			valid = got >= 0
+		case OptionResumeOffset:
+			// The server must resume from the requested offset. Blocks are numbered accordingly once the block size
+			// is known
+			valid = got == want
+			resume = got
+		case OptionRollover:
+			s.rollover, valid = parseRollover(option.Value)
+		}
+		if !valid {
+			return fmt.Errorf("%w: invalid %s %q", ErrInvalidOACK, option.Name, option.Value)
+		}
+	}
+	if resume%int64(s.blockSize) != 0 {
+		return fmt.Errorf("%w: %s %d is not a multiple of the block size", ErrInvalidOACK, OptionResumeOffset, resume)
+	}
+	s.firstBlock = s.blockAfter(resume / int64(s.blockSize))
+	s.options = acknowledged
+	return nil
+}
+
+// awaitOACK waits for the server to reply to a request. If the server acknowledges the requested options, they are
+// applied to the session and true is returned. Otherwise, the server's reply is left to be received by the transfer,
+// which goes on with the default values. OACKs sent in reply to requests carrying no options are refused
+func (s *session) awaitOACK(requested []Option) (bool, error) {
+	acknowledged := false
+	err := s.await(func(p Packet) (bool, error) {
+		switch p := p.(type) {
+		case *OACKPacket:
+			acknowledged = true
+			if len(requested) == 0 {
+				return false, s.abort(fmt.Errorf("%w: no options were requested", ErrInvalidOACK))
+			}
+			if err := s.accept(requested, p.Options); err != nil {
+				return false, s.abort(err)
+			}
+			s.oack = true
+		case *DATAPacket, *ACKPacket:
+			s.queued = p
+		default:
+			return false, s.abort(fmt.Errorf("%w: expected OACK", ErrUnexpectedPacket))
+		}
+		return true, nil
+	})
+	return acknowledged, err
+}
@@ -0,0 +1,755 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeHandler serves streams whose size can't be known in advance
+type pipeHandler struct {
+	data []byte
+}
+
+func (h pipeHandler) ReadFile(context.Context, *Request) (io.ReadCloser, error) {
+	r, w := io.Pipe()
+	go func() {
+		_, _ = w.Write(h.data)
+		_ = w.Close()
+	}()
+	return r, nil
+}
+
+func (h pipeHandler) WriteFile(context.Context, *Request) (io.WriteCloser, error) {
+	return nil, ErrorCodeAccessViolation
+}
+
+func TestTransferSizeOption(t *testing.T) {
+	t.Run("Size of files is reported on read requests", func(t *testing.T) {
+		data := bytes.Repeat([]byte("X"), 1000)
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": data}))
+
+		p := newTestPeer(t, addr)
+		p.send(&RRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{Name: "tsize", Value: "0"}}})
+		oack, ok := p.receive().(*OACKPacket)
+		if !ok {
+			t.Fatalf("got %#v want an OACK packet", oack)
+		}
+		want := []Option{{Name: "tsize", Value: "1000"}}
+		if !reflect.DeepEqual(oack.Options, want) {
+			t.Fatalf("got %v want %v", oack.Options, want)
+		}
+
+		p.send(&ACKPacket{BlockNumber: 0})
+		dp, ok := p.receive().(*DATAPacket)
+		if !ok || dp.BlockNumber != 1 {
+			t.Fatalf("got %#v want DATA block 1", dp)
+		}
+	})
+
+	t.Run("Size of files read in netascii mode accounts for line endings being expanded", func(t *testing.T) {
+		text := "first line\nsecond line\rthird line\n"
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.txt": []byte(text)}))
+
+		p := newTestPeer(t, addr)
+		p.send(&RRQPacket{Filename: "file.txt", Mode: ModeNETASCII, Options: []Option{{Name: "tsize", Value: "0"}}})
+		oack, ok := p.receive().(*OACKPacket)
+		if !ok {
+			t.Fatalf("got %#v want an OACK packet", oack)
+		}
+		want := "first line\r\nsecond line\r\x00third line\r\n"
+		if size := []Option{{Name: "tsize", Value: strconv.Itoa(len(want))}}; !reflect.DeepEqual(oack.Options, size) {
+			t.Fatalf("got %v want %v", oack.Options, size)
+		}
+
+		// The file is sent from the start once scanned
+		p.send(&ACKPacket{BlockNumber: 0})
+		dp, ok := p.receive().(*DATAPacket)
+		if !ok || dp.BlockNumber != 1 || string(dp.Data) != want {
+			t.Fatalf("got %#v want DATA block 1 with %q", dp, want)
+		}
+		p.send(&ACKPacket{BlockNumber: 1})
+	})
+
+	t.Run("Size of streams of unknown length is not reported", func(t *testing.T) {
+		addr := startTestServer(t, pipeHandler{data: []byte("streamed")})
+
+		p := newTestPeer(t, addr)
+		p.send(&RRQPacket{Filename: "stream", Mode: ModeOctet, Options: []Option{{Name: "tsize", Value: "0"}}})
+
+		// With no options left to acknowledge, the server must skip the OACK and start sending data right away
+		dp, ok := p.receive().(*DATAPacket)
+		if !ok {
+			t.Fatalf("got %#v want a DATA packet", dp)
+		}
+		if dp.BlockNumber != 1 || string(dp.Data) != "streamed" {
+			t.Fatalf("got block %v with %q want block 1 with %q", dp.BlockNumber, dp.Data, "streamed")
+		}
+		p.send(&ACKPacket{BlockNumber: 1})
+	})
+
+	t.Run("Declared size is acknowledged on write requests", func(t *testing.T) {
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		addr := startTestServer(t, h)
+
+		p := newTestPeer(t, addr)
+		p.send(&WRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{Name: "tsize", Value: "5"}}})
+		oack, ok := p.receive().(*OACKPacket)
+		if !ok {
+			t.Fatalf("got %#v want an OACK packet", oack)
+		}
+		want := []Option{{Name: "tsize", Value: "5"}}
+		if !reflect.DeepEqual(oack.Options, want) {
+			t.Fatalf("got %v want %v", oack.Options, want)
+		}
+
+		p.send(&DATAPacket{BlockNumber: 1, Data: []byte("hello")})
+		if ack, ok := p.receive().(*ACKPacket); !ok || ack.BlockNumber != 1 {
+			t.Fatalf("got %#v want ACK block 1", ack)
+		}
+	})
+}
+
+// sizeConn records the size of the datagrams sent through a connection
+type sizeConn struct {
+	net.PacketConn
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (c *sizeConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	c.sizes = append(c.sizes, len(b))
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestBlockSizeOption(t *testing.T) {
+	const clamped = 1428
+
+	t.Run("Block sizes larger than the server allows are clamped in the OACK", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": []byte("hello")}),
+			WithMaxServerBlockSize(clamped))
+		p := newTestPeer(t, addr)
+		p.send(&RRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{Name: "blksize", Value: "65464"}}})
+
+		oack, ok := p.receive().(*OACKPacket)
+		if !ok {
+			t.Fatal("got an unexpected packet want an OACK")
+		}
+		if want := []Option{{Name: "blksize", Value: "1428"}}; !reflect.DeepEqual(oack.Options, want) {
+			t.Fatalf("got %v want %v", oack.Options, want)
+		}
+		p.send(&ERRORPacket{ErrorCode: ErrorCodeOptionRefused})
+	})
+
+	t.Run("Requested block sizes within the server's limit are agreed to", func(t *testing.T) {
+		sess := newSession(nil, nil, defaultTransferConfig())
+		sess.maxBlockSize = clamped
+		oack := sess.negotiate([]Option{{Name: "blksize", Value: "1024"}}, nil)
+		if want := []Option{{Name: "blksize", Value: "1024"}}; !reflect.DeepEqual(oack, want) {
+			t.Fatalf("got %v want %v", oack, want)
+		}
+		if sess.blockSize != 1024 {
+			t.Fatalf("got block size %v want %v", sess.blockSize, 1024)
+		}
+	})
+
+	t.Run("DATA packets larger than the negotiated block size abort the transfer", func(t *testing.T) {
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		p := newTestPeer(t, startTestServer(t, h))
+		p.send(&WRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{Name: "blksize", Value: "1024"}}})
+		if oack, ok := p.receive().(*OACKPacket); !ok || !reflect.DeepEqual(oack.Options, []Option{{"blksize", "1024"}}) {
+			t.Fatalf("got %#v want an OACK with blksize 1024", oack)
+		}
+
+		p.send(sessionDATA{&DATAPacket{BlockNumber: 1, Data: make([]byte, 2000)}, 2000})
+		if pkt, ok := p.receive().(*ERRORPacket); !ok || pkt.ErrorCode != ErrorCodeIllegalOp {
+			t.Fatalf("got %#v want ERROR %v", pkt, ErrorCodeIllegalOp)
+		}
+		if _, err := h.ReadFile(context.Background(), &Request{Filename: "file.bin"}); err != ErrorCodeFileNotFound {
+			t.Fatalf("got %v want the upload to be discarded", err)
+		}
+	})
+
+	t.Run("DATA packets of the largest block size fit in a UDP datagram", func(t *testing.T) {
+		buf := bytes.Buffer{}
+		p := sessionDATA{&DATAPacket{BlockNumber: 1, Data: make([]byte, maxBlockSize)}, maxBlockSize}
+		if err := p.Marshal(&buf); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if buf.Len() != 65468 {
+			t.Fatalf("got %v bytes want %v", buf.Len(), 65468)
+		}
+		if buf.Len() > maxUDPPayloadSize {
+			t.Fatalf("got %v bytes want at most %v", buf.Len(), maxUDPPayloadSize)
+		}
+	})
+
+	t.Run("Files are transferred with the largest block size", func(t *testing.T) {
+		want := bytes.Repeat([]byte("M"), maxBlockSize+100)
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": want}))
+		got := bytes.Buffer{}
+		c := newTestClient(t, WithBlockSize(maxBlockSize))
+		tr, err := c.Download(context.Background(), addr.String(), "file.bin", ModeOctet, &got)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+		if tr.BlockSize() != maxBlockSize {
+			t.Fatalf("got block size %v want %v", tr.BlockSize(), maxBlockSize)
+		}
+	})
+
+	t.Run("Block sizes implying datagrams larger than UDP allows are never used", func(t *testing.T) {
+		size := maxUDPPayloadSize - 4 + 1
+		if _, err := NewClient(WithBlockSize(size)); !errors.Is(err, ErrInvalidConfig) {
+			t.Fatalf("got %v want %v", err, ErrInvalidConfig)
+		}
+		if got := NegotiatedBlockSize([]Option{{Name: "blksize", Value: strconv.Itoa(size)}}); got != DefaultBlockSize {
+			t.Fatalf("got %v want %v", got, DefaultBlockSize)
+		}
+		sess := newSession(nil, nil, defaultTransferConfig())
+		oack := sess.negotiate([]Option{{Name: "blksize", Value: strconv.Itoa(size)}}, nil)
+		if want := []Option{{Name: "blksize", Value: "65464"}}; !reflect.DeepEqual(oack, want) {
+			t.Fatalf("got %v want %v", oack, want)
+		}
+		p := sessionDATA{&DATAPacket{BlockNumber: 1, Data: make([]byte, maxBlockSize+1)}, maxBlockSize}
+		if err := p.Marshal(io.Discard); err == nil {
+			t.Fatal("wanted an error but didn't get one")
+		}
+	})
+
+	t.Run("Clients honor block sizes clamped by the server", func(t *testing.T) {
+		want := bytes.Repeat([]byte("M"), 2*clamped+144)
+		conns := make(chan *sizeConn, 1)
+		listen := func(local net.Addr) (net.PacketConn, error) {
+			conn, err := listenUDP(local)
+			if err != nil {
+				return nil, err
+			}
+			sized := &sizeConn{PacketConn: conn}
+			conns <- sized
+			return sized, nil
+		}
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": want}),
+			WithMaxServerBlockSize(clamped), WithListenFunc(listen))
+
+		got := bytes.Buffer{}
+		c := newTestClient(t, WithBlockSize(maxBlockSize))
+		tr, err := c.Download(context.Background(), addr.String(), "file.bin", ModeOctet, &got)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+		if tr.BlockSize() != clamped {
+			t.Fatalf("got block size %v want %v", tr.BlockSize(), clamped)
+		}
+
+		conn := <-conns
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		// The OACK is followed by the blocks, each preceded by a 4-byte header
+		if sizes := []int{4 + clamped, 4 + clamped, 4 + 144}; !reflect.DeepEqual(conn.sizes[1:], sizes) {
+			t.Fatalf("got datagrams of %v bytes want %v after the OACK", conn.sizes, sizes)
+		}
+	})
+}
+
+func TestRolloverOption(t *testing.T) {
+	tests := []struct {
+		value    string
+		accepted bool
+		want     uint16
+	}{
+		{"0", true, 0},
+		{"1", true, 1},
+		{"2", false, 0},
+	}
+	for _, test := range tests {
+		t.Run("Rollover "+test.value, func(t *testing.T) {
+			sess := newSession(nil, nil, defaultTransferConfig())
+			oack := sess.negotiate([]Option{{Name: "rollover", Value: test.value}}, nil)
+			if got := len(oack) == 1; got != test.accepted {
+				t.Fatalf("got accepted %v want %v", got, test.accepted)
+			}
+			if got := sess.nextBlock(65535); got != test.want {
+				t.Fatalf("got block %v after 65535 want %v", got, test.want)
+			}
+			if got := sess.nextBlock(41); got != 42 {
+				t.Fatalf("got block %v after 41 want %v", got, 42)
+			}
+		})
+	}
+
+	t.Run("Negotiated rollover overrides the configured policy", func(t *testing.T) {
+		sess := newSession(nil, nil, transferConfig{rollover: RolloverToOne})
+		sess.negotiate([]Option{{Name: "rollover", Value: "0"}}, nil)
+		if got := sess.nextBlock(65535); got != 0 {
+			t.Fatalf("got block %v after 65535 want %v", got, 0)
+		}
+	})
+
+	t.Run("DATA packets for block 0 are accepted after rolling over", func(t *testing.T) {
+		sess := newSession(nil, nil, defaultTransferConfig())
+		buf := bytes.Buffer{}
+		if err := (sessionDATA{&DATAPacket{BlockNumber: 0, Data: []byte("wrapped")}, sess.blockSize}).Marshal(&buf); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		p, err := sess.parse(buf.Bytes())
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if dp, ok := p.(*DATAPacket); !ok || dp.BlockNumber != 0 || string(dp.Data) != "wrapped" {
+			t.Fatalf("got %#v want DATA block 0", p)
+		}
+	})
+}
+
+// tracingConn records the packets sent and received through a connection
+type tracingConn struct {
+	net.PacketConn
+	mu    sync.Mutex
+	trace []string
+}
+
+func (c *tracingConn) record(direction string, b []byte) {
+	desc := "malformed"
+	switch p, _ := ParsePacket(b); p := p.(type) {
+	case *OACKPacket:
+		desc = "OACK"
+	case *DATAPacket:
+		desc = fmt.Sprintf("DATA %d", p.BlockNumber)
+	case *ACKPacket:
+		desc = fmt.Sprintf("ACK %d", p.BlockNumber)
+	case *ERRORPacket:
+		desc = fmt.Sprintf("ERROR %d", p.ErrorCode)
+	}
+	c.mu.Lock()
+	c.trace = append(c.trace, direction+" "+desc)
+	c.mu.Unlock()
+}
+
+func (c *tracingConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		c.record("<-", b[:n])
+	}
+	return n, addr, err
+}
+
+func (c *tracingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	// Recorded before sending, so that the packets received by the peer are already part of the trace
+	c.record("->", b)
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestWindowSizeOption(t *testing.T) {
+	t.Run("Windows larger than the server allows are clamped", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			opts      []ServerOption
+			requested string
+			want      string
+		}{
+			{"By default", nil, "65535", strconv.Itoa(DefaultMaxServerWindowSize)},
+			{"Below the configured limit", []ServerOption{WithMaxServerWindowSize(8)}, "16", "8"},
+			{"Within the configured limit", []ServerOption{WithMaxServerWindowSize(8)}, "4", "4"},
+			{"At most to half the block number range", []ServerOption{WithMaxServerWindowSize(65535)}, "65535",
+				strconv.Itoa(DefaultMaxServerWindowSize)},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": []byte("hello")}), test.opts...)
+				p := newTestPeer(t, addr)
+				p.send(&RRQPacket{Filename: "file.bin", Mode: ModeOctet,
+					Options: []Option{{Name: OptionWindowSize, Value: test.requested}}})
+				oack, ok := p.receive().(*OACKPacket)
+				if !ok {
+					t.Fatalf("got %#v want an OACK packet", oack)
+				}
+				if want := []Option{{Name: OptionWindowSize, Value: test.want}}; !reflect.DeepEqual(oack.Options, want) {
+					t.Fatalf("got %v want %v", oack.Options, want)
+				}
+			})
+		}
+	})
+
+	t.Run("Clients honor windows clamped by the server", func(t *testing.T) {
+		want := bytes.Repeat([]byte("W"), 20*DefaultBlockSize+1)
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": want}), WithMaxServerWindowSize(8))
+		got := bytes.Buffer{}
+		tr, err := newTestClient(t, WithWindowSize(maxWindowSize)).Download(context.Background(), addr.String(),
+			"file.bin", ModeOctet, &got)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+		if tr.WindowSize() != 8 {
+			t.Fatalf("got window size %v want %v", tr.WindowSize(), 8)
+		}
+	})
+
+	t.Run("Retransmitted blocks are not taken for blocks ahead in the largest windows", func(t *testing.T) {
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		p := newTestPeer(t, startTestServer(t, h, WithMaxServerWindowSize(maxWindowSize)))
+		p.send(&WRQPacket{Filename: "file.bin", Mode: ModeOctet,
+			Options: []Option{{Name: OptionWindowSize, Value: strconv.Itoa(maxWindowSize)}}})
+		if oack, ok := p.receive().(*OACKPacket); !ok {
+			t.Fatalf("got %#v want an OACK packet", oack)
+		}
+
+		blocks := [][]byte{
+			bytes.Repeat([]byte("1"), DefaultBlockSize),
+			bytes.Repeat([]byte("2"), DefaultBlockSize),
+			bytes.Repeat([]byte("3"), DefaultBlockSize),
+		}
+		for i, data := range blocks {
+			p.send(&DATAPacket{BlockNumber: uint16(i + 1), Data: data})
+		}
+		// A stale copy of block 2 is neither kept for later nor reported as a gap
+		p.send(&DATAPacket{BlockNumber: 2, Data: bytes.Repeat([]byte("X"), DefaultBlockSize)})
+		p.send(&DATAPacket{BlockNumber: 4, Data: []byte("end")})
+		expectACK(t, p, 4)
+
+		if got, want := readMapFile(t, h, "file.bin"), append(bytes.Join(blocks, nil), "end"...); !bytes.Equal(got, want) {
+			t.Fatalf("got %q want %q", got, want)
+		}
+	})
+}
+
+func TestOACKHandshake(t *testing.T) {
+	t.Run("Read requests with options are confirmed with ACK 0 before DATA 1 is sent", func(t *testing.T) {
+		conns := make(chan *tracingConn, 1)
+		listen := func(local net.Addr) (net.PacketConn, error) {
+			conn, err := listenUDP(local)
+			if err != nil {
+				return nil, err
+			}
+			traced := &tracingConn{PacketConn: conn}
+			conns <- traced
+			return traced, nil
+		}
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": []byte("hello")}), WithListenFunc(listen))
+
+		got := bytes.Buffer{}
+		c := newTestClient(t, WithWindowSize(2))
+		if err := c.Get(context.Background(), addr.String(), "file.bin", ModeOctet, &got); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+
+		conn := <-conns
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		want := []string{"-> OACK", "<- ACK 0", "-> DATA 1"}
+		if len(conn.trace) < len(want) || !reflect.DeepEqual(conn.trace[:len(want)], want) {
+			t.Fatalf("got %v want %v", conn.trace, want)
+		}
+	})
+}
+
+func TestSupportedOptions(t *testing.T) {
+	t.Run("Every supported option can be requested and acknowledged", func(t *testing.T) {
+		for _, name := range SupportedOptions() {
+			min, _, ok := optionRange(name)
+			if !ok {
+				t.Fatalf("got no range for %s", name)
+			}
+			option := Option{Name: name, Value: strconv.FormatInt(min, 10)}
+			if err := validateOption(option); err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			sess := newSession(nil, nil, defaultTransferConfig())
+			if err := sess.accept([]Option{option}, []Option{option}); err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+		}
+	})
+
+	t.Run("Exactly the supported options are acknowledged by the server", func(t *testing.T) {
+		requested := []Option{{"unknown", "1"}}
+		for _, name := range SupportedOptions() {
+			min, _, _ := optionRange(name)
+			requested = append(requested, Option{Name: name, Value: strconv.FormatInt(min, 10)})
+		}
+		sess := newSession(nil, nil, defaultTransferConfig())
+		sess.resumable = true
+		var got []string
+		for _, option := range sess.negotiate(requested, bytes.NewReader(nil)) {
+			got = append(got, option.Name)
+		}
+		sort.Strings(got)
+		want := SupportedOptions()
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v acknowledged want %v", got, want)
+		}
+	})
+
+	t.Run("Requested timeouts are used by the server", func(t *testing.T) {
+		tests := []struct {
+			value string
+			want  []Option
+		}{
+			{"1", []Option{{Name: OptionTimeout, Value: "1"}}},
+			{"255", []Option{{Name: OptionTimeout, Value: "255"}}},
+			{"0", nil},
+			{"256", nil},
+			{"1.5", nil},
+		}
+		for _, test := range tests {
+			sess := newSession(nil, nil, defaultTransferConfig())
+			got := sess.negotiate([]Option{{Name: OptionTimeout, Value: test.value}}, nil)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %v want %v", got, test.want)
+			}
+			wantTimeout := DefaultTimeout
+			if test.want != nil {
+				n, _ := strconv.Atoi(test.value)
+				wantTimeout = time.Duration(n) * time.Second
+			}
+			if sess.timeout != wantTimeout {
+				t.Fatalf("got timeout %v want %v", sess.timeout, wantTimeout)
+			}
+		}
+	})
+
+	t.Run("The list can't be modified by callers", func(t *testing.T) {
+		want := SupportedOptions()
+		SupportedOptions()[0] = "unknown"
+		if got := SupportedOptions(); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v want %v", got, want)
+		}
+	})
+}
+
+func TestUnknownOptions(t *testing.T) {
+	rrq := &RRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{"vendorx", "1"}, {"blksize", "1024"}}}
+	buf := bytes.Buffer{}
+	if err := rrq.Marshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Unknown options are kept in parsed requests", func(t *testing.T) {
+		got, err := ParsePacket(buf.Bytes())
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !reflect.DeepEqual(got, rrq) {
+			t.Fatalf("got %#v want %#v", got, rrq)
+		}
+	})
+
+	t.Run("Unknown options are left out of the OACK", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": []byte("data")}))
+		p := newTestPeer(t, addr)
+		p.send(rrq)
+		oack, ok := p.receive().(*OACKPacket)
+		if !ok {
+			t.Fatalf("got %#v want an OACK", oack)
+		}
+		if want := []Option{{"blksize", "1024"}}; !reflect.DeepEqual(oack.Options, want) {
+			t.Fatalf("got %v want %v", oack.Options, want)
+		}
+		p.send(&ACKPacket{BlockNumber: 0})
+		if pkt, ok := p.receive().(*DATAPacket); !ok || string(pkt.Data) != "data" {
+			t.Fatalf("got %#v want DATA 1", pkt)
+		}
+		p.send(&ACKPacket{BlockNumber: 1})
+	})
+}
+
+func TestPathMTU(t *testing.T) {
+	// negotiate requests the largest block size from a server started with the given options
+	negotiate := func(t *testing.T, opts ...ServerOption) []Option {
+		t.Helper()
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": []byte("hello")}), opts...)
+		p := newTestPeer(t, addr)
+		p.send(&RRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{Name: "blksize", Value: "65464"}}})
+		oack, ok := p.receive().(*OACKPacket)
+		if !ok {
+			t.Fatal("got an unexpected packet want an OACK")
+		}
+		p.send(&ERRORPacket{ErrorCode: ErrorCodeOptionRefused})
+		return oack.Options
+	}
+
+	t.Run("Block sizes are capped to fit in the path MTU", func(t *testing.T) {
+		if got, want := negotiate(t, WithPathMTU(1500)), []Option{{"blksize", "1468"}}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v want %v", got, want)
+		}
+	})
+
+	t.Run("The MTU may be looked up per destination", func(t *testing.T) {
+		var peers []net.Addr
+		var mu sync.Mutex
+		lookup := func(peer net.Addr) int {
+			mu.Lock()
+			defer mu.Unlock()
+			peers = append(peers, peer)
+			return 576
+		}
+		if got, want := negotiate(t, WithPathMTUFunc(lookup)), []Option{{"blksize", "544"}}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v want %v", got, want)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(peers) != 1 {
+			t.Fatalf("got %d lookups want 1", len(peers))
+		}
+	})
+
+	t.Run("The lowest of the MTU cap and the maximum block size applies", func(t *testing.T) {
+		got := negotiate(t, WithPathMTU(9000), WithMaxServerBlockSize(1024))
+		if want := []Option{{"blksize", "1024"}}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v want %v", got, want)
+		}
+	})
+
+	t.Run("Unknown MTUs leave block sizes uncapped", func(t *testing.T) {
+		if got, want := negotiate(t, WithPathMTU(0)), []Option{{"blksize", "65464"}}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v want %v", got, want)
+		}
+	})
+
+	t.Run("IPv6 headers are taken into account", func(t *testing.T) {
+		if got := blockSizeForMTU(1500, &net.UDPAddr{IP: net.IPv6loopback}); got != 1448 {
+			t.Fatalf("got %v want %v", got, 1448)
+		}
+		if got := blockSizeForMTU(1500, &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1)}); got != 1468 {
+			t.Fatalf("got %v want %v", got, 1468)
+		}
+	})
+}
+
+func TestCanonicalizeOptions(t *testing.T) {
+	m := map[string]string{
+		"vendorx":    "1",
+		"windowsize": "4",
+		"rollover":   "0",
+		"tsize":      "0",
+		"Timeout":    "5",
+		"blksize":    "1428",
+		"alpha":      "a",
+	}
+	want := []Option{
+		{"blksize", "1428"},
+		{"Timeout", "5"},
+		{"tsize", "0"},
+		{"windowsize", "4"},
+		{"alpha", "a"},
+		{"rollover", "0"},
+		{"vendorx", "1"},
+	}
+
+	t.Run("Options are returned in a stable order", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			if got := CanonicalizeOptions(m); !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v want %v", got, want)
+			}
+		}
+	})
+
+	t.Run("Options which can't be sent are left out", func(t *testing.T) {
+		got := CanonicalizeOptions(map[string]string{"": "1", "blksize": "1024", "näme": "1", "name": "välue"})
+		if want := []Option{{"blksize", "1024"}}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v want %v", got, want)
+		}
+	})
+
+	t.Run("No options are returned for empty maps", func(t *testing.T) {
+		if got := CanonicalizeOptions(nil); len(got) != 0 {
+			t.Fatalf("got %v want no options", got)
+		}
+	})
+}
+
+func TestFileSize(t *testing.T) {
+	data := []byte("header|payload")
+	readHeader := func(t *testing.T, r io.Reader) {
+		t.Helper()
+		if _, err := io.ReadFull(r, make([]byte, len("header|"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := int64(len("payload"))
+
+	t.Run("Partially read readers report the data left", func(t *testing.T) {
+		for _, r := range []io.Reader{bytes.NewReader(data), strings.NewReader(string(data)), bytes.NewBuffer(data),
+			io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data)))} {
+			readHeader(t, r)
+			if got, ok := fileSize(r); !ok || got != want {
+				t.Fatalf("got %d, %v for %T want %d", got, ok, r, want)
+			}
+		}
+	})
+
+	t.Run("Partially read files report the data left", func(t *testing.T) {
+		f, err := os.Create(filepath.Join(t.TempDir(), "file.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		readHeader(t, f)
+		if got, ok := fileSize(f); !ok || got != want {
+			t.Fatalf("got %d, %v want %d", got, ok, want)
+		}
+	})
+
+	t.Run("Uploads of partially read readers declare the data left", func(t *testing.T) {
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			wrq, ok := p.receive().(*WRQPacket)
+			if !ok {
+				t.Errorf("got %#v want a WRQ", wrq)
+				return
+			}
+			if value, _ := findOption(wrq.Options, OptionTransferSize); value != strconv.FormatInt(want, 10) {
+				t.Errorf("got tsize %q want %d", value, want)
+			}
+			p.send(&ACKPacket{BlockNumber: 0})
+			if pkt, ok := p.receive().(*DATAPacket); !ok || string(pkt.Data) != "payload" {
+				t.Errorf("got %#v want DATA 1 with the payload", pkt)
+				return
+			}
+			p.send(&ACKPacket{BlockNumber: 1})
+		}()
+
+		r := bytes.NewReader(data)
+		readHeader(t, r)
+		if err := newTestClient(t).Put(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet,
+			r); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		<-done
+	})
+}
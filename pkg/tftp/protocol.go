@@ -2,18 +2,26 @@ package tftp
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
 	"unicode"
 )
 
 var (
 	ErrInputNotNETASCII   = errors.New("input is not valid NETASCII")
 	ErrInvalidBlockNumber = errors.New("block number is not valid")
-	ErrTooMuchData        = errors.New("data packet contains more than 512 bytes")
+	ErrTooMuchData        = errors.New("data packet contains more data than fits in a block")
 	ErrMismatchingOpcode  = errors.New("attempting to unmarshal a packet with mismatching opcode")
+	ErrUnknownOpcode      = errors.New("packet has an unknown opcode")
+	ErrTruncatedPacket    = errors.New("packet is missing required fields")
+	ErrTrailingBytes      = errors.New("packet has trailing bytes after its last field")
+	ErrNilWriter          = errors.New("can't marshal a packet to a nil writer")
+	ErrUnknownMode        = errors.New("unknown transfer mode")
 )
 
 // IOError type encapsulates I/O errors when marshalling or unmarshalling binary packets
@@ -29,6 +37,11 @@ func (err IOError) Error() string {
 	return err.Msg
 }
 
+// Unwrap returns the original error
+func (err IOError) Unwrap() error {
+	return err.Err
+}
+
 func NewIOError(msg string, err error) IOError {
 	return IOError{
 		Msg: msg,
@@ -36,6 +49,24 @@ func NewIOError(msg string, err error) IOError {
 	}
 }
 
+// ProtocolError type represents an error carried by an ERROR packet, either received from or sent to the peer
+type ProtocolError struct {
+	Code ErrorCode // Error code
+	Msg  string    // Error message
+}
+
+func (err ProtocolError) Error() string {
+	if err.Msg != "" {
+		return fmt.Sprintf("%s: %s", err.Code.Error(), err.Msg)
+	}
+	return err.Code.Error()
+}
+
+// Unwrap returns the error code, so that errors.Is can be used to match protocol errors against an ErrorCode
+func (err ProtocolError) Unwrap() error {
+	return err.Code
+}
+
 // Mode type represents a mode, as defined in the TFTP protocol
 type Mode string
 
@@ -44,18 +75,55 @@ const (
 	ModeOctet    = "octet"
 )
 
+// NeedsConversion reports whether files transferred in this mode must be translated into NETASCII, which is the case
+// for netascii regardless of case
+func (m Mode) NeedsConversion() bool {
+	return strings.EqualFold(string(m), ModeNETASCII)
+}
+
+// String returns the mode as is, or a quoted description if it contains characters which are not printable
+func (m Mode) String() string {
+	for i := 0; i < len(m); i++ {
+		if m[i] < 0x20 || m[i] > 0x7e {
+			return fmt.Sprintf("unknown(%q)", string(m))
+		}
+	}
+	return string(m)
+}
+
+// ParseMode returns the mode named by s regardless of case, which must be either netascii or octet. Other modes, such
+// as the obsolete mail mode, are rejected with ErrUnknownMode
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(strings.ToLower(s)); mode {
+	case ModeNETASCII, ModeOctet:
+		return mode, nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrUnknownMode, Mode(s))
+}
+
 // Opcode type represents a TFTP opcode
 type Opcode uint16
 
 // RRQ is the opcode for the RRQ (Read Request) packet
 const RRQ Opcode = 1
 
+// Option represents a request option, as defined in RFC 2347
+type Option struct {
+	// Option name. This should only contain NETASCII characters. Since option names are case-insensitive, received
+	// ones are converted to lower case
+	Name string
+	// Option value. This should only contain NETASCII characters
+	Value string
+}
+
 // RRQPacket represents a Read Request packet
 type RRQPacket struct {
 	// Destination filename. This should only contain NETASCII characters
 	Filename string
 	// File mode
 	Mode Mode
+	// Requested options, if any
+	Options []Option
 }
 
 // WRQ is the opcode for the WRQ (Write Request) packet
@@ -67,20 +135,37 @@ type WRQPacket struct {
 	Filename string
 	// File mode
 	Mode Mode
+	// Requested options, if any
+	Options []Option
 }
 
 // DATA is the opcode for the DATA (Data) packet
 const DATA Opcode = 3
 
+// DefaultBlockSize is the size of the data carried by every DATA packet but the last one, unless another block size
+// is negotiated with the blksize option
+const DefaultBlockSize = 512
+
+// MaxDataSize is the maximum length of the data carried by a DATA packet, unless a larger block size is negotiated
+// with the blksize option
+const MaxDataSize = DefaultBlockSize
+
 // DATAPacket represents a data packet
 type DATAPacket struct {
 	// Block number, starting from 1
 	BlockNumber uint16
-	// Data being transferred within this packet, with a maximum length of 512.
-	// If the length of this field is between 0 and 511, the transfer is considered complete
+	// Data being transferred within this packet, with a maximum length of 512 unless a larger block size is negotiated.
+	// If the length of this field is less than the block size, the transfer is considered complete
 	Data []byte
 }
 
+// BlockCount returns the number of DATA packets needed to transfer size bytes in blocks of blockSize bytes. Since a
+// transfer ends with the first block shorter than blockSize, files whose size is a multiple of blockSize take an
+// extra empty block
+func BlockCount(size int64, blockSize int) int64 {
+	return size/int64(blockSize) + 1
+}
+
 // ACK is the opcode for the ACK (Acknowledgement) packet
 const ACK Opcode = 4
 
@@ -107,6 +192,7 @@ const (
 	ErrorCodeUnknownTransferID ErrorCode = 5
 	ErrorCodeFileAlreadyExists ErrorCode = 6
 	ErrorCodeNoSuchUser        ErrorCode = 7
+	ErrorCodeOptionRefused     ErrorCode = 8
 )
 
 func (e ErrorCode) Error() string {
@@ -127,10 +213,33 @@ func (e ErrorCode) Error() string {
 		return "file already exists"
 	case ErrorCodeNoSuchUser:
 		return "no such user"
+	case ErrorCodeOptionRefused:
+		return "option negotiation refused"
 	}
 	return "unknown error"
 }
 
+// Errors matching protocol errors with the corresponding code, so that errors reported by the peer can be told apart
+// with errors.Is
+var (
+	ErrFileNotFound      error = ErrorCodeFileNotFound
+	ErrAccessViolation   error = ErrorCodeAccessViolation
+	ErrDiskFull          error = ErrorCodeDiskFull
+	ErrIllegalOperation  error = ErrorCodeIllegalOp
+	ErrUnknownTransferID error = ErrorCodeUnknownTransferID
+	ErrFileAlreadyExists error = ErrorCodeFileAlreadyExists
+	ErrNoSuchUser        error = ErrorCodeNoSuchUser
+	ErrOptionRefused     error = ErrorCodeOptionRefused
+)
+
+// ErrorCodeFromPacket returns the error code carried by p, if it is an ERROR packet
+func ErrorCodeFromPacket(p Packet) (ErrorCode, bool) {
+	if p, ok := p.(*ERRORPacket); ok {
+		return p.ErrorCode, true
+	}
+	return 0, false
+}
+
 // ERRORPacket represents an Error packet.
 // ERROR packets are sent when to acknowledge any kind of packet which results in an unsuccessful outcome.
 type ERRORPacket struct {
@@ -140,10 +249,173 @@ type ERRORPacket struct {
 	ErrorMsg string
 }
 
+// OACK is the opcode for the OACK (Option Acknowledgement) packet, as defined in RFC 2347
+const OACK Opcode = 6
+
+// OACKPacket represents an Option Acknowledgement packet.
+// OACK packets are sent by the server in response to a request carrying options, and contain the subset of those
+// options the server accepted.
+type OACKPacket struct {
+	// Accepted options
+	Options []Option
+}
+
+// IsRequest reports whether op is the opcode of a request starting a transfer, i.e. RRQ or WRQ
+func IsRequest(op Opcode) bool {
+	return op == RRQ || op == WRQ
+}
+
+// MinSize returns the size of the smallest well-formed packet with the given opcode, so that datagrams too short to
+// hold one can be rejected without being parsed. For unknown opcodes, only the opcode itself is accounted for
+func MinSize(op Opcode) int {
+	switch op {
+	case RRQ, WRQ:
+		// Opcode and NUL-terminated filename and mode
+		return 4
+	case DATA, ACK:
+		// Opcode and block number
+		return 4
+	case ERROR:
+		// Opcode, error code and NUL-terminated message
+		return 5
+	}
+	return 2
+}
+
 type Packet interface {
 	Marshal(w io.Writer) error
 }
 
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[Opcode]func() Packet)
+)
+
+// RegisterPacket makes ParsePacket unmarshal datagrams with the given extension opcode into packets created by
+// factory. The packets must implement Unmarshal(r io.Reader) error, like the ones defined by the protocol.
+// RegisterPacket panics if op is one of the opcodes defined by the protocol or has already been registered
+func RegisterPacket(op Opcode, factory func() Packet) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if op >= RRQ && op <= OACK {
+		panic(fmt.Sprintf("tftp: can't register reserved opcode %d", op))
+	}
+	if factory == nil {
+		panic("tftp: nil packet factory")
+	}
+	if _, ok := registry[op]; ok {
+		panic(fmt.Sprintf("tftp: opcode %d registered twice", op))
+	}
+	registry[op] = factory
+}
+
+// registeredPacket returns a new packet for the given extension opcode, if any has been registered
+func registeredPacket(op Opcode) (Packet, bool) {
+	registryMu.RLock()
+	factory, ok := registry[op]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	return factory(), true
+}
+
+// ClonePacket returns a deep copy of p, which is not affected by later changes to p such as the reuse of its data
+// buffer. Packets of types other than the ones defined by this package are returned as they are
+func ClonePacket(p Packet) Packet {
+	switch p := p.(type) {
+	case *RRQPacket:
+		c := *p
+		c.Options = cloneOptions(p.Options)
+		return &c
+	case *WRQPacket:
+		c := *p
+		c.Options = cloneOptions(p.Options)
+		return &c
+	case *DATAPacket:
+		c := *p
+		if p.Data != nil {
+			c.Data = append([]byte{}, p.Data...)
+		}
+		return &c
+	case *ACKPacket:
+		c := *p
+		return &c
+	case *ERRORPacket:
+		c := *p
+		return &c
+	case *OACKPacket:
+		c := *p
+		c.Options = cloneOptions(p.Options)
+		return &c
+	}
+	return p
+}
+
+// cloneOptions returns a copy of options
+func cloneOptions(options []Option) []Option {
+	if options == nil {
+		return nil
+	}
+	return append([]Option{}, options...)
+}
+
+// ParsePacket unmarshals a datagram into the packet type corresponding to its opcode. Extension opcodes are looked up
+// among the ones registered with RegisterPacket
+func ParsePacket(b []byte) (Packet, error) {
+	if len(b) < 2 || len(b) < MinSize(Opcode(binary.BigEndian.Uint16(b))) {
+		return nil, ErrTruncatedPacket
+	}
+
+	var p interface {
+		Packet
+		UnmarshalBytes(b []byte) error
+	}
+	switch Opcode(binary.BigEndian.Uint16(b)) {
+	case RRQ:
+		p = &RRQPacket{}
+	case WRQ:
+		p = &WRQPacket{}
+	case DATA:
+		p = &DATAPacket{}
+	case ACK:
+		p = &ACKPacket{}
+	case ERROR:
+		p = &ERRORPacket{}
+	case OACK:
+		p = &OACKPacket{}
+	default:
+		return parseRegisteredPacket(b)
+	}
+
+	if err := p.UnmarshalBytes(b); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseRegisteredPacket unmarshals a datagram with an extension opcode
+func parseRegisteredPacket(b []byte) (Packet, error) {
+	p, ok := registeredPacket(Opcode(binary.BigEndian.Uint16(b)))
+	if !ok {
+		return nil, ErrUnknownOpcode
+	}
+	switch u := p.(type) {
+	case interface{ UnmarshalBytes(b []byte) error }:
+		if err := u.UnmarshalBytes(b); err != nil {
+			return nil, err
+		}
+	case interface{ Unmarshal(r io.Reader) error }:
+		if err := u.Unmarshal(bytes.NewReader(b)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnknownOpcode
+	}
+	return p, nil
+}
+
 func isNETASCII(s string) bool {
 	for i := 0; i < len(s); i++ {
 		if s[i] == 0 || s[i] > unicode.MaxASCII {
@@ -153,22 +425,189 @@ func isNETASCII(s string) bool {
 	return true
 }
 
-func expectOpcode(r io.Reader, expected Opcode) (err error) {
+func expectOpcode(r io.Reader, expected Opcode) error {
 	var opcode Opcode
-	if err = binary.Read(r, binary.BigEndian, &opcode); err == nil && opcode != expected {
-		err = ErrMismatchingOpcode
+	if err := binary.Read(r, binary.BigEndian, &opcode); err != nil {
+		return readError("can't read opcode", err)
 	}
+	if opcode != expected {
+		return ErrMismatchingOpcode
+	}
+	return nil
+}
+
+// readError wraps an error returned while reading a packet field. Running out of input means that the packet is
+// truncated, which is reported as ErrTruncatedPacket
+func readError(msg string, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncatedPacket
+	}
+	return NewIOError(msg, err)
+}
+
+// expectOpcodeBytes behaves like expectOpcode, returning the remainder of b following the opcode
+func expectOpcodeBytes(b []byte, expected Opcode) ([]byte, error) {
+	if len(b) < 2 {
+		return nil, ErrTruncatedPacket
+	}
+	if Opcode(binary.BigEndian.Uint16(b)) != expected {
+		return nil, ErrMismatchingOpcode
+	}
+	return b[2:], nil
+}
+
+// isFilename reports whether s may be carried as a filename. Filenames must be NETASCII unless allowNonNETASCII is
+// true, and can never contain NUL bytes, which terminate them
+func isFilename(s string, allowNonNETASCII bool) bool {
+	if allowNonNETASCII {
+		return strings.IndexByte(s, 0) < 0
+	}
+	return isNETASCII(s)
+}
+
+// cutFilename behaves like cutString, but only requires the string to be NETASCII unless allowNonNETASCII is true
+func cutFilename(b []byte, allowNonNETASCII bool) (string, []byte, error) {
+	if !allowNonNETASCII {
+		return cutString(b)
+	}
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return "", nil, ErrTruncatedPacket
+	}
+	return string(b[:i]), b[i+1:], nil
+}
+
+// cutString splits b at the first NUL byte, returning the NETASCII string preceding it and the remainder of b
+// following it
+func cutString(b []byte) (string, []byte, error) {
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return "", nil, ErrTruncatedPacket
+	}
+	s := string(b[:i])
+	if !isNETASCII(s) {
+		return "", nil, ErrInputNotNETASCII
+	}
+	return s, b[i+1:], nil
+}
+
+func marshalOptions(w io.Writer, options []Option) error {
+	for _, option := range options {
+		// Check encoding
+		if !isNETASCII(option.Name) || !isNETASCII(option.Value) {
+			return ErrInputNotNETASCII
+		}
+
+		// Write option name
+		if _, err := w.Write([]byte(option.Name)); err != nil {
+			return NewIOError("can't write option name", err)
+		}
+		if _, err := w.Write([]byte{0}); err != nil {
+			return NewIOError("can't write option name NUL terminator", err)
+		}
+
+		// Write option value
+		if _, err := w.Write([]byte(option.Value)); err != nil {
+			return NewIOError("can't write option value", err)
+		}
+		if _, err := w.Write([]byte{0}); err != nil {
+			return NewIOError("can't write option value NUL terminator", err)
+		}
+	}
+	return nil
+}
+
+func unmarshalOptions(reader *bufio.Reader) ([]Option, error) {
+	var options []Option
+	for {
+		// Read option name
+		name, err := reader.ReadString('\x00')
+		if err == io.EOF && name == "" {
+			// No more options
+			return options, nil
+		}
+		if err != nil {
+			return nil, readError("can't read option name", err)
+		}
+		name = name[:len(name)-1]
+		if !isNETASCII(name) {
+			return nil, ErrInputNotNETASCII
+		}
+
+		// Read option value
+		value, err := reader.ReadString('\x00')
+		if err != nil {
+			return nil, readError("can't read option value", err)
+		}
+		value = value[:len(value)-1]
+		if !isNETASCII(value) {
+			return nil, ErrInputNotNETASCII
+		}
+
+		options = append(options, Option{Name: strings.ToLower(name), Value: value})
+	}
+}
+
+func unmarshalOptionsBytes(b []byte) ([]Option, error) {
+	var options []Option
+	for len(b) > 0 {
+		name, rest, err := cutString(b)
+		if err != nil {
+			return nil, err
+		}
+		value, rest, err := cutString(rest)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, Option{Name: strings.ToLower(name), Value: value})
+		b = rest
+	}
+	return options, nil
+}
+
+// unmarshalRequestBytes parses the fields following the opcode of RRQ and WRQ packets. Unless allowNonNETASCII is
+// true, filenames must be NETASCII
+func unmarshalRequestBytes(b []byte, allowNonNETASCII bool) (filename string, mode Mode, options []Option, err error) {
+	filename, b, err = cutFilename(b, allowNonNETASCII)
+	if err != nil {
+		return
+	}
+	if filename == "" {
+		err = ErrTruncatedPacket
+		return
+	}
+
+	var m string
+	if m, b, err = cutString(b); err != nil {
+		return
+	}
+	if m == "" {
+		err = ErrTruncatedPacket
+		return
+	}
+	mode = Mode(m)
+
+	options, err = unmarshalOptionsBytes(b)
 	return
 }
 
 func (p *RRQPacket) Marshal(w io.Writer) error {
+	return p.marshal(w, false)
+}
+
+// marshal writes the packet to w. Unless allowNonNETASCII is true, the filename must be NETASCII
+func (p *RRQPacket) marshal(w io.Writer, allowNonNETASCII bool) error {
+	if w == nil {
+		return ErrNilWriter
+	}
+
 	// Write opcode
 	if err := binary.Write(w, binary.BigEndian, RRQ); err != nil {
 		return NewIOError("can't write opcode", err)
 	}
 
 	// Check encoding
-	if !isNETASCII(p.Filename) || !isNETASCII(string(p.Mode)) {
+	if !isFilename(p.Filename, allowNonNETASCII) || !isNETASCII(string(p.Mode)) {
 		return ErrInputNotNETASCII
 	}
 
@@ -188,7 +627,8 @@ func (p *RRQPacket) Marshal(w io.Writer) error {
 		return NewIOError("can't write mode NUL terminator", err)
 	}
 
-	return nil
+	// Write options
+	return marshalOptions(w, p.Options)
 }
 
 func (p *RRQPacket) Unmarshal(r io.Reader) error {
@@ -200,37 +640,88 @@ func (p *RRQPacket) Unmarshal(r io.Reader) error {
 
 	// Read filename
 	filename, err := reader.ReadString('\x00')
+	if err == io.EOF {
+		return ErrTruncatedPacket
+	}
 	if err != nil {
 		return NewIOError("can't read filename", err)
 	}
 	filename = filename[:len(filename)-1]
+	if filename == "" {
+		return ErrTruncatedPacket
+	}
 	if !isNETASCII(filename) {
 		return ErrInputNotNETASCII
 	}
 
 	// Read mode
 	mode, err := reader.ReadString('\x00')
+	if err == io.EOF {
+		return ErrTruncatedPacket
+	}
 	if err != nil {
 		return NewIOError("can't read mode", err)
 	}
 	mode = mode[:len(mode)-1]
+	if mode == "" {
+		return ErrTruncatedPacket
+	}
 	if !isNETASCII(mode) {
 		return ErrInputNotNETASCII
 	}
 
+	// Read options
+	options, err := unmarshalOptions(reader)
+	if err != nil {
+		return err
+	}
+
 	p.Filename = filename
 	p.Mode = Mode(mode)
+	p.Options = options
+	return nil
+}
+
+// UnmarshalBytes behaves like Unmarshal, but parses the packet from a byte slice such as a datagram
+func (p *RRQPacket) UnmarshalBytes(b []byte) error {
+	return p.unmarshalBytes(b, false)
+}
+
+// unmarshalBytes parses the packet from b. Unless allowNonNETASCII is true, the filename must be NETASCII
+func (p *RRQPacket) unmarshalBytes(b []byte, allowNonNETASCII bool) error {
+	b, err := expectOpcodeBytes(b, RRQ)
+	if err != nil {
+		return err
+	}
+
+	filename, mode, options, err := unmarshalRequestBytes(b, allowNonNETASCII)
+	if err != nil {
+		return err
+	}
+
+	p.Filename = filename
+	p.Mode = mode
+	p.Options = options
 	return nil
 }
 
 func (p *WRQPacket) Marshal(w io.Writer) error {
+	return p.marshal(w, false)
+}
+
+// marshal writes the packet to w. Unless allowNonNETASCII is true, the filename must be NETASCII
+func (p *WRQPacket) marshal(w io.Writer, allowNonNETASCII bool) error {
+	if w == nil {
+		return ErrNilWriter
+	}
+
 	// Write opcode
 	if err := binary.Write(w, binary.BigEndian, WRQ); err != nil {
 		return NewIOError("can't write opcode", err)
 	}
 
 	// Check encoding
-	if !isNETASCII(p.Filename) || !isNETASCII(string(p.Mode)) {
+	if !isFilename(p.Filename, allowNonNETASCII) || !isNETASCII(string(p.Mode)) {
 		return ErrInputNotNETASCII
 	}
 
@@ -250,7 +741,8 @@ func (p *WRQPacket) Marshal(w io.Writer) error {
 		return NewIOError("can't write mode NUL terminator", err)
 	}
 
-	return nil
+	// Write options
+	return marshalOptions(w, p.Options)
 }
 
 func (p *WRQPacket) Unmarshal(r io.Reader) error {
@@ -262,36 +754,88 @@ func (p *WRQPacket) Unmarshal(r io.Reader) error {
 
 	// Read filename
 	filename, err := reader.ReadString('\x00')
+	if err == io.EOF {
+		return ErrTruncatedPacket
+	}
 	if err != nil {
 		return NewIOError("can't read filename", err)
 	}
 	filename = filename[:len(filename)-1]
+	if filename == "" {
+		return ErrTruncatedPacket
+	}
 	if !isNETASCII(filename) {
 		return ErrInputNotNETASCII
 	}
 
 	// Read mode
 	mode, err := reader.ReadString('\x00')
+	if err == io.EOF {
+		return ErrTruncatedPacket
+	}
 	if err != nil {
 		return NewIOError("can't read mode", err)
 	}
 	mode = mode[:len(mode)-1]
+	if mode == "" {
+		return ErrTruncatedPacket
+	}
 	if !isNETASCII(mode) {
 		return ErrInputNotNETASCII
 	}
 
+	// Read options
+	options, err := unmarshalOptions(reader)
+	if err != nil {
+		return err
+	}
+
 	p.Filename = filename
 	p.Mode = Mode(mode)
+	p.Options = options
+	return nil
+}
+
+// UnmarshalBytes behaves like Unmarshal, but parses the packet from a byte slice such as a datagram
+func (p *WRQPacket) UnmarshalBytes(b []byte) error {
+	return p.unmarshalBytes(b, false)
+}
+
+// unmarshalBytes parses the packet from b. Unless allowNonNETASCII is true, the filename must be NETASCII
+func (p *WRQPacket) unmarshalBytes(b []byte, allowNonNETASCII bool) error {
+	b, err := expectOpcodeBytes(b, WRQ)
+	if err != nil {
+		return err
+	}
+
+	filename, mode, options, err := unmarshalRequestBytes(b, allowNonNETASCII)
+	if err != nil {
+		return err
+	}
+
+	p.Filename = filename
+	p.Mode = mode
+	p.Options = options
 	return nil
 }
 
 func (p *DATAPacket) Marshal(w io.Writer) error {
+	return p.marshal(w, false, MaxDataSize)
+}
+
+// marshal writes the packet to w. Unless rolledOver is true, block number 0 is rejected, since it's only valid after
+// block numbers roll over on transfers larger than 65535 blocks. Packets carrying more than maxSize bytes are rejected
+func (p *DATAPacket) marshal(w io.Writer, rolledOver bool, maxSize int) error {
+	if w == nil {
+		return ErrNilWriter
+	}
+
 	// Write opcode
 	if err := binary.Write(w, binary.BigEndian, DATA); err != nil {
 		return NewIOError("can't write opcode", err)
 	}
 
-	if p.BlockNumber == 0 {
+	if p.BlockNumber == 0 && !rolledOver {
 		// Block numbers start from one and increment by one
 		return ErrInvalidBlockNumber
 	}
@@ -301,8 +845,8 @@ func (p *DATAPacket) Marshal(w io.Writer) error {
 		return NewIOError("can't write block number", err)
 	}
 
-	if len(p.Data) > 512 {
-		// Data packets can't carry more than 512 bytes
+	if len(p.Data) > maxSize {
+		// Data packets can't carry more than a block
 		return ErrTooMuchData
 	}
 
@@ -315,6 +859,11 @@ func (p *DATAPacket) Marshal(w io.Writer) error {
 }
 
 func (p *DATAPacket) Unmarshal(r io.Reader) error {
+	return p.unmarshal(r, false)
+}
+
+// unmarshal reads the packet from r. Unless rolledOver is true, block number 0 is rejected
+func (p *DATAPacket) unmarshal(r io.Reader, rolledOver bool) error {
 	if err := expectOpcode(r, DATA); err != nil {
 		return err
 	}
@@ -322,24 +871,126 @@ func (p *DATAPacket) Unmarshal(r io.Reader) error {
 	// Read block number
 	var blockNumber uint16
 	if err := binary.Read(r, binary.BigEndian, &blockNumber); err != nil {
-		return NewIOError("can't read block number", err)
+		return readError("can't read block number", err)
 	}
 
-	if blockNumber == 0 {
+	if blockNumber == 0 && !rolledOver {
 		return ErrInvalidBlockNumber
 	}
 
-	buf, err := io.ReadAll(r)
+	// Read one byte past the limit to tell oversized packets apart without reading them whole
+	buf, err := io.ReadAll(io.LimitReader(r, MaxDataSize+1))
 	if err != nil {
 		return NewIOError("can't read data", err)
 	}
+	if len(buf) > MaxDataSize {
+		return ErrTooMuchData
+	}
 
 	p.Data = buf
 	p.BlockNumber = blockNumber
 	return nil
 }
 
+// UnmarshalBytes behaves like Unmarshal, but parses the packet from a byte slice such as a datagram. The data is
+// copied, so b may be reused afterwards
+func (p *DATAPacket) UnmarshalBytes(b []byte) error {
+	return p.unmarshalBytes(b, false, MaxDataSize)
+}
+
+// unmarshalBytes parses the packet from b. Unless rolledOver is true, block number 0 is rejected. Packets carrying more
+// than maxSize bytes are rejected
+func (p *DATAPacket) unmarshalBytes(b []byte, rolledOver bool, maxSize int) error {
+	if err := p.unmarshalView(b, rolledOver, maxSize); err != nil {
+		return err
+	}
+	p.Data = append([]byte(nil), p.Data...)
+	return nil
+}
+
+// UnmarshalView parses a DATA packet from a byte slice such as a datagram, like UnmarshalBytes does, but without
+// copying the data: the Data field of the returned packet refers to the same memory as b. It's only valid until b is
+// modified or reused, such as by receiving the next datagram into it, and must be copied to be kept any longer
+func UnmarshalView(b []byte) (*DATAPacket, error) {
+	p := &DATAPacket{}
+	if err := p.unmarshalView(b, false, MaxDataSize); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// unmarshalView behaves like unmarshalBytes, but the data of the packet refers to b rather than being copied
+func (p *DATAPacket) unmarshalView(b []byte, rolledOver bool, maxSize int) error {
+	b, err := expectOpcodeBytes(b, DATA)
+	if err != nil {
+		return err
+	}
+
+	if len(b) < 2 {
+		return ErrTruncatedPacket
+	}
+	blockNumber := binary.BigEndian.Uint16(b)
+	if blockNumber == 0 && !rolledOver {
+		return ErrInvalidBlockNumber
+	}
+
+	if len(b)-2 > maxSize {
+		return ErrTooMuchData
+	}
+
+	// Appending to the data must not overwrite whatever follows it in b
+	p.Data = b[2:len(b):len(b)]
+	p.BlockNumber = blockNumber
+	return nil
+}
+
+// Reset clears the packet so that it can be reused, keeping the capacity of the data buffer
+func (p *DATAPacket) Reset() {
+	p.BlockNumber = 0
+	p.Data = p.Data[:0]
+}
+
+// UnmarshalInto behaves like Unmarshal, but appends the data read to the existing Data slice instead of allocating a
+// new one. Together with Reset, this allows DATA packets to be pooled and reused without reallocating their buffers.
+// The contents of the packet are unspecified if an error is returned
+func (p *DATAPacket) UnmarshalInto(r io.Reader) error {
+	if err := expectOpcode(r, DATA); err != nil {
+		return err
+	}
+
+	// Read block number
+	if err := binary.Read(r, binary.BigEndian, &p.BlockNumber); err != nil {
+		return readError("can't read block number", err)
+	}
+
+	if p.BlockNumber == 0 {
+		return ErrInvalidBlockNumber
+	}
+
+	// Read data, growing the buffer only when it's full
+	for start := len(p.Data); ; {
+		if len(p.Data) == cap(p.Data) {
+			p.Data = append(p.Data, 0)[:len(p.Data)]
+		}
+		n, err := r.Read(p.Data[len(p.Data):cap(p.Data)])
+		p.Data = p.Data[:len(p.Data)+n]
+		if len(p.Data)-start > MaxDataSize {
+			return ErrTooMuchData
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return NewIOError("can't read data", err)
+		}
+	}
+}
+
 func (p *ACKPacket) Marshal(w io.Writer) error {
+	if w == nil {
+		return ErrNilWriter
+	}
+
 	// Write opcode
 	if err := binary.Write(w, binary.BigEndian, ACK); err != nil {
 		return NewIOError("can't write opcode", err)
@@ -361,13 +1012,35 @@ func (p *ACKPacket) Unmarshal(r io.Reader) error {
 	// Read block number
 	// We do not perform any checks here because a block number of 0 is legal on ACKs
 	if err := binary.Read(r, binary.BigEndian, &p.BlockNumber); err != nil {
-		return NewIOError("can't read block number", err)
+		return readError("can't read block number", err)
 	}
 
 	return nil
 }
 
+// UnmarshalBytes behaves like Unmarshal, but parses the packet from a byte slice such as a datagram
+func (p *ACKPacket) UnmarshalBytes(b []byte) error {
+	b, err := expectOpcodeBytes(b, ACK)
+	if err != nil {
+		return err
+	}
+
+	if len(b) < 2 {
+		return ErrTruncatedPacket
+	}
+	if len(b) > 2 {
+		// ACK packets have a fixed length
+		return ErrTrailingBytes
+	}
+	p.BlockNumber = binary.BigEndian.Uint16(b)
+	return nil
+}
+
 func (p *ERRORPacket) Marshal(w io.Writer) error {
+	if w == nil {
+		return ErrNilWriter
+	}
+
 	// Write opcode
 	if err := binary.Write(w, binary.BigEndian, ERROR); err != nil {
 		return NewIOError("can't write opcode", err)
@@ -403,14 +1076,14 @@ func (p *ERRORPacket) Unmarshal(r io.Reader) error {
 	// Read error code
 	var errorCode ErrorCode
 	if err := binary.Read(r, binary.BigEndian, &errorCode); err != nil {
-		return NewIOError("can't read error code", err)
+		return readError("can't read error code", err)
 	}
 
 	// Read error message
 	reader := bufio.NewReader(r)
 	errorMsg, err := reader.ReadString('\x00')
 	if err != nil {
-		return NewIOError("can't read error message", err)
+		return readError("can't read error message", err)
 	}
 	errorMsg = errorMsg[:len(errorMsg)-1]
 	if !isNETASCII(errorMsg) {
@@ -421,3 +1094,85 @@ func (p *ERRORPacket) Unmarshal(r io.Reader) error {
 	p.ErrorMsg = errorMsg
 	return nil
 }
+
+// UnmarshalBytes behaves like Unmarshal, but parses the packet from a byte slice such as a datagram
+func (p *ERRORPacket) UnmarshalBytes(b []byte) error {
+	return p.unmarshalBytes(b, false)
+}
+
+// unmarshalBytes behaves like UnmarshalBytes. If lenient is set, messages lacking the terminating NUL byte, as sent by
+// some noncompliant peers, are accepted as long as they are not empty
+func (p *ERRORPacket) unmarshalBytes(b []byte, lenient bool) error {
+	b, err := expectOpcodeBytes(b, ERROR)
+	if err != nil {
+		return err
+	}
+
+	if len(b) < 2 {
+		return ErrTruncatedPacket
+	}
+	errorCode := ErrorCode(binary.BigEndian.Uint16(b))
+
+	msg := b[2:]
+	if lenient && len(msg) > 0 && bytes.IndexByte(msg, 0) < 0 {
+		msg = append(msg[:len(msg):len(msg)], 0)
+	}
+	errorMsg, _, err := cutString(msg)
+	if err != nil {
+		return err
+	}
+
+	p.ErrorCode = errorCode
+	p.ErrorMsg = errorMsg
+	return nil
+}
+
+func (p *OACKPacket) Marshal(w io.Writer) error {
+	if w == nil {
+		return ErrNilWriter
+	}
+
+	// Write opcode
+	if err := binary.Write(w, binary.BigEndian, OACK); err != nil {
+		return NewIOError("can't write opcode", err)
+	}
+
+	// Write options
+	return marshalOptions(w, p.Options)
+}
+
+func (p *OACKPacket) Unmarshal(r io.Reader) error {
+	if err := expectOpcode(r, OACK); err != nil {
+		return err
+	}
+
+	// Read options
+	options, err := unmarshalOptions(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+
+	p.Options = options
+	return nil
+}
+
+// UnmarshalBytes behaves like Unmarshal, but parses the packet from a byte slice such as a datagram
+func (p *OACKPacket) UnmarshalBytes(b []byte) error {
+	b, err := expectOpcodeBytes(b, OACK)
+	if err != nil {
+		return err
+	}
+
+	options, err := unmarshalOptionsBytes(b)
+	if err != nil {
+		return err
+	}
+
+	p.Options = options
+	return nil
+}
+
+// AsError returns the error reported by the packet as a ProtocolError
+func (p *ERRORPacket) AsError() error {
+	return ProtocolError{Code: p.ErrorCode, Msg: p.ErrorMsg}
+}
@@ -3,6 +3,11 @@ package tftp
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -142,6 +147,36 @@ func TestRRQUnmarshal(t *testing.T) {
 		if err == nil {
 			t.Fatal("wanted an error but didn't get one")
 		}
+		if err != ErrTruncatedPacket {
+			t.Fatalf("got %v want %v", err, ErrTruncatedPacket)
+		}
+	})
+
+	t.Run("RRQ unmarshal with empty filename fails", func(t *testing.T) {
+		buf := bytes.NewBufferString("\x00\x01\x00octet\x00")
+		p := RRQPacket{}
+		err := p.Unmarshal(buf)
+		if err != ErrTruncatedPacket {
+			t.Fatalf("got %v want %v", err, ErrTruncatedPacket)
+		}
+	})
+
+	t.Run("RRQ unmarshal with missing mode fails", func(t *testing.T) {
+		buf := bytes.NewBufferString("\x00\x01file\x00")
+		p := RRQPacket{}
+		err := p.Unmarshal(buf)
+		if err != ErrTruncatedPacket {
+			t.Fatalf("got %v want %v", err, ErrTruncatedPacket)
+		}
+	})
+
+	t.Run("RRQ unmarshal with empty mode fails", func(t *testing.T) {
+		buf := bytes.NewBufferString("\x00\x01file\x00\x00")
+		p := RRQPacket{}
+		err := p.Unmarshal(buf)
+		if err != ErrTruncatedPacket {
+			t.Fatalf("got %v want %v", err, ErrTruncatedPacket)
+		}
 	})
 }
 
@@ -238,12 +273,42 @@ func TestWRQUnmarshal(t *testing.T) {
 	})
 
 	t.Run("WRQ unmarshal with missing fields fails", func(t *testing.T) {
-		buf := bytes.NewBufferString("\x00\x01/hello.txt")
+		buf := bytes.NewBufferString("\x00\x02/hello.txt")
 		p := WRQPacket{}
 		err := p.Unmarshal(buf)
 		if err == nil {
 			t.Fatal("wanted an error but didn't get one")
 		}
+		if err != ErrTruncatedPacket {
+			t.Fatalf("got %v want %v", err, ErrTruncatedPacket)
+		}
+	})
+
+	t.Run("WRQ unmarshal with empty filename fails", func(t *testing.T) {
+		buf := bytes.NewBufferString("\x00\x02\x00octet\x00")
+		p := WRQPacket{}
+		err := p.Unmarshal(buf)
+		if err != ErrTruncatedPacket {
+			t.Fatalf("got %v want %v", err, ErrTruncatedPacket)
+		}
+	})
+
+	t.Run("WRQ unmarshal with missing mode fails", func(t *testing.T) {
+		buf := bytes.NewBufferString("\x00\x02file\x00")
+		p := WRQPacket{}
+		err := p.Unmarshal(buf)
+		if err != ErrTruncatedPacket {
+			t.Fatalf("got %v want %v", err, ErrTruncatedPacket)
+		}
+	})
+
+	t.Run("WRQ unmarshal with empty mode fails", func(t *testing.T) {
+		buf := bytes.NewBufferString("\x00\x02file\x00\x00")
+		p := WRQPacket{}
+		err := p.Unmarshal(buf)
+		if err != ErrTruncatedPacket {
+			t.Fatalf("got %v want %v", err, ErrTruncatedPacket)
+		}
 	})
 }
 
@@ -324,6 +389,31 @@ func TestDATAUnmarshal(t *testing.T) {
 		}
 	})
 
+	t.Run("DATA unmarshal works with 512 bytes of data", func(t *testing.T) {
+		want := bytes.Repeat([]byte("X"), MaxDataSize)
+		p := DATAPacket{}
+		if err := p.Unmarshal(bytes.NewReader(append([]byte("\x00\x03\x00\x01"), want...))); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(p.Data, want) {
+			t.Fatalf("got %d bytes want %d", len(p.Data), len(want))
+		}
+	})
+
+	t.Run("DATA unmarshal fails with more than 512 bytes of data", func(t *testing.T) {
+		b := append([]byte("\x00\x03\x00\x01"), make([]byte, 4096)...)
+		unmarshallers := map[string]func(p *DATAPacket) error{
+			"Unmarshal":      func(p *DATAPacket) error { return p.Unmarshal(bytes.NewReader(b)) },
+			"UnmarshalBytes": func(p *DATAPacket) error { return p.UnmarshalBytes(b) },
+			"UnmarshalInto":  func(p *DATAPacket) error { return p.UnmarshalInto(bytes.NewReader(b)) },
+		}
+		for name, unmarshal := range unmarshallers {
+			if err := unmarshal(&DATAPacket{}); err != ErrTooMuchData {
+				t.Fatalf("got %v want %v from %s", err, ErrTooMuchData, name)
+			}
+		}
+	})
+
 	t.Run("DATA unmarshal fails with block number equal to 0", func(t *testing.T) {
 		buf := bytes.NewBufferString("\x00\x03\x00\x00Hello, world!")
 		p := DATAPacket{}
@@ -335,6 +425,34 @@ func TestDATAUnmarshal(t *testing.T) {
 			t.Fatalf("got %v want %v", err, ErrMismatchingOpcode)
 		}
 	})
+
+	t.Run("DATA views share memory with the datagram", func(t *testing.T) {
+		b := []byte("\x00\x03\x00\x07view")
+		p, err := UnmarshalView(b)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if p.BlockNumber != 7 || string(p.Data) != "view" {
+			t.Fatalf("got %#v want block 7 with %q", p, "view")
+		}
+		if &p.Data[0] != &b[4] {
+			t.Fatal("data was copied from the datagram")
+		}
+
+		// As documented, the view is only valid until the buffer is reused
+		copy(b, "\x00\x03\x00\x08next")
+		if string(p.Data) != "next" {
+			t.Fatalf("got %q want %q", p.Data, "next")
+		}
+	})
+
+	t.Run("DATA views are validated like copies", func(t *testing.T) {
+		for _, b := range []string{"\x00\x03\x00", "\x00\x03\x00\x00data", "\x00\x04\x00\x01"} {
+			if _, err := UnmarshalView([]byte(b)); err == nil {
+				t.Fatalf("wanted an error but didn't get one for %q", b)
+			}
+		}
+	})
 }
 
 func TestACKMarshal(t *testing.T) {
@@ -356,6 +474,12 @@ func TestACKUnmarshal(t *testing.T) {
 			t.Fatalf("got block number %v want %v", p.BlockNumber, 0x3F)
 		}
 	})
+	t.Run("ACK packets with trailing bytes are rejected", func(t *testing.T) {
+		_, err := ParsePacket([]byte("\x00\x04\x00\x3Fblksize\x00512\x00"))
+		if !errors.Is(err, ErrTrailingBytes) {
+			t.Fatalf("got %v want %v", err, ErrTrailingBytes)
+		}
+	})
 }
 
 func TestERRORMarshal(t *testing.T) {
@@ -394,4 +518,665 @@ func TestERRORUnmarshal(t *testing.T) {
 			t.Fatalf("got error message %v want %v", p.ErrorMsg, "my error message")
 		}
 	})
+	t.Run("ERROR packets with an empty message round-trip", func(t *testing.T) {
+		datagram := []byte("\x00\x05\x00\x01\x00")
+		for name, unmarshal := range map[string]func(p *ERRORPacket) error{
+			"Unmarshal":      func(p *ERRORPacket) error { return p.Unmarshal(bytes.NewReader(datagram)) },
+			"UnmarshalBytes": func(p *ERRORPacket) error { return p.UnmarshalBytes(datagram) },
+		} {
+			p := ERRORPacket{ErrorMsg: "stale"}
+			if err := unmarshal(&p); err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			if p.ErrorCode != ErrorCodeFileNotFound || p.ErrorMsg != "" {
+				t.Fatalf("got %#v want error code %v with an empty message from %s", p, ErrorCodeFileNotFound, name)
+			}
+
+			buf := bytes.Buffer{}
+			if err := p.Marshal(&buf); err != nil {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			if !bytes.Equal(buf.Bytes(), datagram) {
+				t.Fatalf("got %q want %q", buf.Bytes(), datagram)
+			}
+		}
+	})
+}
+
+func TestOptionsMarshal(t *testing.T) {
+	t.Run("RRQ marshal works with options", buildMarshalTest(
+		t,
+		&RRQPacket{
+			Filename: "/hello.txt",
+			Mode:     ModeOctet,
+			Options:  []Option{{Name: "tsize", Value: "0"}},
+		},
+		[]byte("\x00\x01/hello.txt\x00octet\x00tsize\x000\x00"),
+	))
+
+	t.Run("WRQ marshal works with options", buildMarshalTest(
+		t,
+		&WRQPacket{
+			Filename: "/hello.txt",
+			Mode:     ModeOctet,
+			Options:  []Option{{Name: "tsize", Value: "1024"}},
+		},
+		[]byte("\x00\x02/hello.txt\x00octet\x00tsize\x001024\x00"),
+	))
+
+	t.Run("OACK marshal works", buildMarshalTest(
+		t,
+		&OACKPacket{Options: []Option{{Name: "tsize", Value: "42"}, {Name: "blksize", Value: "1024"}}},
+		[]byte("\x00\x06tsize\x0042\x00blksize\x001024\x00"),
+	))
+
+	t.Run("Marshal fails with invalid option encoding", func(t *testing.T) {
+		p := OACKPacket{Options: []Option{{Name: "tsize", Value: "ñ"}}}
+		buf := bytes.Buffer{}
+		err := p.Marshal(&buf)
+		if err == nil {
+			t.Fatal("wanted an error but didn't get one")
+		}
+		if err != ErrInputNotNETASCII {
+			t.Fatalf("got %v want %v", err, ErrInputNotNETASCII)
+		}
+	})
+}
+
+func TestNonNETASCIIFilenames(t *testing.T) {
+	t.Run("UTF-8 filenames round-trip when allowed", func(t *testing.T) {
+		want := RRQPacket{Filename: "imágenes/arranque.bin", Mode: ModeOctet}
+		buf := bytes.Buffer{}
+		if err := want.marshal(&buf, true); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		got := RRQPacket{}
+		if err := got.unmarshalBytes(buf.Bytes(), true); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v want %v", got, want)
+		}
+	})
+
+	t.Run("UTF-8 filenames are rejected by default", func(t *testing.T) {
+		p := WRQPacket{Filename: "imágenes/arranque.bin", Mode: ModeOctet}
+		if err := p.Marshal(&bytes.Buffer{}); err != ErrInputNotNETASCII {
+			t.Fatalf("got %v want %v", err, ErrInputNotNETASCII)
+		}
+		if err := p.UnmarshalBytes([]byte("\x00\x02im\xc3\xa1genes\x00octet\x00")); err != ErrInputNotNETASCII {
+			t.Fatalf("got %v want %v", err, ErrInputNotNETASCII)
+		}
+	})
+
+	t.Run("NUL bytes are rejected even when non-NETASCII filenames are allowed", func(t *testing.T) {
+		p := WRQPacket{Filename: "file\x00.bin", Mode: ModeOctet}
+		if err := p.marshal(&bytes.Buffer{}, true); err != ErrInputNotNETASCII {
+			t.Fatalf("got %v want %v", err, ErrInputNotNETASCII)
+		}
+	})
+}
+
+func TestOptionsUnmarshal(t *testing.T) {
+	t.Run("RRQ unmarshal works with options", func(t *testing.T) {
+		buf := bytes.NewBufferString("\x00\x01/hello.txt\x00octet\x00tsize\x000\x00blksize\x001024\x00")
+		p := RRQPacket{}
+		if err := p.Unmarshal(buf); err != nil {
+			t.Fatal("got an error but didn't want one")
+		}
+		want := []Option{{Name: "tsize", Value: "0"}, {Name: "blksize", Value: "1024"}}
+		if !reflect.DeepEqual(p.Options, want) {
+			t.Fatalf("got %v want %v", p.Options, want)
+		}
+	})
+
+	t.Run("WRQ unmarshal works with options", func(t *testing.T) {
+		buf := bytes.NewBufferString("\x00\x02/hello.txt\x00octet\x00tsize\x001024\x00")
+		p := WRQPacket{}
+		if err := p.Unmarshal(buf); err != nil {
+			t.Fatal("got an error but didn't want one")
+		}
+		want := []Option{{Name: "tsize", Value: "1024"}}
+		if !reflect.DeepEqual(p.Options, want) {
+			t.Fatalf("got %v want %v", p.Options, want)
+		}
+	})
+
+	t.Run("OACK unmarshal works", func(t *testing.T) {
+		buf := bytes.NewBufferString("\x00\x06tsize\x0042\x00")
+		p := OACKPacket{}
+		if err := p.Unmarshal(buf); err != nil {
+			t.Fatal("got an error but didn't want one")
+		}
+		want := []Option{{Name: "tsize", Value: "42"}}
+		if !reflect.DeepEqual(p.Options, want) {
+			t.Fatalf("got %v want %v", p.Options, want)
+		}
+	})
+
+	t.Run("Option names are converted to lower case", func(t *testing.T) {
+		datagram := "\x00\x01/hello.txt\x00octet\x00BlkSize\x001024\x00X-Vendor\x00MixedCase\x00"
+		want := []Option{{Name: "blksize", Value: "1024"}, {Name: "x-vendor", Value: "MixedCase"}}
+
+		p := RRQPacket{}
+		if err := p.Unmarshal(bytes.NewBufferString(datagram)); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !reflect.DeepEqual(p.Options, want) {
+			t.Fatalf("got %v want %v", p.Options, want)
+		}
+
+		p = RRQPacket{}
+		if err := p.UnmarshalBytes([]byte(datagram)); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !reflect.DeepEqual(p.Options, want) {
+			t.Fatalf("got %v want %v", p.Options, want)
+		}
+		if value, ok := findOption(p.Options, OptionBlockSize); !ok || value != "1024" {
+			t.Fatalf("got %q want %q", value, "1024")
+		}
+	})
+
+	t.Run("Unmarshal with missing option value fails", func(t *testing.T) {
+		buf := bytes.NewBufferString("\x00\x01/hello.txt\x00octet\x00tsize\x00")
+		p := RRQPacket{}
+		err := p.Unmarshal(buf)
+		if err == nil {
+			t.Fatal("wanted an error but didn't get one")
+		}
+	})
+}
+
+func TestDATAReuse(t *testing.T) {
+	t.Run("DATA reset keeps the data buffer", func(t *testing.T) {
+		p := DATAPacket{BlockNumber: 7, Data: make([]byte, 10, 516)}
+		p.Reset()
+		if p.BlockNumber != 0 {
+			t.Fatalf("got block number %v want %v", p.BlockNumber, 0)
+		}
+		if len(p.Data) != 0 || cap(p.Data) != 516 {
+			t.Fatalf("got len %d cap %d want len 0 cap 516", len(p.Data), cap(p.Data))
+		}
+	})
+
+	t.Run("DATA unmarshal into reuses the data buffer", func(t *testing.T) {
+		buf := make([]byte, 0, 516)
+		p := DATAPacket{Data: buf}
+		if err := p.UnmarshalInto(bytes.NewBufferString("\x00\x03\x00\x02Hello, world!")); err != nil {
+			t.Fatal("got an error but didn't want one")
+		}
+		if p.BlockNumber != 2 {
+			t.Fatalf("got block number %v want %v", p.BlockNumber, 2)
+		}
+		if !bytes.Equal(p.Data, []byte("Hello, world!")) {
+			t.Fatalf("got data %v want %v", p.Data, []byte("Hello, world!"))
+		}
+		if &p.Data[0] != &buf[:1][0] {
+			t.Fatal("data buffer was reallocated")
+		}
+	})
+
+	t.Run("DATA unmarshal into appends to existing data", func(t *testing.T) {
+		p := DATAPacket{Data: []byte("Hello")}
+		if err := p.UnmarshalInto(bytes.NewBufferString("\x00\x03\x00\x01, world!")); err != nil {
+			t.Fatal("got an error but didn't want one")
+		}
+		if !bytes.Equal(p.Data, []byte("Hello, world!")) {
+			t.Fatalf("got data %v want %v", p.Data, []byte("Hello, world!"))
+		}
+	})
+
+	t.Run("DATA unmarshal into fails with block number equal to 0", func(t *testing.T) {
+		p := DATAPacket{}
+		err := p.UnmarshalInto(bytes.NewBufferString("\x00\x03\x00\x00Hello, world!"))
+		if err != ErrInvalidBlockNumber {
+			t.Fatalf("got %v want %v", err, ErrInvalidBlockNumber)
+		}
+	})
+}
+
+func BenchmarkDATAUnmarshalInto(b *testing.B) {
+	datagram := append([]byte("\x00\x03\x00\x01"), bytes.Repeat([]byte("X"), 512)...)
+	pool := sync.Pool{
+		New: func() interface{} {
+			return &DATAPacket{Data: make([]byte, 0, 512)}
+		},
+	}
+
+	b.ReportAllocs()
+	r := bytes.NewReader(nil)
+	for i := 0; i < b.N; i++ {
+		p := pool.Get().(*DATAPacket)
+		p.Reset()
+		r.Reset(datagram)
+		if err := p.UnmarshalInto(r); err != nil {
+			b.Fatal(err)
+		}
+		pool.Put(p)
+	}
+}
+
+func BenchmarkRRQMarshal(b *testing.B) {
+	p := &RRQPacket{
+		Filename: "pxelinux.0",
+		Mode:     ModeOctet,
+		Options:  []Option{{Name: OptionBlockSize, Value: "1428"}, {Name: OptionTransferSize, Value: "0"}},
+	}
+
+	b.ReportAllocs()
+	buf := bytes.Buffer{}
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := p.Marshal(&buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDATAUnmarshal(b *testing.B) {
+	datagram := append([]byte("\x00\x03\x00\x01"), bytes.Repeat([]byte("X"), 512)...)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(datagram)))
+	for i := 0; i < b.N; i++ {
+		p := DATAPacket{}
+		if err := p.UnmarshalBytes(datagram); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestBlockCount(t *testing.T) {
+	tests := []struct {
+		size      int64
+		blockSize int
+		want      int64
+	}{
+		{0, 512, 1},
+		{1, 512, 1},
+		{511, 512, 1},
+		{512, 512, 2},
+		{1000, 512, 2},
+		{1024, 512, 3},
+		{1000, 1024, 1},
+	}
+	for _, test := range tests {
+		if got := BlockCount(test.size, test.blockSize); got != test.want {
+			t.Errorf("got %d want %d for %d bytes in blocks of %d", got, test.want, test.size, test.blockSize)
+		}
+	}
+}
+
+func TestUnmarshalBytes(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		got   interface{ UnmarshalBytes(b []byte) error }
+		want  Packet
+		err   error
+	}{
+		{"RRQ", "\x00\x01/hello.txt\x00octet\x00", &RRQPacket{},
+			&RRQPacket{Filename: "/hello.txt", Mode: ModeOctet}, nil},
+		{"RRQ with options", "\x00\x01/hello.txt\x00octet\x00tsize\x000\x00blksize\x001024\x00", &RRQPacket{},
+			&RRQPacket{Filename: "/hello.txt", Mode: ModeOctet, Options: []Option{{"tsize", "0"}, {"blksize", "1024"}}}, nil},
+		{"RRQ with mismatching opcode", "\x00\x02/hello.txt\x00octet\x00", &RRQPacket{}, nil, ErrMismatchingOpcode},
+		{"RRQ with invalid filename encoding", "\x00\x01/helló.txt\x00octet\x00", &RRQPacket{}, nil, ErrInputNotNETASCII},
+		{"RRQ with invalid mode encoding", "\x00\x01/hello.txt\x00octét\x00", &RRQPacket{}, nil, ErrInputNotNETASCII},
+		{"RRQ with missing fields", "\x00\x01/hello.txt", &RRQPacket{}, nil, ErrTruncatedPacket},
+		{"RRQ with empty filename", "\x00\x01\x00octet\x00", &RRQPacket{}, nil, ErrTruncatedPacket},
+		{"RRQ with missing mode", "\x00\x01file\x00", &RRQPacket{}, nil, ErrTruncatedPacket},
+		{"RRQ with empty mode", "\x00\x01file\x00\x00", &RRQPacket{}, nil, ErrTruncatedPacket},
+		{"RRQ with missing option value", "\x00\x01/hello.txt\x00octet\x00tsize\x00", &RRQPacket{}, nil, ErrTruncatedPacket},
+		{"WRQ", "\x00\x02/hello.txt\x00octet\x00", &WRQPacket{},
+			&WRQPacket{Filename: "/hello.txt", Mode: ModeOctet}, nil},
+		{"WRQ with options", "\x00\x02/hello.txt\x00octet\x00tsize\x001024\x00", &WRQPacket{},
+			&WRQPacket{Filename: "/hello.txt", Mode: ModeOctet, Options: []Option{{"tsize", "1024"}}}, nil},
+		{"WRQ with mismatching opcode", "\x00\x01/hello.txt\x00octet\x00", &WRQPacket{}, nil, ErrMismatchingOpcode},
+		{"WRQ with missing fields", "\x00\x02/hello.txt", &WRQPacket{}, nil, ErrTruncatedPacket},
+		{"DATA", "\x00\x03\x00\x01Hello, world!", &DATAPacket{},
+			&DATAPacket{BlockNumber: 1, Data: []byte("Hello, world!")}, nil},
+		{"DATA with mismatching opcode", "\x00\x04\x00\x01Hello, world!", &DATAPacket{}, nil, ErrMismatchingOpcode},
+		{"DATA with block number equal to 0", "\x00\x03\x00\x00Hello, world!", &DATAPacket{}, nil, ErrInvalidBlockNumber},
+		{"ACK", "\x00\x04\x00\x3F", &ACKPacket{}, &ACKPacket{BlockNumber: 0x3F}, nil},
+		{"ERROR", "\x00\x05\x00\x07my error message\x00", &ERRORPacket{},
+			&ERRORPacket{ErrorCode: ErrorCodeNoSuchUser, ErrorMsg: "my error message"}, nil},
+		{"OACK", "\x00\x06tsize\x0042\x00", &OACKPacket{}, &OACKPacket{Options: []Option{{"tsize", "42"}}}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name+" unmarshal from bytes", func(t *testing.T) {
+			err := test.got.UnmarshalBytes([]byte(test.input))
+			if err != test.err {
+				t.Fatalf("got %v want %v", err, test.err)
+			}
+			if test.want != nil && !reflect.DeepEqual(test.got, test.want) {
+				t.Fatalf("got %#v want %#v", test.got, test.want)
+			}
+		})
+	}
+
+	t.Run("DATA unmarshal from bytes copies the data", func(t *testing.T) {
+		b := []byte("\x00\x03\x00\x01Hello")
+		p := DATAPacket{}
+		if err := p.UnmarshalBytes(b); err != nil {
+			t.Fatal("got an error but didn't want one")
+		}
+		copy(b[4:], "World")
+		if string(p.Data) != "Hello" {
+			t.Fatalf("got %q want %q", p.Data, "Hello")
+		}
+	})
+}
+
+func TestMarshalNilWriter(t *testing.T) {
+	for _, p := range []Packet{&RRQPacket{}, &WRQPacket{}, &DATAPacket{}, &ACKPacket{}, &ERRORPacket{}, &OACKPacket{}} {
+		t.Run(reflect.TypeOf(p).Elem().Name()+".Marshal fails on a nil writer", func(t *testing.T) {
+			if err := p.Marshal(nil); err != ErrNilWriter {
+				t.Fatalf("got %v want %v", err, ErrNilWriter)
+			}
+		})
+	}
+}
+
+func TestUnmarshalShortInput(t *testing.T) {
+	type unmarshaller struct {
+		name      string
+		opcode    Opcode
+		unmarshal func(b []byte) error
+	}
+	var unmarshallers []unmarshaller
+	for _, p := range []interface {
+		Unmarshal(r io.Reader) error
+		UnmarshalBytes(b []byte) error
+	}{&RRQPacket{}, &WRQPacket{}, &DATAPacket{}, &ACKPacket{}, &ERRORPacket{}, &OACKPacket{}} {
+		p := p
+		name := reflect.TypeOf(p).Elem().Name()
+		var opcode Opcode
+		if _, ok := p.(*DATAPacket); ok {
+			opcode = DATA
+		}
+		unmarshallers = append(unmarshallers,
+			unmarshaller{name + ".Unmarshal", opcode, func(b []byte) error { return p.Unmarshal(bytes.NewReader(b)) }},
+			unmarshaller{name + ".UnmarshalBytes", opcode, p.UnmarshalBytes})
+	}
+	unmarshallers = append(unmarshallers,
+		unmarshaller{"DATAPacket.UnmarshalInto", DATA, func(b []byte) error {
+			return (&DATAPacket{}).UnmarshalInto(bytes.NewReader(b))
+		}},
+		unmarshaller{"ParsePacket", DATA, func(b []byte) error {
+			_, err := ParsePacket(b)
+			return err
+		}})
+
+	inputs := []struct {
+		name  string
+		input []byte
+	}{
+		{"empty input", []byte{}},
+		{"one byte", []byte{0x00}},
+		{"DATA header only", []byte{0x00, 0x03}},
+	}
+	for _, u := range unmarshallers {
+		for _, in := range inputs {
+			t.Run(u.name+" fails on "+in.name, func(t *testing.T) {
+				want := ErrTruncatedPacket
+				if len(in.input) == 2 && u.opcode != DATA {
+					want = ErrMismatchingOpcode
+				}
+				if err := u.unmarshal(in.input); err != want {
+					t.Fatalf("got %v want %v", err, want)
+				}
+			})
+		}
+	}
+}
+
+func TestClonePacket(t *testing.T) {
+	t.Run("Clones are not affected by changes to the original DATA", func(t *testing.T) {
+		p := &DATAPacket{BlockNumber: 1, Data: []byte("Hello")}
+		clone := ClonePacket(p).(*DATAPacket)
+		p.BlockNumber = 2
+		p.Data[0] = 'J'
+		if clone.BlockNumber != 1 || string(clone.Data) != "Hello" {
+			t.Fatalf("got block %v with %q want block 1 with %q", clone.BlockNumber, clone.Data, "Hello")
+		}
+	})
+
+	t.Run("Clones are not affected by changes to the original options", func(t *testing.T) {
+		p := &RRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{Name: "tsize", Value: "0"}}}
+		clone := ClonePacket(p).(*RRQPacket)
+		p.Options[0].Value = "1"
+		if clone.Options[0].Value != "0" {
+			t.Fatalf("got %q want %q", clone.Options[0].Value, "0")
+		}
+	})
+
+	t.Run("Clones are equal to the original", func(t *testing.T) {
+		packets := []Packet{
+			&RRQPacket{Filename: "file.bin", Mode: ModeOctet},
+			&WRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{Name: "tsize", Value: "0"}}},
+			&DATAPacket{BlockNumber: 1, Data: []byte("data")},
+			&ACKPacket{BlockNumber: 1},
+			&ERRORPacket{ErrorCode: ErrorCodeDiskFull, ErrorMsg: "full"},
+			&OACKPacket{Options: []Option{{Name: "blksize", Value: "1024"}}},
+		}
+		for _, p := range packets {
+			clone := ClonePacket(p)
+			if clone == p {
+				t.Errorf("got the same %T want a copy", p)
+			}
+			if !reflect.DeepEqual(clone, p) {
+				t.Errorf("got %#v want %#v", clone, p)
+			}
+		}
+	})
+}
+
+func TestMinSize(t *testing.T) {
+	tests := []struct {
+		op   Opcode
+		want int
+	}{
+		{RRQ, 4},
+		{WRQ, 4},
+		{DATA, 4},
+		{ACK, 4},
+		{ERROR, 5},
+		{OACK, 2},
+		{42, 2},
+	}
+	for _, test := range tests {
+		if got := MinSize(test.op); got != test.want {
+			t.Errorf("got %v want %v for opcode %d", got, test.want, test.op)
+		}
+	}
+
+	t.Run("Datagrams shorter than the minimum size are rejected", func(t *testing.T) {
+		for _, b := range []string{"\x00\x01\x00", "\x00\x03\x00", "\x00\x04\x00", "\x00\x05\x00\x01"} {
+			if _, err := ParsePacket([]byte(b)); err != ErrTruncatedPacket {
+				t.Errorf("got %v want %v for %q", err, ErrTruncatedPacket, b)
+			}
+		}
+	})
+
+	t.Run("Datagrams of the minimum size are parsed", func(t *testing.T) {
+		for _, b := range []string{"\x00\x03\x00\x01", "\x00\x04\x00\x01", "\x00\x05\x00\x01\x00", "\x00\x06"} {
+			if _, err := ParsePacket([]byte(b)); err != nil {
+				t.Errorf("got an error but didn't want one: %v for %q", err, b)
+			}
+		}
+	})
+}
+
+func TestIsRequest(t *testing.T) {
+	tests := []struct {
+		op   Opcode
+		want bool
+	}{
+		{RRQ, true},
+		{WRQ, true},
+		{DATA, false},
+		{ACK, false},
+		{ERROR, false},
+		{OACK, false},
+		{0, false},
+		{42, false},
+	}
+	for _, test := range tests {
+		if got := IsRequest(test.op); got != test.want {
+			t.Errorf("got %v want %v for opcode %d", got, test.want, test.op)
+		}
+	}
+}
+
+// pingPacket is an extension packet carrying an arbitrary payload
+type pingPacket struct {
+	Payload string
+}
+
+const pingOpcode Opcode = 7
+
+func (p *pingPacket) Marshal(w io.Writer) error {
+	_, err := w.Write(append([]byte{0, byte(pingOpcode)}, p.Payload...))
+	return err
+}
+
+func (p *pingPacket) Unmarshal(r io.Reader) error {
+	if err := expectOpcode(r, pingOpcode); err != nil {
+		return err
+	}
+	payload, err := io.ReadAll(r)
+	p.Payload = string(payload)
+	return err
+}
+
+func TestRegisterPacket(t *testing.T) {
+	t.Run("Registered extension packets are parsed", func(t *testing.T) {
+		if _, err := ParsePacket([]byte("\x00\x07ping")); err != ErrUnknownOpcode {
+			t.Fatalf("got %v want %v", err, ErrUnknownOpcode)
+		}
+
+		RegisterPacket(pingOpcode, func() Packet { return &pingPacket{} })
+		t.Cleanup(func() {
+			registryMu.Lock()
+			delete(registry, pingOpcode)
+			registryMu.Unlock()
+		})
+
+		p, err := ParsePacket([]byte("\x00\x07ping"))
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if p, ok := p.(*pingPacket); !ok || p.Payload != "ping" {
+			t.Fatalf("got %#v want a ping packet", p)
+		}
+	})
+
+	t.Run("Reserved opcodes can't be registered", func(t *testing.T) {
+		for op := RRQ; op <= OACK; op++ {
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Errorf("registering opcode %d didn't panic", op)
+					}
+				}()
+				RegisterPacket(op, func() Packet { return &pingPacket{} })
+			}()
+		}
+	})
+}
+
+func TestErrorSentinels(t *testing.T) {
+	sentinels := map[ErrorCode]error{
+		ErrorCodeFileNotFound:      ErrFileNotFound,
+		ErrorCodeAccessViolation:   ErrAccessViolation,
+		ErrorCodeDiskFull:          ErrDiskFull,
+		ErrorCodeIllegalOp:         ErrIllegalOperation,
+		ErrorCodeUnknownTransferID: ErrUnknownTransferID,
+		ErrorCodeFileAlreadyExists: ErrFileAlreadyExists,
+		ErrorCodeNoSuchUser:        ErrNoSuchUser,
+		ErrorCodeOptionRefused:     ErrOptionRefused,
+	}
+	for code := range sentinels {
+		code := code
+		t.Run("Protocol errors match the sentinel for "+code.Error(), func(t *testing.T) {
+			err := fmt.Errorf("transfer failed: %w", (&ERRORPacket{ErrorCode: code, ErrorMsg: "oops"}).AsError())
+			for other, otherSentinel := range sentinels {
+				if got := errors.Is(err, otherSentinel); got != (other == code) {
+					t.Fatalf("got %v want %v matching %v", got, other == code, otherSentinel)
+				}
+			}
+		})
+	}
+
+	t.Run("Error codes are read from ERROR packets only", func(t *testing.T) {
+		if code, ok := ErrorCodeFromPacket(&ERRORPacket{ErrorCode: ErrorCodeDiskFull}); !ok || code != ErrorCodeDiskFull {
+			t.Fatalf("got %v %v want %v", code, ok, ErrorCodeDiskFull)
+		}
+		if _, ok := ErrorCodeFromPacket(&ACKPacket{}); ok {
+			t.Fatal("got an error code from an ACK packet")
+		}
+	})
+}
+
+func TestModeNeedsConversion(t *testing.T) {
+	tests := []struct {
+		mode Mode
+		want bool
+	}{
+		{"netascii", true},
+		{"NETASCII", true},
+		{"NetAscii", true},
+		{"octet", false},
+		{"mail", false},
+	}
+	for _, test := range tests {
+		if got := test.mode.NeedsConversion(); got != test.want {
+			t.Errorf("got %v want %v for %q", got, test.want, test.mode)
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want Mode
+		err  bool
+	}{
+		{"Modes are parsed", "octet", ModeOctet, false},
+		{"Modes are parsed regardless of case", "OCTET", ModeOctet, false},
+		{"NETASCII is parsed", "NetAscii", ModeNETASCII, false},
+		{"Unknown modes are rejected", "binary", "", true},
+		{"The obsolete mail mode is rejected", "mail", "", true},
+		{"Empty modes are rejected", "", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseMode(test.s)
+			if test.err != errors.Is(err, ErrUnknownMode) {
+				t.Fatalf("got error %v want %v", err, ErrUnknownMode)
+			}
+			if got != test.want {
+				t.Fatalf("got %q want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestModeString(t *testing.T) {
+	tests := []struct {
+		mode Mode
+		want string
+	}{
+		{ModeOctet, "octet"},
+		{"NETASCII", "NETASCII"},
+		{"oct\x00et", `unknown("oct\x00et")`},
+		{"\xe9", `unknown("\xe9")`},
+	}
+	for _, test := range tests {
+		if got := test.mode.String(); got != test.want {
+			t.Errorf("got %q want %q", got, test.want)
+		}
+	}
 }
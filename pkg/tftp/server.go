@@ -0,0 +1,910 @@
+package tftp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrServerClosed is returned by the Server's ListenAndServe method after a call to Close
+	ErrServerClosed = errors.New("server closed")
+	// ErrNoConn is returned by Run on servers which were not created with a connection to serve from
+	ErrNoConn = errors.New("server has no connection to serve from")
+	// ErrHandlerTimeout is reported to clients whose requests the handler doesn't answer within the handler timeout
+	ErrHandlerTimeout = errors.New("handler timed out")
+	// ErrNilStream is reported to clients whose requests the handler answers with neither a stream nor an error
+	ErrNilStream = errors.New("handler returned no stream")
+	// ErrTIDRangeExhausted is returned when no socket can be bound to any of the ports transfer IDs are allocated from
+	ErrTIDRangeExhausted = errors.New("no transfer ID left in range")
+	// ErrReadOnly is reported to clients sending write requests to a read-only server
+	ErrReadOnly = ProtocolError{Code: ErrorCodeAccessViolation, Msg: "server is read-only"}
+	// ErrClientNotAllowed is reported to clients which are not in the allowlist of the server
+	ErrClientNotAllowed = ProtocolError{Code: ErrorCodeAccessViolation, Msg: "client not allowed"}
+	// ErrFileTooLarge is reported to clients uploading files larger than allowed by WithMaxFileSize
+	ErrFileTooLarge = ProtocolError{Code: ErrorCodeDiskFull, Msg: "file exceeds the maximum size"}
+)
+
+// ServerOption type configures optional parameters of a Server
+type ServerOption interface {
+	applyServer(s *Server)
+}
+
+type serverOptionFunc func(s *Server)
+
+func (f serverOptionFunc) applyServer(s *Server) {
+	f(s)
+}
+
+// ListenFunc type creates the socket a transfer is carried out from. Since the port of this socket is the server's
+// transfer ID, every call must return a socket bound to a different address. local is the address of the socket which
+// received the request
+type ListenFunc func(local net.Addr) (net.PacketConn, error)
+
+// WithListenFunc sets the function creating the sockets transfers are carried out from. By default, UDP sockets are
+// bound to the IP address requests are received on and to a port chosen by the system
+func WithListenFunc(listen ListenFunc) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.listen = listen
+	})
+}
+
+// WithTIDRange makes transfers be carried out from ports between low and high, both included, so that the server can
+// be reached through firewalls which only let a narrow range of UDP ports through. The first port available is used,
+// and requests received while every port in the range is in use are refused as if the server were busy. Invalid
+// ranges are ignored. This option replaces the ListenFunc set by WithListenFunc, and vice versa
+func WithTIDRange(low, high int) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		if low > 0 && low <= high && high <= math.MaxUint16 {
+			s.listen = listenUDPRange(low, high)
+		}
+	})
+}
+
+// WithHandlerTimeout limits the time the handler is given to open or create a file. The context passed to the handler
+// expires after d, and requests it doesn't answer in time are refused with ErrHandlerTimeout. Streams returned
+// afterwards are closed right away, so they must not depend on the context. By default, there is no limit
+func WithHandlerTimeout(d time.Duration) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.handlerTimeout = d
+	})
+}
+
+// DefaultBusyMessage is the message of the ERROR packet sent to clients whose requests can't be served because the
+// server has run out of resources
+const DefaultBusyMessage = "server busy"
+
+// WithBusyMessage sets the message of the ERROR packet sent to clients whose requests can't be served because the
+// server has run out of resources, such as when no transfer ID can be allocated. Messages which are not NETASCII are
+// ignored, and DefaultBusyMessage is used instead
+func WithBusyMessage(msg string) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		if isNETASCII(msg) {
+			s.busyMessage = msg
+		}
+	})
+}
+
+// WithDallyTimeout sets the time a transfer lingers once an upload is complete, acknowledging the final block again
+// should the client retransmit it because the acknowledgement was lost. By default, DefaultDallyTimeout is used. A
+// zero value disables dallying
+func WithDallyTimeout(d time.Duration) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.dallyTimeout = d
+	})
+}
+
+// WithChecksum makes the server compute a checksum of every file transferred successfully by means of the hash
+// returned by newHash, and report it to onComplete along with the filename passed to the handler, which is the
+// rewritten one if filenames are rewritten. The checksum covers the data as
+// transferred, and is computed as blocks are sent or received. This allows an out-of-band system to verify transfers,
+// since TFTP offers no integrity checks of its own
+func WithChecksum(newHash func() hash.Hash, onComplete func(filename string, sum []byte)) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.newHash = newHash
+		s.onComplete = onComplete
+	})
+}
+
+// DefaultMaxServerBlockSize is the largest block size the server agrees to by default, which is the largest one
+// allowed by RFC 2348
+const DefaultMaxServerBlockSize = maxBlockSize
+
+// WithMaxServerBlockSize sets the largest block size the server agrees to. Clients requesting larger blocks by means
+// of the blksize option are offered this size instead, which is useful to keep DATA packets from exceeding the MTU of
+// the network. Sizes outside the range allowed by RFC 2348 are ignored, and DefaultMaxServerBlockSize is used instead
+func WithMaxServerBlockSize(size int) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		if size >= minBlockSize && size <= maxBlockSize {
+			s.maxBlockSize = size
+		}
+	})
+}
+
+// DefaultMaxServerWindowSize is the largest window the server agrees to by default. Every block of a window is kept
+// until it is acknowledged, so the memory a transfer takes grows with its window
+const DefaultMaxServerWindowSize = 64
+
+// WithMaxServerWindowSize sets the largest window the server agrees to. Clients requesting larger windows by means of
+// the windowsize option are offered this size instead. Sizes outside the range of 1 to 32767 blocks are ignored, and
+// DefaultMaxServerWindowSize is used instead
+func WithMaxServerWindowSize(size int) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		if size >= 1 && size <= maxWindowSize {
+			s.maxWindowSize = size
+		}
+	})
+}
+
+// PathMTUFunc type returns the MTU of the path to peer, or 0 if it's unknown
+type PathMTUFunc func(peer net.Addr) int
+
+// WithPathMTU caps the block size agreed to so that DATA packets sent over a path with the given MTU are not
+// fragmented. For instance, on paths with an MTU of 1500 bytes, block sizes are capped to 1468 bytes for IPv4 peers
+// and to 1448 bytes for IPv6 peers. MTUs which are not positive are ignored
+func WithPathMTU(mtu int) ServerOption {
+	return WithPathMTUFunc(func(net.Addr) int {
+		return mtu
+	})
+}
+
+// WithPathMTUFunc behaves like WithPathMTU, but calls fn with the address of the client whenever a transfer starts, so
+// that the MTU may be discovered or looked up per destination. Returning 0 leaves the block size uncapped
+func WithPathMTUFunc(fn PathMTUFunc) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.pathMTU = fn
+	})
+}
+
+// blockSizeForMTU returns the largest block size of the DATA packets which fit in a datagram sent to peer over a path
+// with the given MTU, taking the IP, UDP and TFTP headers into account
+func blockSizeForMTU(mtu int, peer net.Addr) int {
+	header := 20 + 8 + 4
+	if addr, ok := peer.(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		header += 20
+	}
+	return mtu - header
+}
+
+// WithBandwidthLimit limits the aggregate throughput of the DATA packets sent by all transfers to bytesPerSecond,
+// pacing them so that the server doesn't starve other services sharing the network. Up to a second worth of data may
+// be sent in a burst. By default, or if bytesPerSecond is not positive, there is no limit
+func WithBandwidthLimit(bytesPerSecond int64) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.bandwidthLimit = bytesPerSecond
+	})
+}
+
+// WithMaxFileSize limits the size of the files uploaded to the server to size bytes. Clients declaring a larger size
+// by means of the tsize option are refused before the handler is called and any data is sent, and other uploads are
+// aborted as soon as they exceed the limit. Either way, ErrFileTooLarge is reported to the client. By default, or if
+// size is not positive, there is no limit
+func WithMaxFileSize(size int64) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.maxFileSize = size
+	})
+}
+
+// WithErrorHandler sets a function called with the error every failed transfer ends with, along with the address of
+// the client. Errors occurring while tearing the transfer down, such as those closing the file, are joined to it, and
+// make the transfer be reported even if it otherwise succeeded. The function may be called concurrently by several
+// transfers
+func WithErrorHandler(fn func(peer net.Addr, err error)) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.errorHandler = fn
+	})
+}
+
+// NormalizeFilenames makes the server convert requested filenames to lower case and replace backslashes with forward
+// slashes before passing them to the handler, for the sake of legacy clients using DOS-style paths such as
+// BOOT\PXE.0. By default, filenames are passed on exactly as requested
+func NormalizeFilenames() ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.normalizeFilenames = true
+	})
+}
+
+// FilenameRewriter type maps the filename requested by the client at remote to the one passed to the handler. Returning
+// an error refuses the request, reporting the error to the client
+type FilenameRewriter func(remote net.Addr, filename string) (string, error)
+
+// WithFilenameRewriter sets a function rewriting requested filenames before they are passed to the handler, so that
+// names such as latest.bin can be resolved to a file chosen at request time. Filenames are rewritten after being
+// normalized, and the handler only sees the rewritten ones. The function is called from the transfer's own goroutine,
+// so it may take its time without holding up requests from other clients
+func WithFilenameRewriter(rewrite FilenameRewriter) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.rewriteFilename = rewrite
+	})
+}
+
+// WithMaxSessions limits the number of transfers carried out at once. Requests received while the limit is reached are
+// refused as if the server were busy. By default, or if n is not positive, there is no limit
+func WithMaxSessions(n int) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.maxSessions = n
+	})
+}
+
+// WithMaxSessionsPerClient limits the number of transfers carried out at once with clients sharing an IP address, so
+// that a single client can't monopolize the server. Requests received while a client is at its limit are refused as if
+// the server were busy. By default, or if n is not positive, there is no limit
+func WithMaxSessionsPerClient(n int) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.maxSessionsPerClient = n
+	})
+}
+
+// ReadOnly makes the server refuse every write request with an access violation, without calling the handler
+func ReadOnly() ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.readOnly = true
+	})
+}
+
+// WithAllowlist restricts the clients served to those whose IP addresses are within any of the given prefixes. Requests
+// from other clients are refused with an access violation. By default, every client is served
+func WithAllowlist(prefixes ...netip.Prefix) ServerOption {
+	return serverOptionFunc(func(s *Server) {
+		s.allowlist = prefixes
+	})
+}
+
+// listenUDP is the default ListenFunc
+func listenUDP(local net.Addr) (net.PacketConn, error) {
+	return net.ListenUDP("udp", transferAddr(local))
+}
+
+// listenUDPRange returns a ListenFunc binding sockets to the first port available between low and high
+func listenUDPRange(low, high int) ListenFunc {
+	return func(local net.Addr) (net.PacketConn, error) {
+		laddr := transferAddr(local)
+		for port := low; port <= high; port++ {
+			laddr.Port = port
+			if conn, err := net.ListenUDP("udp", laddr); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, ErrTIDRangeExhausted
+	}
+}
+
+// transferAddr returns the address transfers are carried out from for requests received on local, leaving the port to
+// be chosen by the system
+func transferAddr(local net.Addr) *net.UDPAddr {
+	// Bind to the same address the request was received on, keeping the zone of IPv6 link-local addresses
+	laddr := &net.UDPAddr{}
+	if addr, ok := local.(*net.UDPAddr); ok {
+		laddr.IP, laddr.Zone = addr.IP, addr.Zone
+	}
+	return laddr
+}
+
+// Server is a TFTP server which answers read and write requests by means of a Handler
+type Server struct {
+	transferConfig
+	handler              Handler
+	handlerTimeout       time.Duration
+	dallyTimeout         time.Duration
+	busyMessage          string
+	maxBlockSize         int
+	maxWindowSize        int
+	pathMTU              PathMTUFunc
+	bandwidthLimit       int64
+	maxFileSize          int64
+	limiter              *bandwidthLimiter
+	newHash              func() hash.Hash
+	onComplete           func(filename string, sum []byte)
+	normalizeFilenames   bool
+	rewriteFilename      FilenameRewriter
+	maxSessions          int
+	maxSessionsPerClient int
+	readOnly             bool
+	allowlist            []netip.Prefix
+	errorHandler         func(peer net.Addr, err error)
+	onServed             func(req *Request) // Called whenever a file has been read successfully
+	listen               ListenFunc
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	closed   bool
+	conn     net.PacketConn
+	sessions map[net.PacketConn]struct{}
+	active   int            // Number of sessions, including those whose sockets are being allocated
+	clients  map[string]int // Number of sessions by client IP address
+}
+
+// NewServer creates a new server which dispatches requests to handler
+func NewServer(handler Handler, opts ...ServerOption) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Server{
+		transferConfig: defaultTransferConfig(),
+		handler:        handler,
+		dallyTimeout:   DefaultDallyTimeout,
+		busyMessage:    DefaultBusyMessage,
+		maxBlockSize:   DefaultMaxServerBlockSize,
+		maxWindowSize:  DefaultMaxServerWindowSize,
+		listen:         listenUDP,
+		ctx:            ctx,
+		cancel:         cancel,
+		sessions:       make(map[net.PacketConn]struct{}),
+		clients:        make(map[string]int),
+	}
+	for _, opt := range opts {
+		opt.applyServer(s)
+	}
+	if s.bandwidthLimit > 0 {
+		s.limiter = newBandwidthLimiter(ctx, s.bandwidthLimit)
+	}
+	return s
+}
+
+// NewServerWithConfig creates a new server which dispatches requests to handler, as configured by cfg, and serves
+// them from conn once Run is called. conn may be nil for servers started with ListenAndServe or Serve instead. Options
+// are applied on top of the configuration. An error is returned if the configuration is not valid
+func NewServerWithConfig(conn net.PacketConn, handler Handler, cfg ServerConfig, opts ...ServerOption) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	s := NewServer(handler, append(cfg.options(), opts...)...)
+	s.conn = conn
+	return s, nil
+}
+
+// ListenAndServe listens on the UDP address addr and serves incoming requests until the server is closed
+func (s *Server) ListenAndServe(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// Close stops the server, aborting all ongoing transfers
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cancel()
+	var err error
+	if s.conn != nil {
+		err = s.conn.Close()
+	}
+	for conn := range s.sessions {
+		_ = conn.Close()
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// Run serves requests received by the connection the server was created with until the server is closed, in which
+// case ErrServerClosed is returned
+func (s *Server) Run() error {
+	s.mu.Lock()
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return ErrNoConn
+	}
+	return s.Serve(conn)
+}
+
+// Serve accepts requests received by conn until the server is closed, in which case ErrServerClosed is returned. conn
+// may be a socket configured by the caller, or any other implementation of net.PacketConn. Transfers are carried out
+// from sockets created by the server's ListenFunc
+func (s *Server) Serve(conn net.PacketConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = conn.Close()
+		return ErrServerClosed
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		if n >= 2 {
+			if op := Opcode(binary.BigEndian.Uint16(buf)); op == ERROR {
+				// ERROR packets are never answered
+				continue
+			} else if !IsRequest(op) {
+				// Stray packets from other transfers, as well as unknown ones, can't start a transfer
+				_ = sendPacket(conn, addr, ErrorPacketFromError(ErrUnexpectedPacket))
+				continue
+			}
+		}
+
+		if !s.allowed(addr) {
+			_ = sendPacket(conn, addr, ErrorPacketFromError(ErrClientNotAllowed))
+			continue
+		}
+
+		p, err := s.parseRequest(buf[:n])
+		if err != nil {
+			// Malformed requests
+			_ = sendPacket(conn, addr, ErrorPacketFromError(ProtocolError{Code: ErrorCodeIllegalOp, Msg: err.Error()}))
+			continue
+		}
+		run, err := s.prepare(p)
+		if err != nil {
+			_ = sendPacket(conn, addr, ErrorPacketFromError(err))
+			continue
+		}
+		s.startSession(conn, addr, run)
+	}
+}
+
+// allowed reports whether requests from addr may be served, as per the allowlist
+func (s *Server) allowed(addr net.Addr) bool {
+	if len(s.allowlist) == 0 {
+		return true
+	}
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	ip := udpAddr.AddrPort().Addr().Unmap()
+	for _, prefix := range s.allowlist {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// prepare checks a request, returning the function carrying out the transfer it asks for. Requests are checked before
+// any resources are allocated for their transfers, so that floods of invalid or unauthorized requests are answered from
+// the listening socket alone. Only cheap checks are made here, since requests from every client wait for them: the
+// handler and the filename rewriter are left to the transfer
+func (s *Server) prepare(p Packet) (func(sess *session) error, error) {
+	switch p := p.(type) {
+	case *RRQPacket:
+		if err := checkMode(p.Mode); err != nil {
+			return nil, err
+		}
+		return func(sess *session) error {
+			return s.handleRead(sess, p)
+		}, nil
+	case *WRQPacket:
+		if s.readOnly {
+			return nil, ErrReadOnly
+		}
+		if s.tooLarge(p.Options) {
+			// Spare the bandwidth of an upload bound to fail
+			return nil, ErrFileTooLarge
+		}
+		if err := checkMode(p.Mode); err != nil {
+			return nil, err
+		}
+		return func(sess *session) error {
+			return s.handleWrite(sess, p)
+		}, nil
+	}
+	return nil, fmt.Errorf("%w: expected a request", ErrUnexpectedPacket)
+}
+
+// checkMode refuses requests for unknown transfer modes
+func checkMode(mode Mode) error {
+	if _, err := ParseMode(string(mode)); err != nil {
+		return ProtocolError{Code: ErrorCodeIllegalOp, Msg: err.Error()}
+	}
+	return nil
+}
+
+// parseRequest behaves like ParsePacket, subject to the restrictions on filenames configured for the server
+func (s *Server) parseRequest(b []byte) (Packet, error) {
+	if !s.allowNonNETASCIIFilenames || len(b) < 2 {
+		return ParsePacket(b)
+	}
+
+	var err error
+	switch Opcode(binary.BigEndian.Uint16(b)) {
+	case RRQ:
+		p := &RRQPacket{}
+		if err = p.unmarshalBytes(b, true); err == nil {
+			return p, nil
+		}
+	case WRQ:
+		p := &WRQPacket{}
+		if err = p.unmarshalBytes(b, true); err == nil {
+			return p, nil
+		}
+	default:
+		return ParsePacket(b)
+	}
+	return nil, err
+}
+
+// startSession runs a transfer with peer in its own goroutine, from a transfer ID newly allocated for the request
+// received by listener
+func (s *Server) startSession(listener net.PacketConn, peer net.Addr, run func(sess *session) error) {
+	// Make room for the session before allocating its socket
+	client := clientIP(peer)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	if s.maxSessions > 0 && s.active >= s.maxSessions ||
+		s.maxSessionsPerClient > 0 && s.clients[client] >= s.maxSessionsPerClient {
+		s.mu.Unlock()
+		_ = sendPacket(listener, peer, &ERRORPacket{ErrorCode: ErrorCodeNotDefined, ErrorMsg: s.busyMessage})
+		return
+	}
+	s.active++
+	s.clients[client]++
+	s.mu.Unlock()
+
+	conn, err := s.listen(listener.LocalAddr())
+	s.mu.Lock()
+	if err != nil || s.closed {
+		s.release(client)
+		s.mu.Unlock()
+		if err != nil {
+			_ = sendPacket(listener, peer, &ERRORPacket{ErrorCode: ErrorCodeNotDefined, ErrorMsg: s.busyMessage})
+		} else {
+			_ = conn.Close()
+		}
+		return
+	}
+	applyDSCP(conn, s.transferConfig)
+	s.sessions[conn] = struct{}{}
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+		sess := newSession(conn, peer, s.transferConfig)
+		sess.maxBlockSize = s.maxBlockSize
+		sess.maxWindowSize = s.maxWindowSize
+		if s.pathMTU != nil {
+			if mtu := s.pathMTU(peer); mtu > 0 {
+				if size := blockSizeForMTU(mtu, peer); size >= minBlockSize && size < sess.maxBlockSize {
+					sess.maxBlockSize = size
+				}
+			}
+		}
+		sess.limiter = s.limiter
+		err := run(sess)
+
+		s.mu.Lock()
+		delete(s.sessions, conn)
+		s.release(client)
+		s.mu.Unlock()
+		if err = joinErrors(err, sess.close()); err != nil && s.errorHandler != nil {
+			s.errorHandler(peer, err)
+		}
+	}()
+}
+
+// release frees the room taken by a session with client. The caller must hold the lock
+func (s *Server) release(client string) {
+	s.active--
+	if s.clients[client]--; s.clients[client] == 0 {
+		delete(s.clients, client)
+	}
+}
+
+// Sessions returns the number of transfers in progress
+func (s *Server) Sessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.active
+}
+
+// clientIP returns the IP address of a client, which identifies it regardless of the port its requests come from
+func clientIP(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.AddrPort().Addr().Unmap().String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// filename returns the filename passed to the handler for the one requested by the client at remote
+func (s *Server) filename(remote net.Addr, requested string) (string, error) {
+	filename := requested
+	if s.normalizeFilenames {
+		filename = strings.ReplaceAll(strings.ToLower(filename), "\\", "/")
+	}
+	if s.rewriteFilename != nil {
+		return s.rewriteFilename(remote, filename)
+	}
+	return filename, nil
+}
+
+// callHandler calls open, which opens or creates a file by means of the handler, enforcing the handler timeout
+func (s *Server) callHandler(open func(ctx context.Context) (io.Closer, error)) (io.Closer, error) {
+	if s.handlerTimeout <= 0 {
+		return checkStream(open(s.ctx))
+	}
+
+	ctx, cancel := context.WithTimeout(s.ctx, s.handlerTimeout)
+	defer cancel()
+
+	type result struct {
+		c   io.Closer
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		c, err := checkStream(open(ctx))
+		done <- result{c, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.c, r.err
+	case <-ctx.Done():
+		// Handlers ignoring the context are not waited for, but whatever they eventually return has to be released
+		go func() {
+			if r := <-done; r.err == nil {
+				_ = r.c.Close()
+			}
+		}()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, ErrHandlerTimeout
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// checkStream fails handler calls which returned neither a stream nor an error
+func checkStream(c io.Closer, err error) (io.Closer, error) {
+	if err == nil && c == nil {
+		return nil, ErrNilStream
+	}
+	return c, err
+}
+
+// handleRead serves a read request
+func (s *Server) handleRead(sess *session, p *RRQPacket) (err error) {
+	filename, err := s.filename(sess.peer, p.Filename)
+	if err != nil {
+		return sess.abort(err)
+	}
+	req := &Request{Filename: filename, Mode: p.Mode, RemoteAddr: sess.peer}
+	c, err := s.callHandler(func(ctx context.Context) (io.Closer, error) {
+		return s.handler.ReadFile(ctx, req)
+	})
+	if err != nil {
+		return sess.abort(err)
+	}
+	rc := c.(io.ReadCloser)
+	defer func() {
+		err = joinErrors(err, rc.Close())
+	}()
+
+	var r io.Reader = rc
+	if p.Mode.NeedsConversion() {
+		if h, ok := s.handler.(RawModeHandler); !ok || !h.RawMode() {
+			r = NewNETASCIIReader(rc)
+		}
+	}
+
+	if oack := sess.negotiate(p.Options, r); len(oack) > 0 {
+		// The client acknowledges the options with ACK 0 before the first block is sent
+		if err := sess.send(&OACKPacket{Options: oack}); err != nil {
+			return err
+		}
+		if err := sess.awaitACK(0); err != nil {
+			return err
+		}
+	}
+
+	sum := s.checksum()
+	if sum != nil {
+		r = io.TeeReader(r, sum)
+	}
+	if err := sess.sendFile(r); err != nil {
+		return err
+	}
+	s.complete(req.Filename, sum)
+	if s.onServed != nil {
+		s.onServed(req)
+	}
+	return nil
+}
+
+// handleWrite serves a write request
+func (s *Server) handleWrite(sess *session, p *WRQPacket) error {
+	filename, err := s.filename(sess.peer, p.Filename)
+	if err != nil {
+		return sess.abort(err)
+	}
+	req := &Request{Filename: filename, Mode: p.Mode, RemoteAddr: sess.peer}
+	c, err := s.callHandler(func(ctx context.Context) (io.Closer, error) {
+		return s.handler.WriteFile(ctx, req)
+	})
+	if err != nil {
+		return sess.abort(err)
+	}
+	w := c.(io.WriteCloser)
+
+	// Accepted options are acknowledged in place of the ACK for block 0
+	var reply Packet = &ACKPacket{BlockNumber: 0}
+	if oack := sess.negotiate(p.Options, nil); len(oack) > 0 {
+		reply = &OACKPacket{Options: oack}
+	}
+	if err := sess.send(reply); err != nil {
+		return joinErrors(err, closeWithError(w, err))
+	}
+
+	var dst io.Writer = uploadWriter{w}
+	if s.maxFileSize > 0 {
+		dst = &limitedWriter{w: dst, remaining: s.maxFileSize}
+	}
+	sum := s.checksum()
+	if sum != nil {
+		dst = io.MultiWriter(dst, sum)
+	}
+
+	committed := false
+	err = sess.receiveFile(dst, func() error {
+		committed = true
+		return w.Close()
+	})
+	if err != nil && !committed {
+		return joinErrors(err, closeWithError(w, err))
+	}
+	if err != nil {
+		return err
+	}
+	s.complete(req.Filename, sum)
+	d := s.dallyTimeout
+	if d <= 0 && sess.strictFinalBlock {
+		// Blocks following the final one can only be noticed by lingering
+		d = sess.timeout
+	}
+	if d > 0 {
+		return sess.dally(d)
+	}
+	return nil
+}
+
+// tooLarge reports whether the size declared by the tsize option of a write request exceeds the maximum file size
+func (s *Server) tooLarge(options []Option) bool {
+	if s.maxFileSize <= 0 || s.legacyOnly {
+		return false
+	}
+	value, ok := findOption(options, OptionTransferSize)
+	if !ok {
+		return false
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	return err == nil && size > s.maxFileSize
+}
+
+// uploadWriter stores uploaded files, reporting errors that have no error code of their own, such as those of a disk
+// running out of space, as ErrorCodeDiskFull
+type uploadWriter struct {
+	w io.Writer
+}
+
+func (w uploadWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil && ErrorCodeForError(err) == ErrorCodeNotDefined {
+		err = diskFullError{err}
+	}
+	return n, err
+}
+
+// diskFullError reports an error storing an upload as ErrorCodeDiskFull, while still wrapping the error itself
+type diskFullError struct {
+	err error
+}
+
+func (e diskFullError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrorCodeDiskFull.Error(), e.err.Error())
+}
+
+func (e diskFullError) Unwrap() error {
+	return e.err
+}
+
+// Is matches ErrorCodeDiskFull, besides the errors matched by the wrapped one
+func (e diskFullError) Is(target error) bool {
+	return target == ErrorCodeDiskFull
+}
+
+// As sets ErrorCode targets to ErrorCodeDiskFull, so that ErrorCodeForError reports it
+func (e diskFullError) As(target interface{}) bool {
+	code, ok := target.(*ErrorCode)
+	if ok {
+		*code = ErrorCodeDiskFull
+	}
+	return ok
+}
+
+// limitedWriter is a writer refusing to write more than a number of bytes with ErrFileTooLarge
+type limitedWriter struct {
+	w         io.Writer
+	remaining int64
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > w.remaining {
+		return 0, ErrFileTooLarge
+	}
+	w.remaining -= int64(len(p))
+	return w.w.Write(p)
+}
+
+// checksum returns a new hash for computing the checksum of a transfer, if checksums are enabled
+func (s *Server) checksum() hash.Hash {
+	if s.newHash == nil || s.onComplete == nil {
+		return nil
+	}
+	return s.newHash()
+}
+
+// complete reports the checksum of a successful transfer, if checksums are enabled
+func (s *Server) complete(filename string, sum hash.Hash) {
+	if sum != nil {
+		s.onComplete(filename, sum.Sum(nil))
+	}
+}
+
+// closeWithError closes w after a failed transfer, letting it know about the failure if it supports doing so
+func closeWithError(w io.WriteCloser, err error) error {
+	if w, ok := w.(interface{ CloseWithError(error) error }); ok {
+		return w.CloseWithError(err)
+	}
+	return w.Close()
+}
+
+// ListenAndServe listens on the UDP address addr and serves incoming requests with handler. It always returns a
+// non-nil error
+func ListenAndServe(addr string, handler Handler, opts ...ServerOption) error {
+	return NewServer(handler, opts...).ListenAndServe(addr)
+}
+
+// ListenAndServeContext behaves like ListenAndServe, but stops serving when ctx is done. In that case, all ongoing
+// transfers are aborted and ErrServerClosed is returned
+func ListenAndServeContext(ctx context.Context, addr string, handler Handler, opts ...ServerOption) error {
+	s := NewServer(handler, opts...)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = s.Close()
+		case <-stop:
+		}
+	}()
+	return s.ListenAndServe(addr)
+}
+
+// Serve serves incoming requests received by conn with handler. It returns when reading from conn fails, for
+// instance because it has been closed
+func Serve(conn net.PacketConn, handler Handler, opts ...ServerOption) error {
+	return NewServer(handler, opts...).Serve(conn)
+}
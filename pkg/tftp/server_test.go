@@ -0,0 +1,1142 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// startTestServer starts a server on a random loopback port and returns its address. The server is closed when the
+// test finishes
+func startTestServer(t *testing.T, handler Handler, opts ...ServerOption) net.Addr {
+	t.Helper()
+	return startTestServerOn(t, "127.0.0.1:0", handler, opts...)
+}
+
+// startTestServerOn behaves like startTestServer, but listens on the given address. The test is skipped if the address
+// is not available on this host
+func startTestServerOn(t *testing.T, addr string, handler Handler, opts ...ServerOption) net.Addr {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		t.Skipf("can't listen on %v: %v", addr, err)
+	}
+
+	s := NewServer(handler, opts...)
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Serve(conn)
+	}()
+	t.Cleanup(func() {
+		_ = s.Close()
+		if err := <-done; err != ErrServerClosed {
+			t.Errorf("got %v want %v", err, ErrServerClosed)
+		}
+	})
+	return conn.LocalAddr()
+}
+
+// testPeer is a bare-bones TFTP peer used to drive a server from tests
+type testPeer struct {
+	t      *testing.T
+	conn   net.PacketConn
+	remote net.Addr
+	locked bool
+}
+
+func newTestPeer(t *testing.T, remote net.Addr) *testPeer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestPeerConn(t, conn, remote)
+}
+
+// newTestPeerConn creates a peer talking through conn, which is closed when the test finishes
+func newTestPeerConn(t *testing.T, conn net.PacketConn, remote net.Addr) *testPeer {
+	t.Helper()
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return &testPeer{t: t, conn: conn, remote: remote}
+}
+
+// send marshals a packet and sends it to the remote peer
+func (p *testPeer) send(pkt Packet) {
+	p.t.Helper()
+	buf := bytes.Buffer{}
+	if err := pkt.Marshal(&buf); err != nil {
+		p.t.Fatal(err)
+	}
+	if _, err := p.conn.WriteTo(buf.Bytes(), p.remote); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// receive waits for the next packet. The first packet received locks the remote address onto the sender's TID
+func (p *testPeer) receive() Packet {
+	p.t.Helper()
+	buf := make([]byte, maxDatagramSize)
+	if err := p.conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		p.t.Fatal(err)
+	}
+	n, addr, err := p.conn.ReadFrom(buf)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if !p.locked {
+		p.remote = addr
+		p.locked = true
+	}
+	pkt, err := ParsePacket(buf[:n])
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return pkt
+}
+
+// get downloads a file in lock-step, returning its contents or the error reported by the server
+func (p *testPeer) get(filename string, mode Mode) ([]byte, error) {
+	p.t.Helper()
+	p.send(&RRQPacket{Filename: filename, Mode: mode})
+
+	buf := bytes.Buffer{}
+	for block := uint16(1); ; block++ {
+		switch pkt := p.receive().(type) {
+		case *DATAPacket:
+			if pkt.BlockNumber != block {
+				p.t.Fatalf("got block number %v want %v", pkt.BlockNumber, block)
+			}
+			buf.Write(pkt.Data)
+			p.send(&ACKPacket{BlockNumber: block})
+			if len(pkt.Data) < DefaultBlockSize {
+				return buf.Bytes(), nil
+			}
+		case *ERRORPacket:
+			return nil, ProtocolError{Code: pkt.ErrorCode, Msg: pkt.ErrorMsg}
+		default:
+			p.t.Fatalf("got unexpected packet %#v", pkt)
+		}
+	}
+}
+
+// put uploads a file in lock-step, returning the error reported by the server if any
+func (p *testPeer) put(filename string, mode Mode, data []byte) error {
+	p.t.Helper()
+	p.send(&WRQPacket{Filename: filename, Mode: mode})
+
+	for block := uint16(0); ; block++ {
+		switch pkt := p.receive().(type) {
+		case *ACKPacket:
+			if pkt.BlockNumber != block {
+				p.t.Fatalf("got block number %v want %v", pkt.BlockNumber, block)
+			}
+			if int(block)*DefaultBlockSize > len(data) {
+				return nil
+			}
+			end := (int(block) + 1) * DefaultBlockSize
+			if end > len(data) {
+				end = len(data)
+			}
+			p.send(&DATAPacket{BlockNumber: block + 1, Data: data[int(block)*DefaultBlockSize : end]})
+		case *ERRORPacket:
+			return ProtocolError{Code: pkt.ErrorCode, Msg: pkt.ErrorMsg}
+		default:
+			p.t.Fatalf("got unexpected packet %#v", pkt)
+		}
+	}
+}
+
+func TestServerRead(t *testing.T) {
+	t.Run("Multi-block files are served", func(t *testing.T) {
+		want := bytes.Repeat([]byte("0123456789abcdef"), 100)
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": want}))
+
+		got, err := newTestPeer(t, addr).get("file.bin", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes want %d", len(got), len(want))
+		}
+	})
+
+	t.Run("Files whose size is a multiple of 512 end with an empty block", func(t *testing.T) {
+		want := bytes.Repeat([]byte("X"), 2*DefaultBlockSize)
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": want}))
+
+		got, err := newTestPeer(t, addr).get("file.bin", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes want %d", len(got), len(want))
+		}
+	})
+
+	t.Run("Lost ACKs cause retransmission", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.txt": []byte("hello")}),
+			WithTimeout(10*time.Millisecond))
+
+		p := newTestPeer(t, addr)
+		p.send(&RRQPacket{Filename: "file.txt", Mode: ModeOctet})
+		for i := 0; i < 2; i++ {
+			pkt, ok := p.receive().(*DATAPacket)
+			if !ok || pkt.BlockNumber != 1 {
+				t.Fatalf("got %#v want DATA block 1", pkt)
+			}
+		}
+		p.send(&ACKPacket{BlockNumber: 1})
+	})
+}
+
+// failingHandler serves files which can't be read past their first block
+type failingHandler struct {
+	err error
+}
+
+func (h failingHandler) ReadFile(context.Context, *Request) (io.ReadCloser, error) {
+	return io.NopCloser(io.MultiReader(bytes.NewReader(make([]byte, DefaultBlockSize)), iotest.ErrReader(h.err))), nil
+}
+
+func (h failingHandler) WriteFile(context.Context, *Request) (io.WriteCloser, error) {
+	return nil, ErrorCodeAccessViolation
+}
+
+func TestServerErrors(t *testing.T) {
+	t.Run("Errors reading files mid-transfer are reported instead of ending the file", func(t *testing.T) {
+		addr := startTestServer(t, failingHandler{errors.New("generator failed")})
+
+		p := newTestPeer(t, addr)
+		p.send(&RRQPacket{Filename: "file.bin", Mode: ModeOctet})
+		if dp, ok := p.receive().(*DATAPacket); !ok || dp.BlockNumber != 1 || len(dp.Data) != DefaultBlockSize {
+			t.Fatalf("got %#v want a full DATA block 1", dp)
+		}
+		p.send(&ACKPacket{BlockNumber: 1})
+		pkt, ok := p.receive().(*ERRORPacket)
+		if !ok {
+			t.Fatalf("got %#v want an ERROR packet", pkt)
+		}
+		if pkt.ErrorCode != ErrorCodeNotDefined || pkt.ErrorMsg != "generator failed" {
+			t.Fatalf("got %v %q want %v %q", pkt.ErrorCode, pkt.ErrorMsg, ErrorCodeNotDefined, "generator failed")
+		}
+	})
+
+	t.Run("Handler errors are reported with the corresponding error code", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(nil))
+
+		_, err := newTestPeer(t, addr).get("missing.txt", ModeOctet)
+		if !errors.Is(err, ErrorCodeFileNotFound) {
+			t.Fatalf("got %v want %v", err, ErrorCodeFileNotFound)
+		}
+	})
+
+	t.Run("Packets from unknown transfer IDs are rejected", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.txt": []byte("hello")}))
+
+		p := newTestPeer(t, addr)
+		p.send(&RRQPacket{Filename: "file.txt", Mode: ModeOctet})
+		p.receive()
+
+		stranger := newTestPeer(t, p.remote)
+		stranger.send(&ACKPacket{BlockNumber: 1})
+		pkt, ok := stranger.receive().(*ERRORPacket)
+		if !ok {
+			t.Fatalf("got %#v want an ERROR packet", pkt)
+		}
+		if pkt.ErrorCode != ErrorCodeUnknownTransferID {
+			t.Fatalf("got error code %v want %v", pkt.ErrorCode, ErrorCodeUnknownTransferID)
+		}
+		p.send(&ACKPacket{BlockNumber: 1})
+	})
+}
+
+// nilHandler answers every request with neither a stream nor an error
+type nilHandler struct{}
+
+func (nilHandler) ReadFile(context.Context, *Request) (io.ReadCloser, error)   { return nil, nil }
+func (nilHandler) WriteFile(context.Context, *Request) (io.WriteCloser, error) { return nil, nil }
+
+func TestServerNilStream(t *testing.T) {
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		t.Run(fmt.Sprintf("Handlers returning no stream fail the transfer with a handler timeout of %v", timeout), func(t *testing.T) {
+			addr := startTestServer(t, nilHandler{}, WithHandlerTimeout(timeout))
+
+			_, err := newTestPeer(t, addr).get("file.bin", ModeOctet)
+			if !errors.Is(err, ErrorCodeNotDefined) {
+				t.Fatalf("got %v want %v", err, ErrorCodeNotDefined)
+			}
+			err = newTestPeer(t, addr).put("file.bin", ModeOctet, []byte("hello"))
+			if !errors.Is(err, ErrorCodeNotDefined) {
+				t.Fatalf("got %v want %v", err, ErrorCodeNotDefined)
+			}
+
+			// The server keeps serving other requests
+			_, err = newTestPeer(t, addr).get("file.bin", ModeOctet)
+			var protoErr ProtocolError
+			if !errors.As(err, &protoErr) || protoErr.Msg != ErrNilStream.Error() {
+				t.Fatalf("got %v want %v", err, ErrNilStream)
+			}
+		})
+	}
+}
+
+func TestServerDally(t *testing.T) {
+	t.Run("Final blocks retransmitted after an upload are acknowledged again", func(t *testing.T) {
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		addr := startTestServer(t, h)
+
+		p := newTestPeer(t, addr)
+		p.send(&WRQPacket{Filename: "file.txt", Mode: ModeOctet})
+		expectACK(t, p, 0)
+		p.send(&DATAPacket{BlockNumber: 1, Data: []byte("hello")})
+		expectACK(t, p, 1)
+
+		// As if the ACK had been lost
+		p.send(&DATAPacket{BlockNumber: 1, Data: []byte("hello")})
+		expectACK(t, p, 1)
+
+		if got := readMapFile(t, h, "file.txt"); string(got) != "hello" {
+			t.Fatalf("got %q want %q", got, "hello")
+		}
+	})
+
+	t.Run("Final blocks are checked strictly even if dallying is disabled", func(t *testing.T) {
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		addr := startTestServer(t, h, WithDallyTimeout(0), StrictFinalBlock())
+
+		p := newTestPeer(t, addr)
+		p.send(&WRQPacket{Filename: "file.txt", Mode: ModeOctet})
+		expectACK(t, p, 0)
+		p.send(&DATAPacket{BlockNumber: 1, Data: []byte("short")})
+		expectACK(t, p, 1)
+		p.send(&DATAPacket{BlockNumber: 2, Data: []byte("more")})
+		if e, ok := p.receive().(*ERRORPacket); !ok || e.ErrorCode != ErrorCodeNotDefined {
+			t.Fatalf("got %#v want an ERROR with code %v", e, ErrorCodeNotDefined)
+		}
+	})
+}
+
+func TestServerChecksum(t *testing.T) {
+	data := bytes.Repeat([]byte("checksum"), 300)
+
+	type report struct {
+		filename string
+		sum      []byte
+	}
+	// checksumServer starts a server reporting checksums computed with newHash
+	checksumServer := func(t *testing.T, h Handler, newHash func() hash.Hash) (net.Addr, <-chan report) {
+		t.Helper()
+		reports := make(chan report, 1)
+		addr := startTestServer(t, h, WithChecksum(newHash, func(filename string, sum []byte) {
+			reports <- report{filename, sum}
+		}))
+		return addr, reports
+	}
+	// expectReport fails the test unless a checksum is reported for filename
+	expectReport := func(t *testing.T, reports <-chan report, filename string, want []byte) {
+		t.Helper()
+		select {
+		case got := <-reports:
+			if got.filename != filename || !bytes.Equal(got.sum, want) {
+				t.Fatalf("got %s %x want %s %x", got.filename, got.sum, filename, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no checksum was reported")
+		}
+	}
+
+	t.Run("Checksums of files read are reported", func(t *testing.T) {
+		addr, reports := checksumServer(t, MapHandler(map[string][]byte{"file.bin": data}), sha256.New)
+		if _, err := newTestPeer(t, addr).get("file.bin", ModeOctet); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		want := sha256.Sum256(data)
+		expectReport(t, reports, "file.bin", want[:])
+	})
+
+	t.Run("Checksums of files written are reported", func(t *testing.T) {
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		addr, reports := checksumServer(t, h, func() hash.Hash { return crc32.NewIEEE() })
+		if err := newTestPeer(t, addr).put("file.bin", ModeOctet, data); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		want := crc32.NewIEEE()
+		want.Write(data)
+		expectReport(t, reports, "file.bin", want.Sum(nil))
+	})
+
+	t.Run("Failed transfers are not reported", func(t *testing.T) {
+		addr, reports := checksumServer(t, MapHandler(nil), sha256.New)
+		if _, err := newTestPeer(t, addr).get("missing.bin", ModeOctet); err == nil {
+			t.Fatal("wanted an error but didn't get one")
+		}
+		select {
+		case got := <-reports:
+			t.Fatalf("got a checksum for %s want none", got.filename)
+		case <-time.After(50 * time.Millisecond):
+		}
+	})
+}
+
+// TestServerRetransmissionRace is meant to be run with the race detector enabled, so that it catches unsynchronized
+// access to the session state while retransmitting
+func TestServerRetransmissionRace(t *testing.T) {
+	want := bytes.Repeat([]byte("retransmit"), 300)
+	addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": want}),
+		WithTimeout(time.Millisecond), WithRetries(1000))
+
+	p := newTestPeer(t, addr)
+	p.send(&RRQPacket{Filename: "file.bin", Mode: ModeOctet})
+
+	got := bytes.Buffer{}
+	for block := uint16(1); ; {
+		pkt, ok := p.receive().(*DATAPacket)
+		if !ok {
+			t.Fatalf("got %#v want a DATA packet", pkt)
+		}
+		if pkt.BlockNumber != block {
+			// Retransmission of a block we have already received
+			continue
+		}
+
+		// Take longer than the server timeout to acknowledge every block
+		time.Sleep(5 * time.Millisecond)
+		got.Write(pkt.Data)
+		p.send(&ACKPacket{BlockNumber: block})
+		if len(pkt.Data) < DefaultBlockSize {
+			break
+		}
+		block++
+	}
+
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+	}
+}
+
+// TestServerConcurrentNegotiation is meant to be run with the race detector enabled, so that it catches options
+// negotiated by a transfer leaking into another one
+func TestServerConcurrentNegotiation(t *testing.T) {
+	want := bytes.Repeat([]byte("concurrent"), 1000)
+	addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": want}))
+
+	blockSizes := []int{600, 1024, 1428, 4096}
+	var wg sync.WaitGroup
+	for i, size := range blockSizes {
+		seconds, size := i+1, size
+		timeout := time.Duration(seconds) * time.Second
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got := bytes.Buffer{}
+			c := newTestClient(t, WithBlockSize(size), WithWindowSize(size/512), WithRequestedTimeout(timeout))
+			tr, err := c.Download(context.Background(), addr.String(), "file.bin", ModeOctet, &got)
+			if err != nil {
+				t.Errorf("got an error but didn't want one: %v", err)
+				return
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("got %d bytes want %d", got.Len(), len(want))
+			}
+			if tr.BlockSize() != size || tr.WindowSize() != size/512 {
+				t.Errorf("got block size %v and window size %v want %v and %v",
+					tr.BlockSize(), tr.WindowSize(), size, size/512)
+			}
+			if got := tr.Options()[OptionTimeout]; got != strconv.Itoa(seconds) || tr.Timeout() != timeout {
+				t.Errorf("got timeout %q (%v) want %v", got, tr.Timeout(), timeout)
+			}
+			if blocks := tr.Result().Blocks; blocks != uint64(BlockCount(int64(len(want)), size)) {
+				t.Errorf("got %v blocks want %v for block size %v", blocks, BlockCount(int64(len(want)), size), size)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestServe(t *testing.T) {
+	t.Run("Requests are served from a pre-bound connection", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() {
+			done <- Serve(conn, MapHandler(map[string][]byte{"file.txt": []byte("hello")}))
+		}()
+
+		got, err := newTestPeer(t, conn.LocalAddr()).get("file.txt", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if string(got) != "hello" {
+			t.Fatalf("got %q want %q", got, "hello")
+		}
+
+		_ = conn.Close()
+		if err := <-done; err == nil {
+			t.Fatal("wanted an error but didn't get one")
+		}
+	})
+
+	t.Run("Requests are served from in-memory connections", func(t *testing.T) {
+		network := newMemNetwork()
+		conn := network.listen()
+		s := NewServer(MapHandler(map[string][]byte{"file.txt": []byte("hello")}), WithListenFunc(network.ListenFunc))
+		done := make(chan error, 1)
+		go func() {
+			done <- s.Serve(conn)
+		}()
+
+		got, err := newTestPeerConn(t, network.listen(), conn.LocalAddr()).get("file.txt", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if string(got) != "hello" {
+			t.Fatalf("got %q want %q", got, "hello")
+		}
+
+		_ = s.Close()
+		if err := <-done; err != ErrServerClosed {
+			t.Fatalf("got %v want %v", err, ErrServerClosed)
+		}
+	})
+
+	t.Run("Serving stops when the context is done", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- ListenAndServeContext(ctx, "127.0.0.1:0", MapHandler(nil))
+		}()
+
+		cancel()
+		select {
+		case err := <-done:
+			if err != ErrServerClosed {
+				t.Fatalf("got %v want %v", err, ErrServerClosed)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("server didn't stop")
+		}
+	})
+}
+
+// closeFailingHandler serves files whose Close method fails
+type closeFailingHandler struct {
+	data []byte
+	err  error
+}
+
+func (h closeFailingHandler) ReadFile(context.Context, *Request) (io.ReadCloser, error) {
+	return closeFailingFile{bytes.NewReader(h.data), h.err}, nil
+}
+
+func (h closeFailingHandler) WriteFile(context.Context, *Request) (io.WriteCloser, error) {
+	return nil, ErrorCodeAccessViolation
+}
+
+type closeFailingFile struct {
+	io.Reader
+	err error
+}
+
+func (f closeFailingFile) Close() error {
+	return f.err
+}
+
+func TestServerTeardownErrors(t *testing.T) {
+	closeErr := errors.New("close failed")
+	startServer := func(t *testing.T) (net.Addr, chan error) {
+		errs := make(chan error, 1)
+		addr := startTestServer(t, closeFailingHandler{data: []byte("teardown"), err: closeErr},
+			WithErrorHandler(func(_ net.Addr, err error) {
+				errs <- err
+			}))
+		return addr, errs
+	}
+
+	t.Run("Errors closing the file are reported after successful transfers", func(t *testing.T) {
+		addr, errs := startServer(t)
+		if _, err := newTestPeer(t, addr).get("file.txt", ModeOctet); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if err := <-errs; !errors.Is(err, closeErr) {
+			t.Fatalf("got %v want %v", err, closeErr)
+		}
+	})
+
+	t.Run("Errors closing the file are joined to the error the transfer failed with", func(t *testing.T) {
+		addr, errs := startServer(t)
+		p := newTestPeer(t, addr)
+		p.send(&RRQPacket{Filename: "file.txt", Mode: ModeOctet})
+		if dp, ok := p.receive().(*DATAPacket); !ok || dp.BlockNumber != 1 {
+			t.Fatalf("got %#v want DATA 1", dp)
+		}
+		p.send(&ERRORPacket{ErrorCode: ErrorCodeDiskFull, ErrorMsg: "no room left"})
+
+		err := <-errs
+		if !errors.Is(err, closeErr) {
+			t.Fatalf("got %v want %v", err, closeErr)
+		}
+		if !errors.Is(err, ErrDiskFull) {
+			t.Fatalf("got %v want %v", err, ErrDiskFull)
+		}
+	})
+}
+
+// hungHandler blocks until released, ignoring the context it is given
+type hungHandler struct {
+	release chan struct{}
+	closed  chan struct{}
+}
+
+// hungFile is the stream returned by hungHandler, which signals when it is closed
+type hungFile struct {
+	io.Reader
+	closed chan struct{}
+}
+
+func (f hungFile) Close() error {
+	close(f.closed)
+	return nil
+}
+
+func (h hungHandler) ReadFile(context.Context, *Request) (io.ReadCloser, error) {
+	<-h.release
+	return hungFile{strings.NewReader("late"), h.closed}, nil
+}
+
+func (h hungHandler) WriteFile(context.Context, *Request) (io.WriteCloser, error) {
+	<-h.release
+	return nil, ErrorCodeAccessViolation
+}
+
+func TestServerHandlerTimeout(t *testing.T) {
+	t.Run("Requests not answered by the handler in time are aborted", func(t *testing.T) {
+		h := hungHandler{release: make(chan struct{}), closed: make(chan struct{})}
+		addr := startTestServer(t, h, WithHandlerTimeout(50*time.Millisecond))
+
+		_, err := newTestPeer(t, addr).get("file.bin", ModeOctet)
+		var protoErr ProtocolError
+		if !errors.As(err, &protoErr) {
+			t.Fatalf("got %v want a ProtocolError", err)
+		}
+		if protoErr.Code != ErrorCodeNotDefined || protoErr.Msg != ErrHandlerTimeout.Error() {
+			t.Fatalf("got %v %q want %v %q", protoErr.Code, protoErr.Msg, ErrorCodeNotDefined, ErrHandlerTimeout)
+		}
+
+		// The stream returned by the handler once it wakes up is released
+		close(h.release)
+		select {
+		case <-h.closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the stream returned after the timeout was not closed")
+		}
+	})
+
+	t.Run("Handlers answering in time are not affected", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.txt": []byte("hello")}), WithHandlerTimeout(time.Minute))
+		got, err := newTestPeer(t, addr).get("file.txt", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if string(got) != "hello" {
+			t.Fatalf("got %q want %q", got, "hello")
+		}
+	})
+}
+
+func TestServerBusy(t *testing.T) {
+	exhausted := func(net.Addr) (net.PacketConn, error) {
+		return nil, errors.New("no ports left")
+	}
+	tests := []struct {
+		name string
+		opts []ServerOption
+		want string
+	}{
+		{"The default message is sent when no transfer ID can be allocated", nil, DefaultBusyMessage},
+		{
+			"Configured messages are sent instead of the default one",
+			[]ServerOption{WithBusyMessage("server at capacity")},
+			"server at capacity",
+		},
+		{"Messages which are not NETASCII are ignored", []ServerOption{WithBusyMessage("lleno\xff")}, DefaultBusyMessage},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr := startTestServer(t, MapHandler(nil), append(test.opts, WithListenFunc(exhausted))...)
+			_, err := newTestPeer(t, addr).get("file.txt", ModeOctet)
+			var protoErr ProtocolError
+			if !errors.As(err, &protoErr) {
+				t.Fatalf("got %v want a ProtocolError", err)
+			}
+			if protoErr.Code != ErrorCodeNotDefined || protoErr.Msg != test.want {
+				t.Fatalf("got %v %q want %v %q", protoErr.Code, protoErr.Msg, ErrorCodeNotDefined, test.want)
+			}
+		})
+	}
+}
+
+// freePortRange returns the first of n consecutive ports available on the loopback interface
+func freePortRange(t *testing.T, n int) int {
+	t.Helper()
+	for low := 40000; low+n <= 60000; low += n {
+		free := true
+		for port := low; port < low+n && free; port++ {
+			conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port})
+			if free = err == nil; free {
+				_ = conn.Close()
+			}
+		}
+		if free {
+			return low
+		}
+	}
+	t.Skipf("can't find %d consecutive free ports", n)
+	return 0
+}
+
+func TestServerTIDRange(t *testing.T) {
+	t.Run("Transfers are carried out from ports within the range until it's exhausted", func(t *testing.T) {
+		low := freePortRange(t, 2)
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": []byte("in range")}),
+			WithTIDRange(low, low+1))
+
+		// Keep two transfers open by not acknowledging their first block
+		ports := make(map[int]bool)
+		var open []*testPeer
+		for i := 0; i < 2; i++ {
+			p := newTestPeer(t, addr)
+			p.send(&RRQPacket{Filename: "file.bin", Mode: ModeOctet})
+			if dp, ok := p.receive().(*DATAPacket); !ok || dp.BlockNumber != 1 {
+				t.Fatalf("got %#v want DATA 1", dp)
+			}
+			ports[p.remote.(*net.UDPAddr).Port] = true
+			open = append(open, p)
+		}
+		if !ports[low] || !ports[low+1] {
+			t.Fatalf("got transfers from ports %v want %v and %v", ports, low, low+1)
+		}
+
+		_, err := newTestPeer(t, addr).get("file.bin", ModeOctet)
+		var protoErr ProtocolError
+		if !errors.As(err, &protoErr) || protoErr.Code != ErrorCodeNotDefined || protoErr.Msg != DefaultBusyMessage {
+			t.Fatalf("got %v want %v %q", err, ErrorCodeNotDefined, DefaultBusyMessage)
+		}
+
+		// Ports are available again once transfers complete
+		open[0].send(&ACKPacket{BlockNumber: 1})
+		for deadline := time.Now().Add(time.Second); ; {
+			got, err := newTestPeer(t, addr).get("file.bin", ModeOctet)
+			if err == nil {
+				if string(got) != "in range" {
+					t.Fatalf("got %q want %q", got, "in range")
+				}
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("Listening fails once every port in the range is in use", func(t *testing.T) {
+		low := freePortRange(t, 1)
+		listen := listenUDPRange(low, low)
+		local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+		conn, err := listen(local)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		defer conn.Close()
+		if port := conn.LocalAddr().(*net.UDPAddr).Port; port != low {
+			t.Fatalf("got port %v want %v", port, low)
+		}
+		if _, err := listen(local); err != ErrTIDRangeExhausted {
+			t.Fatalf("got %v want %v", err, ErrTIDRangeExhausted)
+		}
+	})
+}
+
+func TestServerIllegalRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		pkt  Packet
+	}{
+		{"DATA", &DATAPacket{BlockNumber: 1, Data: []byte("stray")}},
+		{"ACK", &ACKPacket{BlockNumber: 1}},
+		{"OACK", &OACKPacket{Options: []Option{{Name: "tsize", Value: "0"}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name+" packets sent to the server are answered with an ERROR", func(t *testing.T) {
+			p := newTestPeer(t, startTestServer(t, MapHandler(nil)))
+			p.send(test.pkt)
+
+			pkt, ok := p.receive().(*ERRORPacket)
+			if !ok {
+				t.Fatalf("got %#v want an ERROR packet", pkt)
+			}
+			if pkt.ErrorCode != ErrorCodeIllegalOp {
+				t.Fatalf("got error code %v want %v", pkt.ErrorCode, ErrorCodeIllegalOp)
+			}
+		})
+	}
+
+	t.Run("Packets with unknown opcodes are answered with an ERROR", func(t *testing.T) {
+		p := newTestPeer(t, startTestServer(t, MapHandler(nil)))
+		if _, err := p.conn.WriteTo([]byte("\x00\x2Abogus"), p.remote); err != nil {
+			t.Fatal(err)
+		}
+
+		pkt, ok := p.receive().(*ERRORPacket)
+		if !ok {
+			t.Fatalf("got %#v want an ERROR packet", pkt)
+		}
+		if pkt.ErrorCode != ErrorCodeIllegalOp {
+			t.Fatalf("got error code %v want %v", pkt.ErrorCode, ErrorCodeIllegalOp)
+		}
+	})
+}
+
+func TestServerLegacyOnly(t *testing.T) {
+	t.Run("Legacy-only servers ignore the requested options", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": []byte("data")}), WithLegacyOnly())
+		p := newTestPeer(t, addr)
+		p.send(&RRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{Name: "blksize", Value: "1024"}}})
+		pkt, ok := p.receive().(*DATAPacket)
+		if !ok || pkt.BlockNumber != 1 || string(pkt.Data) != "data" {
+			t.Fatalf("got %#v want DATA 1", pkt)
+		}
+		p.send(&ACKPacket{BlockNumber: 1})
+	})
+}
+
+func TestServerMaxFileSize(t *testing.T) {
+	t.Run("Uploads declaring a size over the limit are refused right away", func(t *testing.T) {
+		// The handler would refuse the request with a different error code if it were called
+		addr := startTestServer(t, deniedHandler{}, WithMaxFileSize(1000))
+		p := newTestPeer(t, addr)
+		p.send(&WRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{Name: "tsize", Value: "1001"}}})
+		pkt, ok := p.receive().(*ERRORPacket)
+		if !ok || pkt.ErrorCode != ErrorCodeDiskFull {
+			t.Fatalf("got %#v want ERROR %v", pkt, ErrorCodeDiskFull)
+		}
+	})
+
+	t.Run("Uploads exceeding the limit are aborted", func(t *testing.T) {
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		addr := startTestServer(t, h, WithMaxFileSize(1000))
+		err := newTestPeer(t, addr).put("file.bin", ModeOctet, bytes.Repeat([]byte("F"), 1001))
+		if !errors.Is(err, ErrorCodeDiskFull) {
+			t.Fatalf("got %v want %v", err, ErrorCodeDiskFull)
+		}
+	})
+
+	t.Run("Uploads within the limit are stored", func(t *testing.T) {
+		want := bytes.Repeat([]byte("F"), 1000)
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		addr := startTestServer(t, h, WithMaxFileSize(1000))
+		c := newTestClient(t)
+		if err := c.Put(context.Background(), addr.String(), "file.bin", ModeOctet, bytes.NewReader(want)); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if got := readMapFile(t, h, "file.bin"); !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes want %d", len(got), len(want))
+		}
+	})
+
+	t.Run("Clients declaring a size over the limit are told the upload is too large", func(t *testing.T) {
+		addr := startTestServer(t, deniedHandler{}, WithMaxFileSize(1000))
+		c := newTestClient(t)
+		err := c.Put(context.Background(), addr.String(), "file.bin", ModeOctet, bytes.NewReader(make([]byte, 1001)))
+		if !errors.Is(err, ErrUploadTooLarge) {
+			t.Fatalf("got %v want %v", err, ErrUploadTooLarge)
+		}
+	})
+}
+
+// writeFailingHandler accepts uploads whose writes fail once a number of blocks has been written
+type writeFailingHandler struct {
+	blocks  int
+	err     error
+	uploads chan *writeFailingUpload
+}
+
+func (h writeFailingHandler) ReadFile(context.Context, *Request) (io.ReadCloser, error) {
+	return nil, ErrorCodeFileNotFound
+}
+
+func (h writeFailingHandler) WriteFile(context.Context, *Request) (io.WriteCloser, error) {
+	u := &writeFailingUpload{blocks: h.blocks, err: h.err}
+	h.uploads <- u
+	return u, nil
+}
+
+type writeFailingUpload struct {
+	blocks int
+	err    error
+
+	mu          sync.Mutex
+	closeErr    error
+	closeCalled bool
+}
+
+func (u *writeFailingUpload) Write(p []byte) (int, error) {
+	if u.blocks == 0 {
+		return 0, u.err
+	}
+	u.blocks--
+	return len(p), nil
+}
+
+func (u *writeFailingUpload) Close() error {
+	return u.CloseWithError(nil)
+}
+
+func (u *writeFailingUpload) CloseWithError(err error) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closeCalled, u.closeErr = true, err
+	return nil
+}
+
+func TestServerWriteFailure(t *testing.T) {
+	t.Run("Uploads failing to be written are aborted with a disk full error and discarded", func(t *testing.T) {
+		writeErr := errors.New("no space left on device")
+		h := writeFailingHandler{blocks: 1, err: writeErr, uploads: make(chan *writeFailingUpload, 1)}
+		addr := startTestServer(t, h)
+
+		p := newTestPeer(t, addr)
+		p.send(&WRQPacket{Filename: "file.bin", Mode: ModeOctet})
+		expectACK(t, p, 0)
+		block := bytes.Repeat([]byte("W"), DefaultBlockSize)
+		p.send(&DATAPacket{BlockNumber: 1, Data: block})
+		expectACK(t, p, 1)
+		p.send(&DATAPacket{BlockNumber: 2, Data: block})
+		pkt, ok := p.receive().(*ERRORPacket)
+		if !ok || pkt.ErrorCode != ErrorCodeDiskFull {
+			t.Fatalf("got %#v want ERROR %v", pkt, ErrorCodeDiskFull)
+		}
+
+		// No other datagram follows
+		if err := p.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		if n, _, err := p.conn.ReadFrom(make([]byte, maxDatagramSize)); err == nil {
+			t.Fatalf("got an extra datagram of %d bytes", n)
+		}
+
+		u := <-h.uploads
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		if !u.closeCalled || !errors.Is(u.closeErr, writeErr) || !errors.Is(u.closeErr, ErrorCodeDiskFull) {
+			t.Fatalf("got the upload closed with %v want %v", u.closeErr, writeErr)
+		}
+	})
+
+	t.Run("Write errors carrying an error code are reported as is", func(t *testing.T) {
+		h := writeFailingHandler{blocks: 0, err: ErrorCodeAccessViolation, uploads: make(chan *writeFailingUpload, 1)}
+		addr := startTestServer(t, h)
+		if err := newTestPeer(t, addr).put("file.bin", ModeOctet, []byte("data")); !errors.Is(err, ErrorCodeAccessViolation) {
+			t.Fatalf("got %v want %v", err, ErrorCodeAccessViolation)
+		}
+	})
+}
+
+func TestServerResume(t *testing.T) {
+	file := make([]byte, 2000)
+	for i := range file {
+		file[i] = byte(i)
+	}
+	rrq := &RRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{Name: "resumeoffset", Value: "1024"}}}
+
+	t.Run("Downloads are resumed from the requested offset", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": file}), WithResume())
+		p := newTestPeer(t, addr)
+		p.send(rrq)
+		oack, ok := p.receive().(*OACKPacket)
+		if !ok {
+			t.Fatalf("got %#v want an OACK", oack)
+		}
+		if value, _ := findOption(oack.Options, "resumeoffset"); value != "1024" {
+			t.Fatalf("got resumeoffset %q want %q", value, "1024")
+		}
+		p.send(&ACKPacket{BlockNumber: 0})
+
+		got := bytes.Buffer{}
+		for block := uint16(3); ; block++ {
+			pkt, ok := p.receive().(*DATAPacket)
+			if !ok || pkt.BlockNumber != block {
+				t.Fatalf("got %#v want DATA %d", pkt, block)
+			}
+			got.Write(pkt.Data)
+			p.send(&ACKPacket{BlockNumber: block})
+			if len(pkt.Data) < DefaultBlockSize {
+				break
+			}
+		}
+		if !bytes.Equal(got.Bytes(), file[1024:]) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(file)-1024)
+		}
+	})
+
+	t.Run("Offsets which are not a multiple of the block size are ignored", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": file}), WithResume())
+		p := newTestPeer(t, addr)
+		p.send(&RRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{Name: "resumeoffset", Value: "1000"}}})
+		if pkt, ok := p.receive().(*DATAPacket); !ok || pkt.BlockNumber != 1 {
+			t.Fatalf("got %#v want DATA 1", pkt)
+		}
+	})
+
+	t.Run("Downloads can't be resumed unless enabled", func(t *testing.T) {
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": file}))
+		p := newTestPeer(t, addr)
+		p.send(rrq)
+		if pkt, ok := p.receive().(*DATAPacket); !ok || pkt.BlockNumber != 1 {
+			t.Fatalf("got %#v want DATA 1", pkt)
+		}
+	})
+}
+
+func TestServerMaxSessionsPerClient(t *testing.T) {
+	addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": []byte("data")}), WithMaxSessionsPerClient(1))
+
+	// Leave the first transfer waiting for an acknowledgement
+	first := newTestPeer(t, addr)
+	first.send(&RRQPacket{Filename: "file.bin", Mode: ModeOctet})
+	if pkt, ok := first.receive().(*DATAPacket); !ok || pkt.BlockNumber != 1 {
+		t.Fatalf("got %#v want DATA 1", pkt)
+	}
+
+	t.Run("Requests from clients at their limit are refused", func(t *testing.T) {
+		_, err := newTestPeer(t, addr).get("file.bin", ModeOctet)
+		var protocolErr ProtocolError
+		if !errors.As(err, &protocolErr) || protocolErr.Msg != DefaultBusyMessage {
+			t.Fatalf("got %v want %q", err, DefaultBusyMessage)
+		}
+	})
+
+	t.Run("Requests from other clients are served", func(t *testing.T) {
+		conn, err := net.ListenPacket("udp", "127.0.0.2:0")
+		if err != nil {
+			t.Skipf("can't listen on a second loopback address: %v", err)
+		}
+		got, err := newTestPeerConn(t, conn, addr).get("file.bin", ModeOctet)
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if string(got) != "data" {
+			t.Fatalf("got %q want %q", got, "data")
+		}
+	})
+
+	t.Run("Clients may start new transfers once theirs are complete", func(t *testing.T) {
+		first.send(&ACKPacket{BlockNumber: 1})
+		// The session ends once the final acknowledgement is received
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			_, err := newTestPeer(t, addr).get("file.bin", ModeOctet)
+			if err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got an error but didn't want one: %v", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+}
+
+func TestServerQuietStart(t *testing.T) {
+	var mu sync.Mutex
+	sockets := 0
+	listen := func(local net.Addr) (net.PacketConn, error) {
+		mu.Lock()
+		sockets++
+		mu.Unlock()
+		return listenUDP(local)
+	}
+	s := NewServer(MapHandler(map[string][]byte{"file.bin": []byte("data")}), WithListenFunc(listen), ReadOnly())
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = s.Serve(conn)
+	}()
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+	addr := conn.LocalAddr()
+
+	t.Run("Invalid and unauthorized requests get no session", func(t *testing.T) {
+		requests := []Packet{
+			&RRQPacket{Filename: "file.bin", Mode: "mail"},
+			&WRQPacket{Filename: "file.bin", Mode: ModeOctet},
+		}
+		p := newTestPeer(t, addr)
+		for i := 0; i < 100; i++ {
+			for _, request := range requests {
+				p.send(request)
+				if pkt, ok := p.receive().(*ERRORPacket); !ok {
+					t.Fatalf("got %#v want an ERROR packet", pkt)
+				}
+			}
+			// Malformed requests
+			if _, err := p.conn.WriteTo([]byte{0, byte(RRQ), 'f'}, addr); err != nil {
+				t.Fatal(err)
+			}
+			if pkt, ok := p.receive().(*ERRORPacket); !ok || pkt.ErrorCode != ErrorCodeIllegalOp {
+				t.Fatalf("got %#v want ERROR %v", pkt, ErrorCodeIllegalOp)
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if sockets != 0 {
+			t.Fatalf("got %d session sockets want none", sockets)
+		}
+		if n := s.Sessions(); n != 0 {
+			t.Fatalf("got %d sessions want none", n)
+		}
+	})
+
+	t.Run("Valid requests get a session", func(t *testing.T) {
+		p := newTestPeer(t, addr)
+		p.send(&RRQPacket{Filename: "file.bin", Mode: ModeOctet})
+		if pkt, ok := p.receive().(*DATAPacket); !ok || pkt.BlockNumber != 1 {
+			t.Fatalf("got %#v want DATA 1", pkt)
+		}
+		if n := s.Sessions(); n != 1 {
+			t.Fatalf("got %d sessions want 1", n)
+		}
+		p.send(&ACKPacket{BlockNumber: 1})
+
+		mu.Lock()
+		defer mu.Unlock()
+		if sockets != 1 {
+			t.Fatalf("got %d session sockets want 1", sockets)
+		}
+	})
+}
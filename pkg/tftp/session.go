@@ -0,0 +1,709 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTimeout          = errors.New("timed out waiting for the peer")
+	ErrUnexpectedPacket = errors.New("received an unexpected packet")
+	ErrUnexpectedBlock  = errors.New("received a block out of sequence")
+	// ErrTransferTooLong is returned when a transfer takes longer than allowed by MaxTransferDuration
+	ErrTransferTooLong = fmt.Errorf("%w: transfer took longer than allowed", ErrTimeout)
+	// ErrDataAfterFinalBlock is returned when final blocks are checked strictly and the peer keeps sending blocks after
+	// one shorter than the block size, which should have been the final one
+	ErrDataAfterFinalBlock = errors.New("received a block after the final one")
+	// ErrPeerUnreachable is returned when the system reports that the peer is gone, usually because an ICMP port
+	// unreachable message was received in reply to a datagram sent to it
+	ErrPeerUnreachable = errors.New("peer unreachable")
+)
+
+const (
+	// DefaultTimeout is the time to wait for a packet before retransmitting the last one
+	DefaultTimeout = 5 * time.Second
+	// DefaultRetries is the number of retransmissions attempted before giving up on a transfer
+	DefaultRetries = 5
+	// DefaultDallyTimeout is the time the server lingers once an upload is complete, in case the final ACK is lost
+	DefaultDallyTimeout = DefaultTimeout
+	// DefaultMaxBlockAnomalies is the number of blocks jumping backward tolerated before giving up on a transfer
+	DefaultMaxBlockAnomalies = 5
+)
+
+// maxDatagramSize is the size of the buffer used to receive datagrams, large enough to hold any UDP payload
+const maxDatagramSize = 65536
+
+// errRetransmit is returned by receive when no packet arrives in time
+var errRetransmit = errors.New("retransmission timeout")
+
+// session holds the state of a single transfer with a remote transfer ID.
+//
+// A session is driven by a single goroutine: retransmissions are triggered by read deadlines expiring rather than by
+// timers running on their own, so the last datagram sent can't be accessed concurrently and needs no locking.
+type session struct {
+	conn     net.PacketConn
+	peer     net.Addr
+	locked   bool // Whether the peer's transfer ID is known
+	looseTID bool // Whether packets from any port of the peer's host are accepted
+	timeout  time.Duration
+	retries  int
+	// Time after which the transfer is aborted regardless of its progress, if any, as told by now
+	expiry time.Time
+	now    func() time.Time
+
+	// Size of the data carried by every DATA packet but the last one, as per RFC 2348
+	blockSize int
+	// Largest block size agreed to when negotiating options
+	maxBlockSize int
+	// Number of consecutive blocks sent before waiting for an acknowledgement, as per RFC 7440
+	windowSize int
+	// Largest window agreed to when negotiating options
+	maxWindowSize int
+	// Block number following 65535
+	rollover BlockRollover
+	// Whether requested options are ignored, as per RFC 1350
+	legacyOnly bool
+	// Whether blocks received after the final one are reported as errors
+	strictFinalBlock bool
+	// Number of blocks received from far behind the current one tolerated before aborting the transfer
+	maxBlockAnomalies int
+	// Whether downloads may be resumed with the resumeoffset option
+	resumable bool
+	// Number of the first block transferred, which follows the blocks skipped when resuming a download
+	firstBlock uint16
+	// Options acknowledged in the OACK, if any
+	options []Option
+	// Whether the peer acknowledged options with an OACK, which may be retransmitted after the transfer has started
+	oack bool
+	// Limiter pacing the DATA packets sent, if any
+	limiter *bandwidthLimiter
+	// Writer sending windows of DATA packets at once, if supported by the socket
+	batch batchWriter
+
+	last   []byte  // Last datagram sent, kept for retransmission
+	buf    []byte  // Receive buffer
+	queued Packet  // Packet received ahead of time, returned by the next call to receive
+	ack    [4]byte // ACK datagram, rewritten in place for every block acknowledged
+	failed bool    // Whether the transfer has been aborted
+	closed bool    // Whether the socket has been closed
+
+	state     State
+	stateHook func(peer net.Addr, state State)
+
+	bytes       int64  // Bytes of file data sent or received
+	blocks      uint64 // Blocks sent or received, not counting retransmissions
+	retransmits int    // Retransmissions triggered by timeouts
+}
+
+func newSession(conn net.PacketConn, peer net.Addr, cfg transferConfig) *session {
+	s := &session{
+		conn:              conn,
+		peer:              peer,
+		locked:            true,
+		timeout:           cfg.timeout,
+		retries:           cfg.retries,
+		blockSize:         DefaultBlockSize,
+		maxBlockSize:      maxBlockSize,
+		windowSize:        1,
+		maxWindowSize:     maxWindowSize,
+		rollover:          cfg.rollover,
+		legacyOnly:        cfg.legacyOnly,
+		strictFinalBlock:  cfg.strictFinalBlock,
+		resumable:         cfg.resumable,
+		maxBlockAnomalies: cfg.maxBlockAnomalies,
+		firstBlock:        1,
+		buf:               make([]byte, maxDatagramSize),
+		now:               time.Now,
+		state:             StateHandshake,
+		stateHook:         cfg.stateHook,
+		batch:             newBatchWriter(conn),
+	}
+	if s.stateHook != nil {
+		s.stateHook(peer, StateHandshake)
+	}
+	if cfg.maxDuration > 0 {
+		s.expiry = s.now().Add(cfg.maxDuration)
+	}
+	return s
+}
+
+// sessionDATA is a DATA packet sent within a session, whose block number may have rolled over to 0 and whose data may
+// be as large as the negotiated block size
+type sessionDATA struct {
+	*DATAPacket
+	blockSize int
+}
+
+func (p sessionDATA) Marshal(w io.Writer) error {
+	return p.marshal(w, true, p.blockSize)
+}
+
+// parse behaves like ParsePacket, but accepts DATA packets for block 0, which follow block 65535 when block numbers
+// roll over to 0, and DATA packets as large as the negotiated block size. Blocks out of sequence are detected by the
+// session
+func (s *session) parse(b []byte) (Packet, error) {
+	if len(b) >= 2 && Opcode(binary.BigEndian.Uint16(b)) == DATA {
+		p := &DATAPacket{}
+		if err := p.unmarshalBytes(b, true, s.blockSize); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	return ParsePacket(b)
+}
+
+// nextBlock returns the block number following block, rolling over as negotiated
+func (s *session) nextBlock(block uint16) uint16 {
+	if block == math.MaxUint16 && s.rollover == RolloverToOne {
+		return 1
+	}
+	return block + 1
+}
+
+// blockAfter returns the number of the block following the given number of blocks, rolling over as negotiated
+func (s *session) blockAfter(blocks int64) uint16 {
+	if s.rollover == RolloverToOne {
+		return uint16(1 + blocks%math.MaxUint16)
+	}
+	return uint16(1 + blocks)
+}
+
+// sameAddr reports whether a and b refer to the same transfer ID
+func sameAddr(a, b net.Addr) bool {
+	ua, okA := a.(*net.UDPAddr)
+	ub, okB := b.(*net.UDPAddr)
+	if okA && okB {
+		return ua.Port == ub.Port && ua.IP.Equal(ub.IP) && ua.Zone == ub.Zone
+	}
+	return a.Network() == b.Network() && a.String() == b.String()
+}
+
+// netError describes an error returned by the socket. Since retransmitting is pointless once the peer is known to be
+// unreachable, such errors are reported as ErrPeerUnreachable so that the transfer is terminated right away
+func netError(msg string, err error) error {
+	if isConnRefused(err) {
+		err = fmt.Errorf("%w: %v", ErrPeerUnreachable, err)
+	}
+	return NewIOError(msg, err)
+}
+
+// sendPacket marshals p and sends it to addr in a single datagram, outside of any session
+func sendPacket(conn net.PacketConn, addr net.Addr, p Packet) error {
+	buf := bytes.Buffer{}
+	if err := p.Marshal(&buf); err != nil {
+		return err
+	}
+	if _, err := conn.WriteTo(buf.Bytes(), addr); err != nil {
+		return netError("can't send datagram", err)
+	}
+	return nil
+}
+
+// sameHost reports whether a and b refer to transfer IDs on the same host
+func sameHost(a, b net.Addr) bool {
+	ua, okA := a.(*net.UDPAddr)
+	ub, okB := b.(*net.UDPAddr)
+	return okA && okB && ua.IP.Equal(ub.IP) && ua.Zone == ub.Zone
+}
+
+// send marshals p and sends it to the peer in a single datagram
+func (s *session) send(p Packet) error {
+	if err := s.prepare(p); err != nil {
+		return err
+	}
+	return s.resend()
+}
+
+// prepare marshals p and keeps it as the datagram to be sent on the next retransmission, without sending it yet
+func (s *session) prepare(p Packet) error {
+	buf := bytes.Buffer{}
+	if err := p.Marshal(&buf); err != nil {
+		return err
+	}
+	s.last = buf.Bytes()
+	return nil
+}
+
+// prepareACK behaves like prepare for the acknowledgement of the given block. Since acknowledgements only differ in
+// their block number, a single buffer is reused for all of them
+func (s *session) prepareACK(block uint16) {
+	binary.BigEndian.PutUint16(s.ack[:], uint16(ACK))
+	binary.BigEndian.PutUint16(s.ack[2:], block)
+	s.last = s.ack[:]
+}
+
+// sendACK acknowledges the given block
+func (s *session) sendACK(block uint16) error {
+	s.prepareACK(block)
+	return s.resend()
+}
+
+// resend sends the last datagram again
+func (s *session) resend() error {
+	if _, err := s.conn.WriteTo(s.last, s.peer); err != nil {
+		return netError("can't send datagram", err)
+	}
+	return nil
+}
+
+// fail aborts the transfer, reporting the given error code and message to the peer. The returned error describes the
+// failure
+func (s *session) fail(code ErrorCode, msg string) error {
+	return s.abort(ProtocolError{Code: code, Msg: msg})
+}
+
+// abort notifies the peer that the transfer is being aborted because of err, and closes the socket. Only the first
+// call has any effect, so that a single ERROR packet is ever sent. This is done on a best-effort basis and nothing is
+// awaited afterwards, since ERROR packets are neither acknowledged nor retransmitted. err is returned, joined with any
+// errors sending the ERROR packet or closing the socket
+func (s *session) abort(err error) error {
+	if s.failed {
+		return err
+	}
+	s.failed = true
+	sendErr := s.send(ErrorPacketFromError(err))
+	return joinErrors(err, sendErr, s.close())
+}
+
+// close closes the socket, unless it has already been closed
+func (s *session) close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.setState(StateClosed)
+	if err := s.conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return NewIOError("can't close socket", err)
+	}
+	return nil
+}
+
+// joinErrors returns err joined with the errors in errs that are not nil. Should they all be nil, err is returned as
+// is, so that it can still be compared directly
+func joinErrors(err error, errs ...error) error {
+	joined := &joinedError{}
+	for _, e := range append([]error{err}, errs...) {
+		if e != nil {
+			joined.errs = append(joined.errs, e)
+		}
+	}
+	switch len(joined.errs) {
+	case 0:
+		return nil
+	case 1:
+		return joined.errs[0]
+	}
+	return joined
+}
+
+// joinedError is an error made up of several ones, whose messages are listed one per line. errors.Is and errors.As
+// match any of them, even on Go versions predating errors.Join
+type joinedError struct {
+	errs []error
+}
+
+func (e *joinedError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unwrap returns the errors joined
+func (e *joinedError) Unwrap() []error {
+	return e.errs
+}
+
+// Is reports whether any of the errors joined matches target
+func (e *joinedError) Is(target error) bool {
+	for _, err := range e.errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// As finds the first of the errors joined that matches target
+func (e *joinedError) As(target interface{}) bool {
+	for _, err := range e.errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// receive waits for the next packet sent by the peer. Datagrams coming from other transfer IDs are answered with an
+// ERROR packet and discarded. Packets with unknown opcodes, as well as OACKs received once a transfer without options
+// has started, abort the transfer with ErrorCodeIllegalOp. If nothing is received before the timeout expires,
+// errRetransmit is returned
+func (s *session) receive() (Packet, error) {
+	return s.receiveUntil(time.Now().Add(s.timeout))
+}
+
+// receiveUntil behaves like receive, but waits until the given deadline rather than for the timeout. Once the transfer
+// has taken longer than allowed, it's aborted and ErrTransferTooLong is returned instead
+func (s *session) receiveUntil(deadline time.Time) (Packet, error) {
+	if s.expired() {
+		return nil, s.abort(ErrTransferTooLong)
+	}
+	if !s.expiry.IsZero() {
+		// The expiry follows the session's clock, whereas socket deadlines follow the wall clock
+		if limit := time.Now().Add(s.expiry.Sub(s.now())); limit.Before(deadline) {
+			deadline = limit
+		}
+	}
+	if p := s.queued; p != nil {
+		s.queued = nil
+		return p, nil
+	}
+
+	if err := s.conn.SetReadDeadline(deadline); err != nil {
+		return nil, NewIOError("can't set read deadline", err)
+	}
+
+	for {
+		n, addr, err := s.conn.ReadFrom(s.buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if s.expired() {
+					return nil, s.abort(ErrTransferTooLong)
+				}
+				return nil, errRetransmit
+			}
+			return nil, netError("can't receive datagram", err)
+		}
+
+		if !s.locked && sameHost(addr, s.peer) {
+			// The peer replies to a request from the transfer ID it has chosen for the rest of the transfer
+			s.peer = addr
+			s.locked = true
+		}
+
+		if !sameAddr(addr, s.peer) && !(s.looseTID && sameHost(addr, s.peer)) {
+			// Let the stranger know, but do not disturb the transfer
+			_ = sendPacket(s.conn, addr, ErrorPacketFromError(ErrorCodeUnknownTransferID))
+			continue
+		}
+
+		p, err := s.parse(s.buf[:n])
+		if err != nil {
+			_ = s.fail(ErrorCodeIllegalOp, err.Error())
+			return nil, err
+		}
+		if p, ok := p.(*ERRORPacket); ok {
+			return nil, p.AsError()
+		}
+		if _, ok := p.(*OACKPacket); ok && s.state == StateTransferring && !s.oack {
+			// OACKs may only be retransmitted once the transfer has started, if options were negotiated at all
+			return nil, s.abort(fmt.Errorf("%w: OACK without negotiated options", ErrUnexpectedPacket))
+		}
+		return p, nil
+	}
+}
+
+// expired reports whether the transfer has taken longer than allowed
+func (s *session) expired() bool {
+	return !s.expiry.IsZero() && !s.now().Before(s.expiry)
+}
+
+// await receives packets, retransmitting the last datagram on timeouts, until accept reports that the expected
+// packet has arrived or returns an error
+func (s *session) await(accept func(p Packet) (bool, error)) error {
+	return s.awaitRetransmitting(s.resend, accept)
+}
+
+// awaitRetransmitting behaves like await, but calls retransmit on timeouts instead of sending the last datagram again
+func (s *session) awaitRetransmitting(retransmit func() error, accept func(p Packet) (bool, error)) error {
+	for attempt := 0; ; {
+		p, err := s.receive()
+		if err == errRetransmit {
+			if attempt == s.retries {
+				return ErrTimeout
+			}
+			attempt++
+			s.retransmits++
+			if err := retransmit(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if done, err := accept(p); err != nil || done {
+			return err
+		}
+	}
+}
+
+// awaitACK waits for the acknowledgement of the given block, retransmitting the last datagram if needed
+func (s *session) awaitACK(block uint16) error {
+	return s.await(func(p Packet) (bool, error) {
+		ack, ok := p.(*ACKPacket)
+		if !ok {
+			return false, s.abort(fmt.Errorf("%w: expected ACK", ErrUnexpectedPacket))
+		}
+		// Acknowledgements for previous blocks are ignored, since retransmitting upon their reception would trigger
+		// the Sorcerer's Apprentice Syndrome
+		return ack.BlockNumber == block, nil
+	})
+}
+
+// sendFile transfers the contents of r to the peer as a sequence of DATA packets. Up to a window of blocks is sent
+// before waiting for an acknowledgement, which acknowledges the block it refers to as well as every block before it.
+// As per RFC 7440, should the peer acknowledge a block other than the last one of the window, the blocks following it
+// are sent again
+func (s *session) sendFile(r io.Reader) error {
+	s.setState(StateTransferring)
+	window := make([][]byte, 0, s.windowSize) // Datagrams sent and not acknowledged yet
+	spare := make([][]byte, 0, s.windowSize)  // Buffers of acknowledged datagrams, reused for the following blocks
+	block := s.firstBlock                     // Number of the next block to be read
+	rolledBack := false                       // Whether the window was sent again as its first block was lost
+	eof := false
+
+	send := func(datagrams [][]byte) error {
+		if len(datagrams) == 0 {
+			return nil
+		}
+		s.last = datagrams[len(datagrams)-1]
+		if s.batch != nil && s.limiter == nil && len(datagrams) > 1 {
+			// Send as many datagrams as possible at once, and the rest one by one
+			n, err := s.batch.writeBatch(datagrams, s.peer)
+			if err != nil {
+				return netError("can't send datagrams", err)
+			}
+			datagrams = datagrams[n:]
+		}
+		for _, datagram := range datagrams {
+			if s.limiter != nil {
+				s.limiter.wait(len(datagram) - 4)
+			}
+			if _, err := s.conn.WriteTo(datagram, s.peer); err != nil {
+				return netError("can't send datagram", err)
+			}
+		}
+		return nil
+	}
+	sendWindow := func() error {
+		return send(window)
+	}
+
+	for {
+		// Fill the window with the following blocks, and send them
+		filled := len(window)
+		for !eof && len(window) < s.windowSize {
+			var buf []byte
+			if n := len(spare); n > 0 {
+				buf, spare = spare[n-1], spare[:n-1]
+			} else {
+				buf = make([]byte, 4+s.blockSize)
+			}
+			binary.BigEndian.PutUint16(buf, uint16(DATA))
+			binary.BigEndian.PutUint16(buf[2:], block)
+
+			n, err := io.ReadFull(r, buf[4:cap(buf)])
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return s.abort(err)
+			}
+			eof = n < s.blockSize
+			window = append(window, buf[:4+n])
+			s.bytes += int64(n)
+			s.blocks++
+			block = s.nextBlock(block)
+		}
+		if err := send(window[filled:]); err != nil {
+			return err
+		}
+		if len(window) == 0 {
+			return nil
+		}
+
+		acked := 0
+		err := s.awaitRetransmitting(sendWindow, func(p Packet) (bool, error) {
+			if _, ok := p.(*OACKPacket); ok && s.oack {
+				// A late retransmission of the OACK, which stands for an ACK of block 0
+				return false, nil
+			}
+			ack, ok := p.(*ACKPacket)
+			if !ok {
+				return false, s.abort(fmt.Errorf("%w: expected ACK", ErrUnexpectedPacket))
+			}
+			for i, datagram := range window {
+				if binary.BigEndian.Uint16(datagram[2:]) == ack.BlockNumber {
+					acked = i + 1
+					return true, nil
+				}
+			}
+			if s.windowSize > 1 && !rolledBack && ack.BlockNumber == binary.BigEndian.Uint16(window[0][2:])-1 {
+				// The peer acknowledged the block preceding the window again, which is how it reports having lost the
+				// first block of the window. Send the window again right away rather than waiting for a timeout, but
+				// only once per window: in lock-step transfers, or for duplicated acknowledgements, doing so would
+				// trigger the Sorcerer's Apprentice Syndrome
+				rolledBack = true
+				return true, nil
+			}
+			// Acknowledgements for blocks before the window are ignored, since retransmitting upon their reception
+			// would trigger the Sorcerer's Apprentice Syndrome
+			return false, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// Slide the window past the acknowledged block
+		if acked > 0 {
+			rolledBack = false
+		}
+		spare = append(spare, window[:acked]...)
+		window = append(window[:0], window[acked:]...)
+		if err := sendWindow(); err != nil {
+			return err
+		}
+	}
+}
+
+// receiveFile writes the contents of the DATA packets sent by the peer to w, acknowledging them. The last datagram
+// sent by the session must be the one prompting the peer to send the first block (i.e. a RRQ, ACK 0 or OACK).
+// Once the final block has been written, commit is called before acknowledging it, so that the peer is only told
+// about the success of the transfer if the data could be stored.
+//
+// Blocks are acknowledged once per window. Since datagrams may be lost or reordered, blocks arriving ahead of the next
+// expected one are kept until the gap is filled, and the last block received in order is acknowledged immediately so
+// that the sender rolls back and resends the missing ones
+func (s *session) receiveFile(w io.Writer, commit func() error) error {
+	s.setState(StateTransferring)
+	next := s.firstBlock               // Next block to be written
+	acked := next - 1                  // Last block acknowledged
+	pending := make(map[uint16][]byte) // Blocks received ahead of the next one
+	gap := false                       // Whether a gap has been reported to the sender and not filled yet
+	anomalies := 0                     // Blocks received from far behind the last window
+
+	ack := func(block uint16) error {
+		acked = block
+		return s.sendACK(block)
+	}
+
+	for {
+		var dp *DATAPacket
+		err := s.await(func(p Packet) (bool, error) {
+			if _, ok := p.(*OACKPacket); ok && s.oack {
+				// The peer retransmitted the OACK before getting our ACK of block 0. Acknowledge it again, leaving the
+				// last datagram as is
+				return false, sendPacket(s.conn, s.peer, &ACKPacket{BlockNumber: 0})
+			}
+			var ok bool
+			if dp, ok = p.(*DATAPacket); !ok {
+				return false, s.abort(fmt.Errorf("%w: expected DATA", ErrUnexpectedPacket))
+			}
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if offset := dp.BlockNumber - next; offset != 0 {
+			switch {
+			case offset < uint16(s.windowSize):
+				// Keep the block for later and report the gap, unless we have already done so
+				pending[dp.BlockNumber] = dp.Data
+				if !gap {
+					gap = true
+					if err := ack(next - 1); err != nil {
+						return err
+					}
+				}
+			case dp.BlockNumber == acked:
+				// Our last acknowledgement was lost, send it again
+				if err := s.resend(); err != nil {
+					return err
+				}
+			case int16(offset) < 0 && next-dp.BlockNumber > uint16(s.windowSize):
+				// A block far behind the last window. The peer is either confused or not the sender it claims to be,
+				// so it's told where to resume from, and given up on if it keeps doing so
+				if anomalies++; anomalies > s.maxBlockAnomalies {
+					return s.abort(ErrUnexpectedBlock)
+				}
+				if err := ack(next - 1); err != nil {
+					return err
+				}
+			case next-dp.BlockNumber > uint16(s.windowSize):
+				// Neither a retransmission of the last window nor a block within the current one
+				return s.abort(ErrUnexpectedBlock)
+			}
+			continue
+		}
+
+		// Write this block and any blocks following it that arrived earlier
+		for data := dp.Data; ; {
+			if _, err := w.Write(data); err != nil {
+				return s.abort(err)
+			}
+			next = s.nextBlock(next)
+			s.bytes += int64(len(data))
+			s.blocks++
+
+			if len(data) < s.blockSize {
+				if err := commit(); err != nil {
+					return s.abort(err)
+				}
+				return ack(next - 1)
+			}
+
+			var ok bool
+			if data, ok = pending[next]; !ok {
+				break
+			}
+			delete(pending, next)
+		}
+
+		if gap || next-1-acked >= uint16(s.windowSize) {
+			// Acknowledge complete windows, and let the sender know about filled gaps right away
+			gap = len(pending) > 0
+			if err := ack(next - 1); err != nil {
+				return err
+			}
+		} else {
+			// Should the rest of the window be lost, let the sender know where to resume from on the next timeout
+			s.prepareACK(next - 1)
+		}
+	}
+}
+
+// dally lingers for d once the final block has been received and acknowledged. Should our acknowledgement be lost,
+// the peer retransmits the final block, and is answered with the acknowledgement again rather than being left to time
+// out. Nothing else is done in the meantime, unless final blocks are checked strictly: DATA packets for other blocks
+// then reveal that the peer sent a short block before the end of the file, and abort the transfer with
+// ErrDataAfterFinalBlock. Errors received from the peer or the socket meanwhile are returned as well
+func (s *session) dally(d time.Duration) error {
+	// The transfer is complete, so it can't take too long anymore
+	s.expiry = time.Time{}
+	s.setState(StateDallying)
+	final := binary.BigEndian.Uint16(s.last[2:]) // The last datagram sent acknowledges the final block
+	for deadline := time.Now().Add(d); ; {
+		p, err := s.receiveUntil(deadline)
+		if err == errRetransmit {
+			// Nothing else arrived in time
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if dp, ok := p.(*DATAPacket); ok {
+			if s.strictFinalBlock && dp.BlockNumber != final {
+				return s.abort(ErrDataAfterFinalBlock)
+			}
+			_ = s.resend()
+		}
+	}
+}
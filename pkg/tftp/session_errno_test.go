@@ -0,0 +1,21 @@
+//go:build !plan9
+
+package tftp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestNetErrorConnRefused(t *testing.T) {
+	t.Run("Refused connections are reported as an unreachable peer", func(t *testing.T) {
+		cause := &net.OpError{Op: "read", Net: "udp", Err: os.NewSyscallError("recvfrom", syscall.ECONNREFUSED)}
+		err := netError("can't receive datagram", cause)
+		if !errors.Is(err, ErrPeerUnreachable) {
+			t.Fatalf("got %v want %v", err, ErrPeerUnreachable)
+		}
+	})
+}
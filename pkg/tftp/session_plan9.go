@@ -0,0 +1,6 @@
+package tftp
+
+// isConnRefused reports whether err tells that the peer refused the datagrams sent to it, which can't be told on Plan 9
+func isConnRefused(error) bool {
+	return false
+}
@@ -0,0 +1,628 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// expectACK fails the test unless the next packet received by p acknowledges the given block
+func expectACK(t *testing.T, p *testPeer, block uint16) {
+	t.Helper()
+	pkt, ok := p.receive().(*ACKPacket)
+	if !ok {
+		t.Fatalf("got %#v want ACK block %v", pkt, block)
+	}
+	if pkt.BlockNumber != block {
+		t.Fatalf("got ACK block %v want %v", pkt.BlockNumber, block)
+	}
+}
+
+func TestReceiveWindow(t *testing.T) {
+	blocks := [][]byte{
+		bytes.Repeat([]byte("1"), DefaultBlockSize),
+		bytes.Repeat([]byte("2"), DefaultBlockSize),
+		bytes.Repeat([]byte("3"), DefaultBlockSize),
+		bytes.Repeat([]byte("4"), DefaultBlockSize),
+		[]byte("5"),
+	}
+
+	t.Run("Reordered blocks are acknowledged from the last block received in order", func(t *testing.T) {
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		addr := startTestServer(t, h)
+
+		p := newTestPeer(t, addr)
+		p.send(&WRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{Name: "windowsize", Value: "4"}}})
+		oack, ok := p.receive().(*OACKPacket)
+		if !ok {
+			t.Fatalf("got %#v want an OACK packet", oack)
+		}
+		want := []Option{{Name: "windowsize", Value: "4"}}
+		if !reflect.DeepEqual(oack.Options, want) {
+			t.Fatalf("got %v want %v", oack.Options, want)
+		}
+
+		// Deliver blocks 1, 2 and 4: the gap must be reported by acknowledging block 2
+		for _, block := range []uint16{1, 2, 4} {
+			p.send(&DATAPacket{BlockNumber: block, Data: blocks[block-1]})
+		}
+		expectACK(t, p, 2)
+
+		// Once block 3 arrives, block 4 can be written as well
+		p.send(&DATAPacket{BlockNumber: 3, Data: blocks[2]})
+		expectACK(t, p, 4)
+
+		p.send(&DATAPacket{BlockNumber: 5, Data: blocks[4]})
+		expectACK(t, p, 5)
+
+		if got := readMapFile(t, h, "file.bin"); !bytes.Equal(got, bytes.Join(blocks, nil)) {
+			t.Fatalf("got %q want %q", got, bytes.Join(blocks, nil))
+		}
+	})
+
+	t.Run("Complete windows are acknowledged once", func(t *testing.T) {
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		addr := startTestServer(t, h)
+
+		p := newTestPeer(t, addr)
+		p.send(&WRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{Name: "windowsize", Value: "2"}}})
+		if oack, ok := p.receive().(*OACKPacket); !ok {
+			t.Fatalf("got %#v want an OACK packet", oack)
+		}
+
+		for block := uint16(1); block <= 4; block++ {
+			p.send(&DATAPacket{BlockNumber: block, Data: blocks[block-1]})
+		}
+		expectACK(t, p, 2)
+		expectACK(t, p, 4)
+
+		p.send(&DATAPacket{BlockNumber: 5, Data: blocks[4]})
+		expectACK(t, p, 5)
+	})
+}
+
+func TestSendWindow(t *testing.T) {
+	blocks := [][]byte{
+		bytes.Repeat([]byte("1"), DefaultBlockSize),
+		bytes.Repeat([]byte("2"), DefaultBlockSize),
+		bytes.Repeat([]byte("3"), DefaultBlockSize),
+		bytes.Repeat([]byte("4"), DefaultBlockSize),
+		[]byte("5"),
+	}
+	files := map[string][]byte{"file.bin": bytes.Join(blocks, nil)}
+
+	// startDownload sends a RRQ requesting a window of 4 blocks and acknowledges the OACK
+	startDownload := func(t *testing.T) *testPeer {
+		t.Helper()
+		p := newTestPeer(t, startTestServer(t, MapHandler(files)))
+		p.send(&RRQPacket{Filename: "file.bin", Mode: ModeOctet, Options: []Option{{Name: "windowsize", Value: "4"}}})
+		if oack, ok := p.receive().(*OACKPacket); !ok {
+			t.Fatalf("got %#v want an OACK packet", oack)
+		}
+		p.send(&ACKPacket{BlockNumber: 0})
+		return p
+	}
+
+	// expectDATA fails the test unless the next packets received by p are the given blocks
+	expectDATA := func(t *testing.T, p *testPeer, want ...uint16) {
+		t.Helper()
+		for _, block := range want {
+			dp, ok := p.receive().(*DATAPacket)
+			if !ok || dp.BlockNumber != block || !bytes.Equal(dp.Data, blocks[block-1]) {
+				t.Fatalf("got %#v want DATA block %v", dp, block)
+			}
+		}
+	}
+
+	t.Run("Acknowledging the last block of a window acknowledges the whole window", func(t *testing.T) {
+		p := startDownload(t)
+		expectDATA(t, p, 1, 2, 3, 4)
+		p.send(&ACKPacket{BlockNumber: 4})
+		expectDATA(t, p, 5)
+		p.send(&ACKPacket{BlockNumber: 5})
+	})
+
+	t.Run("Blocks following the one acknowledged within a window are sent again", func(t *testing.T) {
+		p := startDownload(t)
+		expectDATA(t, p, 1, 2, 3, 4)
+		p.send(&ACKPacket{BlockNumber: 2})
+		expectDATA(t, p, 3, 4, 5)
+		p.send(&ACKPacket{BlockNumber: 5})
+	})
+
+	t.Run("Windowed transfers complete in both directions", func(t *testing.T) {
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		addr := startTestServer(t, h)
+		want := bytes.Repeat([]byte("window"), 2000)
+
+		c := newTestClient(t, WithWindowSize(8))
+		tr, err := c.Upload(context.Background(), addr.String(), "file.bin", ModeOctet, bytes.NewReader(want))
+		if err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if tr.WindowSize() != 8 {
+			t.Fatalf("got window size %v want %v", tr.WindowSize(), 8)
+		}
+		got := bytes.Buffer{}
+		if err := c.Get(context.Background(), addr.String(), "file.bin", ModeOctet, &got); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+	})
+}
+
+func TestReceiveSequence(t *testing.T) {
+	// startUpload sends a WRQ to a server accepting uploads and waits for it to be acknowledged
+	startUpload := func(t *testing.T) (*MapFileHandler, *testPeer) {
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		p := newTestPeer(t, startTestServer(t, h))
+		p.send(&WRQPacket{Filename: "file.bin", Mode: ModeOctet})
+		expectACK(t, p, 0)
+		return h, p
+	}
+	full := bytes.Repeat([]byte("X"), DefaultBlockSize)
+
+	t.Run("In-order blocks are written", func(t *testing.T) {
+		h, p := startUpload(t)
+		p.send(&DATAPacket{BlockNumber: 1, Data: full})
+		expectACK(t, p, 1)
+		p.send(&DATAPacket{BlockNumber: 2, Data: []byte("end")})
+		expectACK(t, p, 2)
+
+		if got, want := readMapFile(t, h, "file.bin"), append(full, "end"...); !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes want %d", len(got), len(want))
+		}
+	})
+
+	t.Run("Repeated blocks are acknowledged again but not written", func(t *testing.T) {
+		h, p := startUpload(t)
+		p.send(&DATAPacket{BlockNumber: 1, Data: full})
+		expectACK(t, p, 1)
+		p.send(&DATAPacket{BlockNumber: 1, Data: full})
+		expectACK(t, p, 1)
+		p.send(&DATAPacket{BlockNumber: 2, Data: []byte("end")})
+		expectACK(t, p, 2)
+
+		if got, want := readMapFile(t, h, "file.bin"), append(full, "end"...); !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes want %d", len(got), len(want))
+		}
+	})
+
+	t.Run("Skipped blocks abort the transfer", func(t *testing.T) {
+		_, p := startUpload(t)
+		p.send(&DATAPacket{BlockNumber: 1, Data: full})
+		expectACK(t, p, 1)
+		p.send(&DATAPacket{BlockNumber: 3, Data: full})
+
+		pkt, ok := p.receive().(*ERRORPacket)
+		if !ok {
+			t.Fatalf("got %#v want an ERROR packet", pkt)
+		}
+		if pkt.ErrorCode != ErrorCodeNotDefined {
+			t.Fatalf("got error code %v want %v", pkt.ErrorCode, ErrorCodeNotDefined)
+		}
+	})
+
+	t.Run("Blocks jumping backward are answered with the last block received", func(t *testing.T) {
+		h, p := startUpload(t)
+		for block := uint16(1); block <= 3; block++ {
+			p.send(&DATAPacket{BlockNumber: block, Data: full})
+			expectACK(t, p, block)
+		}
+		p.send(&DATAPacket{BlockNumber: 1, Data: full})
+		expectACK(t, p, 3)
+		p.send(&DATAPacket{BlockNumber: 4, Data: []byte("end")})
+		expectACK(t, p, 4)
+
+		if got, want := readMapFile(t, h, "file.bin"), append(bytes.Repeat(full, 3), "end"...); !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes want %d", len(got), len(want))
+		}
+	})
+
+	t.Run("Peers flooding blocks jumping backward are given up on", func(t *testing.T) {
+		_, p := startUpload(t)
+		for block := uint16(1); block <= 3; block++ {
+			p.send(&DATAPacket{BlockNumber: block, Data: full})
+			expectACK(t, p, block)
+		}
+		for i := 0; i < DefaultMaxBlockAnomalies; i++ {
+			p.send(&DATAPacket{BlockNumber: 1, Data: full})
+			expectACK(t, p, 3)
+		}
+		p.send(&DATAPacket{BlockNumber: 1, Data: full})
+
+		pkt, ok := p.receive().(*ERRORPacket)
+		if !ok {
+			t.Fatalf("got %#v want an ERROR packet", pkt)
+		}
+		if pkt.ErrorCode != ErrorCodeNotDefined {
+			t.Fatalf("got error code %v want %v", pkt.ErrorCode, ErrorCodeNotDefined)
+		}
+	})
+
+	t.Run("Peers may be given up on at the first block jumping backward", func(t *testing.T) {
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		p := newTestPeer(t, startTestServer(t, h, WithMaxBlockAnomalies(0)))
+		p.send(&WRQPacket{Filename: "file.bin", Mode: ModeOctet})
+		expectACK(t, p, 0)
+		for block := uint16(1); block <= 3; block++ {
+			p.send(&DATAPacket{BlockNumber: block, Data: full})
+			expectACK(t, p, block)
+		}
+		p.send(&DATAPacket{BlockNumber: 1, Data: full})
+		if pkt, ok := p.receive().(*ERRORPacket); !ok {
+			t.Fatalf("got %#v want an ERROR packet", pkt)
+		}
+	})
+}
+
+func TestDefaultBlockSize(t *testing.T) {
+	t.Run("Transfers without options are sent in blocks of the default size", func(t *testing.T) {
+		want := bytes.Repeat([]byte("D"), 2*DefaultBlockSize+1)
+		p := newTestPeer(t, startTestServer(t, MapHandler(map[string][]byte{"file.bin": want})))
+		p.send(&RRQPacket{Filename: "file.bin", Mode: ModeOctet})
+
+		for block, size := range []int{DefaultBlockSize, DefaultBlockSize, 1} {
+			dp, ok := p.receive().(*DATAPacket)
+			if !ok || dp.BlockNumber != uint16(block+1) || len(dp.Data) != size {
+				t.Fatalf("got %#v want DATA %d with %d bytes", dp, block+1, size)
+			}
+			p.send(&ACKPacket{BlockNumber: dp.BlockNumber})
+		}
+	})
+
+	t.Run("The default block size is in effect unless blksize is negotiated", func(t *testing.T) {
+		tests := []struct {
+			options []Option
+			want    int
+		}{
+			{nil, DefaultBlockSize},
+			{[]Option{{Name: OptionWindowSize, Value: "4"}}, DefaultBlockSize},
+			{[]Option{{Name: OptionBlockSize, Value: "1428"}}, 1428},
+			{[]Option{{Name: OptionBlockSize, Value: "4"}}, DefaultBlockSize},
+			{[]Option{{Name: OptionBlockSize, Value: "large"}}, DefaultBlockSize},
+		}
+		for _, test := range tests {
+			if got := NegotiatedBlockSize(test.options); got != test.want {
+				t.Errorf("got %v want %v for %v", got, test.want, test.options)
+			}
+		}
+	})
+}
+
+func TestSessionFail(t *testing.T) {
+	t.Run("Aborting a transfer sends a single ERROR and closes the socket", func(t *testing.T) {
+		p := newTestPeer(t, nil)
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		sess := newSession(conn, p.conn.LocalAddr(), defaultTransferConfig())
+		err = sess.fail(ErrorCodeDiskFull, "no space left")
+		if !errors.Is(err, ErrorCodeDiskFull) {
+			t.Fatalf("got %v want %v", err, ErrorCodeDiskFull)
+		}
+		if err := sess.abort(ErrUnexpectedBlock); err != ErrUnexpectedBlock {
+			t.Fatalf("got %v want %v", err, ErrUnexpectedBlock)
+		}
+
+		pkt, ok := p.receive().(*ERRORPacket)
+		if !ok {
+			t.Fatalf("got %#v want an ERROR packet", pkt)
+		}
+		if pkt.ErrorCode != ErrorCodeDiskFull || pkt.ErrorMsg != "no space left" {
+			t.Fatalf("got %#v want ERROR %v", pkt, ErrorCodeDiskFull)
+		}
+
+		// No other datagram follows
+		if err := p.conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond)); err != nil {
+			t.Fatal(err)
+		}
+		if n, _, err := p.conn.ReadFrom(make([]byte, maxDatagramSize)); err == nil {
+			t.Fatalf("got an extra datagram of %d bytes", n)
+		}
+
+		if _, err := conn.WriteTo([]byte{0}, p.conn.LocalAddr()); err == nil {
+			t.Fatal("wanted an error but didn't get one")
+		}
+	})
+}
+
+// tickingReader moves a clock forward on every read
+type tickingReader struct {
+	r     io.Reader
+	clock *fakeClock
+	tick  time.Duration
+}
+
+func (r *tickingReader) Read(b []byte) (int, error) {
+	r.clock.mu.Lock()
+	r.clock.t = r.clock.t.Add(r.tick)
+	r.clock.mu.Unlock()
+	return r.r.Read(b)
+}
+
+func TestMaxTransferDuration(t *testing.T) {
+	// transfer sends data between two sessions connected in memory, while the sender's clock moves forward by tick
+	// for every block read
+	transfer := func(data []byte, maxDuration, tick time.Duration) (sent []byte, sendErr, receiveErr error) {
+		network := newMemNetwork()
+		senderConn, receiverConn := network.listen(), network.listen()
+		defer senderConn.Close()
+		defer receiverConn.Close()
+
+		cfg := defaultTransferConfig()
+		cfg.maxDuration = maxDuration
+		clock := &fakeClock{t: time.Now()}
+		sender := newSession(senderConn, receiverConn.LocalAddr(), cfg)
+		sender.now = clock.now
+		receiver := newSession(receiverConn, senderConn.LocalAddr(), defaultTransferConfig())
+		receiver.prepareACK(0)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- sender.sendFile(&tickingReader{bytes.NewReader(data), clock, tick})
+		}()
+		var buf bytes.Buffer
+		receiveErr = receiver.receiveFile(&buf, func() error { return nil })
+		return buf.Bytes(), <-done, receiveErr
+	}
+
+	t.Run("Transfers within the limit complete", func(t *testing.T) {
+		want := bytes.Repeat([]byte("M"), 10*DefaultBlockSize)
+		got, sendErr, receiveErr := transfer(want, time.Minute, time.Second)
+		if sendErr != nil {
+			t.Fatalf("got an error but didn't want one: %v", sendErr)
+		}
+		if receiveErr != nil {
+			t.Fatalf("got an error but didn't want one: %v", receiveErr)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got %d bytes want %d", len(got), len(want))
+		}
+	})
+
+	t.Run("Session clocks behind the wall clock don't cut waits short", func(t *testing.T) {
+		network := newMemNetwork()
+		senderConn, receiverConn := network.listen(), network.listen()
+		defer senderConn.Close()
+		defer receiverConn.Close()
+
+		clock := &fakeClock{t: time.Now().Add(-time.Hour)}
+		sender := newSession(senderConn, receiverConn.LocalAddr(), defaultTransferConfig())
+		sender.now = clock.now
+		sender.expiry = clock.now().Add(time.Minute)
+		receiver := newSession(receiverConn, senderConn.LocalAddr(), defaultTransferConfig())
+		receiver.prepareACK(0)
+
+		want := bytes.Repeat([]byte("M"), 10*DefaultBlockSize)
+		done := make(chan error, 1)
+		go func() {
+			done <- sender.sendFile(bytes.NewReader(want))
+		}()
+		// Make the sender wait for the first acknowledgement
+		time.Sleep(100 * time.Millisecond)
+		var got bytes.Buffer
+		if err := receiver.receiveFile(&got, func() error { return nil }); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), want) {
+			t.Fatalf("got %d bytes want %d", got.Len(), len(want))
+		}
+		if sender.retransmits != 0 {
+			t.Fatalf("got %v retransmissions want none", sender.retransmits)
+		}
+	})
+
+	t.Run("Healthy transfers exceeding the limit are aborted", func(t *testing.T) {
+		data := bytes.Repeat([]byte("M"), 10*DefaultBlockSize)
+		got, sendErr, receiveErr := transfer(data, time.Minute, 20*time.Second)
+		if !errors.Is(sendErr, ErrTransferTooLong) || !errors.Is(sendErr, ErrTimeout) {
+			t.Fatalf("got %v want %v", sendErr, ErrTransferTooLong)
+		}
+		var protocolErr ProtocolError
+		if !errors.As(receiveErr, &protocolErr) || protocolErr.Msg != ErrTransferTooLong.Error() {
+			t.Fatalf("got %v want %v", receiveErr, ErrTransferTooLong)
+		}
+		if len(got) >= len(data) {
+			t.Fatalf("got %d bytes want fewer than %d", len(got), len(data))
+		}
+	})
+}
+
+// BenchmarkACK compares marshalling a new ACK for every block with rewriting the session's ACK buffer in place
+func BenchmarkACK(b *testing.B) {
+	b.Run("Marshal", func(b *testing.B) {
+		s := &session{}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := s.prepare(&ACKPacket{BlockNumber: uint16(i)}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Reuse", func(b *testing.B) {
+		s := &session{}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			s.prepareACK(uint16(i))
+		}
+	})
+}
+
+// BenchmarkTransfer measures the throughput of a 1 MB transfer between two sessions connected in memory
+func BenchmarkTransfer(b *testing.B) {
+	data := bytes.Repeat([]byte{0x5A}, 1<<20)
+	for _, size := range []int{DefaultBlockSize, 8192} {
+		b.Run(fmt.Sprintf("blksize=%d", size), func(b *testing.B) {
+			network := newMemNetwork()
+			b.ReportAllocs()
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				senderConn, receiverConn := network.listen(), network.listen()
+				sender := newSession(senderConn, receiverConn.LocalAddr(), defaultTransferConfig())
+				receiver := newSession(receiverConn, senderConn.LocalAddr(), defaultTransferConfig())
+				sender.blockSize, receiver.blockSize = size, size
+				receiver.prepareACK(0)
+
+				done := make(chan error, 1)
+				go func() {
+					done <- sender.sendFile(bytes.NewReader(data))
+				}()
+				if err := receiver.receiveFile(io.Discard, func() error { return nil }); err != nil {
+					b.Fatal(err)
+				}
+				if err := <-done; err != nil {
+					b.Fatal(err)
+				}
+				_ = senderConn.Close()
+				_ = receiverConn.Close()
+			}
+		})
+	}
+}
+
+func TestPrepareACK(t *testing.T) {
+	t.Run("ACKs prepared in place match marshalled ones", func(t *testing.T) {
+		s := &session{}
+		for _, block := range []uint16{0, 1, 0x1234, 0xFFFF} {
+			s.prepareACK(block)
+			want := bytes.Buffer{}
+			if err := (&ACKPacket{BlockNumber: block}).Marshal(&want); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(s.last, want.Bytes()) {
+				t.Fatalf("got %x want %x", s.last, want.Bytes())
+			}
+		}
+	})
+}
+
+func TestNetError(t *testing.T) {
+	t.Run("Other errors are kept as they are", func(t *testing.T) {
+		cause := &net.OpError{Op: "read", Net: "udp", Err: net.ErrClosed}
+		err := netError("can't receive datagram", cause)
+		if errors.Is(err, ErrPeerUnreachable) {
+			t.Fatalf("got %v want an error other than %v", err, ErrPeerUnreachable)
+		}
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("got %v want %v", err, net.ErrClosed)
+		}
+	})
+}
+
+func TestUnexpectedOpcode(t *testing.T) {
+	// startDownload requests a file from a new server and receives its first block
+	startDownload := func(t *testing.T) *testPeer {
+		t.Helper()
+		data := bytes.Repeat([]byte("U"), 2*DefaultBlockSize)
+		p := newTestPeer(t, startTestServer(t, MapHandler(map[string][]byte{"file.bin": data})))
+		p.send(&RRQPacket{Filename: "file.bin", Mode: ModeOctet})
+		if pkt, ok := p.receive().(*DATAPacket); !ok || pkt.BlockNumber != 1 {
+			t.Fatalf("got %#v want DATA 1", pkt)
+		}
+		return p
+	}
+	expectIllegalOp := func(t *testing.T, p *testPeer) {
+		t.Helper()
+		for {
+			switch pkt := p.receive().(type) {
+			case *DATAPacket:
+				// A retransmission sent before the packet was received
+			case *ERRORPacket:
+				if pkt.ErrorCode != ErrorCodeIllegalOp {
+					t.Fatalf("got %#v want ERROR %v", pkt, ErrorCodeIllegalOp)
+				}
+				return
+			default:
+				t.Fatalf("got %#v want ERROR %v", pkt, ErrorCodeIllegalOp)
+			}
+		}
+	}
+
+	t.Run("OACKs received during transfers without options are refused", func(t *testing.T) {
+		p := startDownload(t)
+		p.send(&OACKPacket{Options: []Option{{Name: "blksize", Value: "1024"}}})
+		expectIllegalOp(t, p)
+	})
+
+	t.Run("Packets with unknown opcodes are refused", func(t *testing.T) {
+		p := startDownload(t)
+		if _, err := p.conn.WriteTo([]byte{0, 7, 0, 1}, p.remote); err != nil {
+			t.Fatal(err)
+		}
+		expectIllegalOp(t, p)
+	})
+
+	t.Run("Clients refuse OACKs received during transfers without options", func(t *testing.T) {
+		p := newTestPeer(t, nil)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			p.receive()
+			p.send(&DATAPacket{BlockNumber: 1, Data: make([]byte, DefaultBlockSize)})
+			expectACK(t, p, 1)
+			p.send(&OACKPacket{Options: []Option{{Name: "blksize", Value: "1024"}}})
+			if pkt, ok := p.receive().(*ERRORPacket); !ok || pkt.ErrorCode != ErrorCodeIllegalOp {
+				t.Errorf("got %#v want ERROR %v", pkt, ErrorCodeIllegalOp)
+			}
+		}()
+
+		c := newTestClient(t)
+		err := c.Get(context.Background(), p.conn.LocalAddr().String(), "file.bin", ModeOctet, &bytes.Buffer{})
+		<-done
+		if !errors.Is(err, ErrUnexpectedPacket) {
+			t.Fatalf("got %v want %v", err, ErrUnexpectedPacket)
+		}
+	})
+}
+
+func TestJoinErrors(t *testing.T) {
+	first := errors.New("first")
+	second := ProtocolError{Code: ErrorCodeDiskFull, Msg: "second"}
+
+	t.Run("Errors are returned as is if nothing is joined to them", func(t *testing.T) {
+		if got := joinErrors(first, nil, nil); got != first {
+			t.Fatalf("got %v want %v", got, first)
+		}
+		if got := joinErrors(nil, nil, first); got != first {
+			t.Fatalf("got %v want %v", got, first)
+		}
+		if got := joinErrors(nil, nil); got != nil {
+			t.Fatalf("got %v want no error", got)
+		}
+	})
+
+	t.Run("Joined errors match every error joined", func(t *testing.T) {
+		err := joinErrors(first, nil, second)
+		if want := "first\n" + second.Error(); err.Error() != want {
+			t.Fatalf("got %q want %q", err.Error(), want)
+		}
+		if !errors.Is(err, first) || !errors.Is(err, ErrorCodeDiskFull) {
+			t.Fatalf("got %v want it to match %v and %v", err, first, ErrorCodeDiskFull)
+		}
+		var protocolErr ProtocolError
+		if !errors.As(err, &protocolErr) || protocolErr != second {
+			t.Fatalf("got %v want %v", protocolErr, second)
+		}
+	})
+}
@@ -0,0 +1,14 @@
+//go:build !plan9 && !windows
+
+package tftp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isConnRefused reports whether err tells that the peer refused the datagrams sent to it, which happens when an ICMP
+// port unreachable message is received
+func isConnRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
@@ -0,0 +1,12 @@
+package tftp
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isConnRefused reports whether err tells that the peer refused the datagrams sent to it. Windows reports ICMP port
+// unreachable messages received on UDP sockets as a connection reset
+func isConnRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.WSAECONNRESET)
+}
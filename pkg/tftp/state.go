@@ -0,0 +1,51 @@
+package tftp
+
+import "net"
+
+// State type represents the stage a transfer is at
+type State int
+
+const (
+	// StateHandshake is the state of transfers waiting for the request to be answered, or for options to be agreed on
+	StateHandshake State = iota
+	// StateTransferring is the state of transfers exchanging DATA and ACK packets
+	StateTransferring
+	// StateDallying is the state of completed uploads lingering in case the final ACK is lost
+	StateDallying
+	// StateClosed is the state of transfers which are over, successfully or not
+	StateClosed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateHandshake:
+		return "handshake"
+	case StateTransferring:
+		return "transferring"
+	case StateDallying:
+		return "dallying"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// WithStateHook sets a function called whenever a transfer enters a new state, along with the address of the peer,
+// starting with StateHandshake and ending with StateClosed. This lets operators see where stuck transfers are at. The
+// function is called from the goroutine running the transfer, and may be called concurrently by several transfers
+func WithStateHook(fn func(peer net.Addr, state State)) TransferOption {
+	return transferOptionFunc(func(c *transferConfig) {
+		c.stateHook = fn
+	})
+}
+
+// setState moves the session to the given state, reporting it to the state hook
+func (s *session) setState(state State) {
+	if s.state == state {
+		return
+	}
+	s.state = state
+	if s.stateHook != nil {
+		s.stateHook(s.peer, state)
+	}
+}
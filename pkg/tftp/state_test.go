@@ -0,0 +1,86 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStateHook(t *testing.T) {
+	// recordStates returns a state hook sending the states entered to a channel
+	recordStates := func() (func(peer net.Addr, state State), <-chan State) {
+		states := make(chan State, 10)
+		return func(peer net.Addr, state State) {
+			states <- state
+		}, states
+	}
+	// expectStates receives states until the transfer is closed
+	expectStates := func(t *testing.T, states <-chan State, want []State) {
+		t.Helper()
+		var got []State
+		for len(got) == 0 || got[len(got)-1] != StateClosed {
+			select {
+			case state := <-states:
+				got = append(got, state)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("got states %v want %v", got, want)
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got states %v want %v", got, want)
+		}
+	}
+
+	t.Run("Uploads go through every state", func(t *testing.T) {
+		hook, states := recordStates()
+		h := MapHandler(nil)
+		h.AllowWrites = true
+		addr := startTestServer(t, h, WithStateHook(hook), WithDallyTimeout(10*time.Millisecond))
+		if err := newTestPeer(t, addr).put("file.bin", ModeOctet, []byte("data")); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		expectStates(t, states, []State{StateHandshake, StateTransferring, StateDallying, StateClosed})
+	})
+
+	t.Run("Downloads are closed once the file is received", func(t *testing.T) {
+		hook, states := recordStates()
+		addr := startTestServer(t, MapHandler(map[string][]byte{"file.bin": []byte("data")}))
+		c := newTestClient(t, WithStateHook(hook))
+		if err := c.Get(context.Background(), addr.String(), "file.bin", ModeOctet, &bytes.Buffer{}); err != nil {
+			t.Fatalf("got an error but didn't want one: %v", err)
+		}
+		expectStates(t, states, []State{StateHandshake, StateTransferring, StateClosed})
+	})
+
+	t.Run("Refused requests are closed during the handshake", func(t *testing.T) {
+		hook, states := recordStates()
+		addr := startTestServer(t, MapHandler(nil), WithStateHook(hook))
+		if _, err := newTestPeer(t, addr).get("missing.bin", ModeOctet); err == nil {
+			t.Fatal("wanted an error but didn't get one")
+		}
+		expectStates(t, states, []State{StateHandshake, StateClosed})
+	})
+}
+
+func TestStateString(t *testing.T) {
+	tests := []struct {
+		state State
+		want  string
+	}{
+		{StateHandshake, "handshake"},
+		{StateTransferring, "transferring"},
+		{StateDallying, "dallying"},
+		{StateClosed, "closed"},
+		{State(42), "unknown"},
+	}
+	for _, test := range tests {
+		t.Run("States are described as "+test.want, func(t *testing.T) {
+			if got := test.state.String(); got != test.want {
+				t.Fatalf("got %q want %q", got, test.want)
+			}
+		})
+	}
+}
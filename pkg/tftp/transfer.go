@@ -0,0 +1,102 @@
+package tftp
+
+import "time"
+
+// Transfer describes a completed transfer, including the parameters in effect after negotiating options with the peer
+type Transfer struct {
+	options    map[string]string
+	blockSize  int
+	windowSize int
+	timeout    time.Duration
+
+	bytes       int64
+	blocks      uint64
+	retransmits int
+	duration    time.Duration
+}
+
+// Result summarizes a completed transfer
+type Result struct {
+	// Bytes is the size of the file transferred
+	Bytes int64
+	// Blocks is the number of DATA packets the file was split into, not counting retransmissions
+	Blocks uint64
+	// Retransmits is the number of times a packet was sent again because the peer didn't reply in time
+	Retransmits int
+	// Duration is the time elapsed from the request until the transfer completed
+	Duration time.Duration
+	// Options holds the options acknowledged by the peer, keyed by name
+	Options map[string]string
+}
+
+func newTransfer(s *session, duration time.Duration) *Transfer {
+	t := &Transfer{
+		options:     make(map[string]string, len(s.options)),
+		blockSize:   s.blockSize,
+		windowSize:  s.windowSize,
+		timeout:     s.timeout,
+		bytes:       s.bytes,
+		blocks:      s.blocks,
+		retransmits: s.retransmits,
+		duration:    duration,
+	}
+	for _, option := range s.options {
+		t.options[option.Name] = option.Value
+	}
+	return t
+}
+
+// Options returns the options acknowledged by the peer, keyed by name. Options which were not acknowledged are absent
+func (t *Transfer) Options() map[string]string {
+	options := make(map[string]string, len(t.options))
+	for name, value := range t.options {
+		options[name] = value
+	}
+	return options
+}
+
+// BlockSize returns the size of the blocks the file was transferred in
+func (t *Transfer) BlockSize() int {
+	return t.blockSize
+}
+
+// WindowSize returns the number of blocks sent before waiting for an acknowledgement
+func (t *Transfer) WindowSize() int {
+	return t.windowSize
+}
+
+// Timeout returns the time waited for a packet before retransmitting
+func (t *Transfer) Timeout() time.Duration {
+	return t.timeout
+}
+
+// Result returns the figures of the transfer
+func (t *Transfer) Result() Result {
+	return Result{
+		Bytes:       t.bytes,
+		Blocks:      t.blocks,
+		Retransmits: t.retransmits,
+		Duration:    t.duration,
+		Options:     t.Options(),
+	}
+}
+
+// EstimateDuration estimates the time taken to transfer a file of the given size over a path with the given round-trip
+// time, ignoring the time taken to send the data itself. Every window of blocks costs a round trip, since the sender
+// waits for its acknowledgement before sending the next one, and files are split into blocks as usual: the final block
+// is shorter than the block size, so files whose size is a multiple of it take an extra, empty one. Block sizes which
+// are not positive stand for DefaultBlockSize, and window sizes which are not positive for lock-step transfers
+func EstimateDuration(size int64, blockSize, windowSize int, rtt time.Duration) time.Duration {
+	if size < 0 {
+		size = 0
+	}
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	if windowSize <= 0 {
+		windowSize = 1
+	}
+	blocks := size/int64(blockSize) + 1
+	windows := (blocks + int64(windowSize) - 1) / int64(windowSize)
+	return time.Duration(windows) * rtt
+}
@@ -0,0 +1,42 @@
+package tftp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEstimateDuration(t *testing.T) {
+	const rtt = 10 * time.Millisecond
+	const size = 1 << 20 // 2048 full blocks of 512 bytes, followed by an empty one
+
+	tests := []struct {
+		name       string
+		size       int64
+		blockSize  int
+		windowSize int
+		want       time.Duration
+	}{
+		{"Lock-step transfers take a round trip per block", size, 512, 1, 2049 * rtt},
+		{"Windowed transfers take a round trip per window", size, 512, 8, 257 * rtt},
+		{"Larger blocks take fewer round trips", size, 1024, 1, 1025 * rtt},
+		{"Empty files take a round trip", 0, 512, 8, rtt},
+		{"Files shorter than a block take a round trip", 100, 512, 1, rtt},
+		{"Invalid block sizes stand for the default one", size, 0, 1, 2049 * rtt},
+		{"Invalid window sizes stand for lock-step transfers", size, 512, 0, 2049 * rtt},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := EstimateDuration(test.size, test.blockSize, test.windowSize, rtt); got != test.want {
+				t.Fatalf("got %v want %v", got, test.want)
+			}
+		})
+	}
+
+	t.Run("Windows of 8 blocks are nearly 8 times faster than lock-step transfers", func(t *testing.T) {
+		lockstep := EstimateDuration(size, 512, 1, rtt)
+		windowed := EstimateDuration(size, 512, 8, rtt)
+		if speedup := float64(lockstep) / float64(windowed); speedup < 7.9 || speedup > 8 {
+			t.Fatalf("got a speedup of %.2f want nearly 8", speedup)
+		}
+	})
+}